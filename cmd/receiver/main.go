@@ -26,7 +26,11 @@ func main() {
 	}
 
 	ctx, cancel := context.WithCancel(context.Background()) // Create a cancelable context and pass it to all goroutines, allows us to gracefully shut down the program
-	receiver.Receiver(ctx, db, conf)
+	if err := receiver.Receiver(ctx, db, conf); err != nil {
+		logrus.Errorf("Failed starting receiver with err %v", err)
+		cancel()
+		return
+	}
 
 	<-utils.CtrlC()
 	cancel() // Gracefully shutdown and stop all goroutines
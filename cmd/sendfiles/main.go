@@ -1,16 +1,25 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"oneway-filesync/pkg/config"
 	"oneway-filesync/pkg/database"
+	"oneway-filesync/pkg/spool"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s <file/dir_path>\n", os.Args[0])
+	priority := flag.Int("priority", 0, "Files with a higher priority are sent first and preempt lower ones")
+	compress := flag.Bool("compress", false, "Compress the files on the way, files that are compressed already are sent as they are")
+	copies := flag.Int("copies", 1, "How many times each file is sent")
+	spacing := flag.Duration("spacing", 0, "Minimal time between the copies of a file, e.g. 10m")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Printf("Usage: %s [-priority <priority>] [-compress] [-copies <copies>] [-spacing <duration>] <file/dir_path>\n", os.Args[0])
 		return
 	}
 
@@ -26,15 +35,39 @@ func main() {
 		return
 	}
 
-	path := os.Args[1]
+	opts := database.SendOptions{
+		Encrypted:   conf.EncryptedOutput,
+		Compress:    *compress,
+		Priority:    *priority,
+		Copies:      *copies,
+		CopySpacing: *spacing,
+	}
+	sp, err := spool.OpenSpool(conf.SpoolDir, conf.SpoolSizeLimit)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	path := flag.Arg(0)
+	// Directories are queued too so that empty ones and their modes arrive, Walk lists them before their contents
 	err = filepath.Walk(path, func(filepath string, info os.FileInfo, e error) error {
-		if !info.IsDir() {
-			err := database.QueueFileForSending(db, filepath, conf.EncryptedOutput)
-			if err != nil {
-				fmt.Printf("%v\n", err)
-			} else {
-				fmt.Printf("File '%s' queued for sending\n", filepath)
-			}
+		if e != nil {
+			fmt.Printf("%v\n", e)
+			return nil
+		}
+		err := sp.QueueFile(db, filepath, opts)
+		if errors.Is(err, spool.ErrSpoolFull) {
+			fmt.Printf("Spool is full, waiting for room for '%s'\n", filepath)
+		}
+		for errors.Is(err, spool.ErrSpoolFull) {
+			// Waits for the sender to send and remove enough snapshots
+			time.Sleep(time.Second)
+			err = sp.QueueFile(db, filepath, opts)
+		}
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		} else {
+			fmt.Printf("File '%s' queued for sending\n", filepath)
 		}
 		return nil
 	})
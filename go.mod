@@ -6,11 +6,14 @@ require (
 	github.com/BurntSushi/toml v1.2.1
 	github.com/danlapid/socketbuffer v1.0.0
 	github.com/glebarez/sqlite v1.6.0
+	github.com/klauspost/compress v1.17.4
 	github.com/klauspost/reedsolomon v1.11.5
 	github.com/rjeczalik/notify v0.9.3
 	github.com/sirupsen/logrus v1.9.0
 	github.com/yeka/zip v0.0.0-20180914125537-d046722c6feb
 	github.com/zhuangsirui/binpacker v2.0.0+incompatible
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.13.0
 	golang.org/x/time v0.3.0
 	gorm.io/driver/sqlite v1.4.4
 	gorm.io/gorm v1.24.3
@@ -25,8 +28,7 @@ require (
 	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/mattn/go-sqlite3 v1.14.15 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20200410134404-eec4a21b6bb0 // indirect
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
-	golang.org/x/sys v0.0.0-20220829200755-d48e67d00261 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
 	modernc.org/libc v1.21.5 // indirect
 	modernc.org/mathutil v1.5.0 // indirect
 	modernc.org/memory v1.4.0 // indirect
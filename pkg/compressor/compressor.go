@@ -0,0 +1,143 @@
+// Compresses chunk data on the sender and decompresses it on the receiver
+// Every chunk is compressed on its own so losing one doesn't affect the others,
+// chunks keep the offset of their uncompressed data so the receiver writes them as before
+package compressor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"oneway-filesync/pkg/structs"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+// Chunks that don't shrink below this fraction of their size are sent as they are,
+// the receiver would spend more on decompressing them than the link saves
+const maxCompressedRatio = 0.95
+
+// Magic numbers of formats that are compressed already
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'B', 'Z', 'h'},                    // bzip2
+	{'P', 'K', 0x03, 0x04},             // zip and the office formats based on it
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{'R', 'a', 'r', '!', 0x1a, 0x07},   // rar
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{'G', 'I', 'F', '8'},               // gif
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+	{0x1a, 0x45, 0xdf, 0xa3},           // matroska and webm
+}
+
+// Reports whether the start of a file belongs to a format that is compressed already,
+// such files skip the compressor altogether
+func AlreadyCompressed(head []byte) bool {
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+type compressorConfig struct {
+	input  chan *structs.Chunk
+	output chan *structs.Chunk
+}
+
+func compressWorker(ctx context.Context, conf *compressorConfig) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		logrus.Errorf("Error creating zstd encoder: %v", err)
+		return
+	}
+	defer encoder.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case chunk := <-conf.input:
+			if chunk.Compress && chunk.Type == structs.PacketTypeShare {
+				compressed := encoder.EncodeAll(chunk.Data, make([]byte, 0, len(chunk.Data)))
+				if float64(len(compressed)) < float64(len(chunk.Data))*maxCompressedRatio {
+					chunk.Data = compressed
+					chunk.Compressed = true
+				}
+			}
+			conf.output <- chunk
+		}
+	}
+}
+
+func CreateCompressor(ctx context.Context, input chan *structs.Chunk, output chan *structs.Chunk, workercount int) {
+	conf := compressorConfig{
+		input:  input,
+		output: output,
+	}
+	for i := 0; i < workercount; i++ {
+		go compressWorker(ctx, &conf)
+	}
+}
+
+type decompressorConfig struct {
+	maxsize int
+	input   chan *structs.Chunk
+	output  chan *structs.Chunk
+}
+
+func decompress(decoder *zstd.Decoder, data []byte, maxsize int) ([]byte, error) {
+	decompressed, err := decoder.DecodeAll(data, make([]byte, 0, maxsize))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxsize {
+		return nil, fmt.Errorf("decompressed to %d bytes, more than a chunk of %d bytes", len(decompressed), maxsize)
+	}
+	return decompressed, nil
+}
+
+func decompressWorker(ctx context.Context, conf *decompressorConfig) {
+	// The memory limit keeps a malicious or corrupt chunk from decompressing into something huge
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(conf.maxsize)))
+	if err != nil {
+		logrus.Errorf("Error creating zstd decoder: %v", err)
+		return
+	}
+	defer decoder.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case chunk := <-conf.input:
+			if chunk.Compressed {
+				data, err := decompress(decoder, chunk.Data, conf.maxsize)
+				if err != nil {
+					logrus.WithFields(logrus.Fields{
+						"TransferId": chunk.TransferId.String(),
+						"DataOffset": chunk.DataOffset,
+					}).Errorf("Error decompressing chunk: %v", err)
+					continue
+				}
+				chunk.Data = data
+				chunk.Compressed = false
+			}
+			conf.output <- chunk
+		}
+	}
+}
+
+// maxsize is the size of the uncompressed data of a chunk, nothing decompresses beyond it
+func CreateDecompressor(ctx context.Context, maxsize int, input chan *structs.Chunk, output chan *structs.Chunk, workercount int) {
+	conf := decompressorConfig{
+		maxsize: maxsize,
+		input:   input,
+		output:  output,
+	}
+	for i := 0; i < workercount; i++ {
+		go decompressWorker(ctx, &conf)
+	}
+}
@@ -0,0 +1,101 @@
+package compressor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"oneway-filesync/pkg/structs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestAlreadyCompressed(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{"test-gzip", []byte{0x1f, 0x8b, 0x08, 0x00}, true},
+		{"test-zip", []byte("PK\x03\x04rest"), true},
+		{"test-png", []byte("\x89PNG\r\n\x1a\n"), true},
+		{"test-text", []byte("id,name,value\n"), false},
+		{"test-empty", []byte{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AlreadyCompressed(tt.head); got != tt.want {
+				t.Errorf("AlreadyCompressed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	text := []byte(strings.Repeat("timestamp,level,message\n2022-01-01,INFO,all is well\n", 200))
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		chunk          structs.Chunk
+		wantCompressed bool
+	}{
+		{"test-text", structs.Chunk{Type: structs.PacketTypeShare, Data: text, Compress: true}, true},
+		{"test-not-requested", structs.Chunk{Type: structs.PacketTypeShare, Data: text}, false},
+		{"test-incompressible", structs.Chunk{Type: structs.PacketTypeShare, Data: random, Compress: true}, false},
+		{"test-manifest", structs.Chunk{Type: structs.PacketTypeManifest, Data: text, Compress: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sent := make(chan *structs.Chunk, 1)
+			compressed := make(chan *structs.Chunk, 1)
+			onwire := make(chan *structs.Chunk, 1)
+			received := make(chan *structs.Chunk, 1)
+			CreateCompressor(ctx, sent, compressed, 1)
+			CreateDecompressor(ctx, len(text), onwire, received, 1)
+
+			original := append([]byte(nil), tt.chunk.Data...)
+			chunk := tt.chunk
+			sent <- &chunk
+
+			select {
+			case got := <-compressed:
+				if got.Compressed != tt.wantCompressed {
+					t.Fatalf("Chunk was compressed on the wire = %v, want %v", got.Compressed, tt.wantCompressed)
+				}
+				onwire <- got
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Chunk never came out of the compressor")
+			}
+			select {
+			case got := <-received:
+				if !bytes.Equal(got.Data, original) {
+					t.Fatalf("Received %d bytes that differ from the %d sent", len(got.Data), len(original))
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Chunk never came out of the decompressor")
+			}
+		})
+	}
+}
+
+func Test_decompress_too_big(t *testing.T) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bomb := encoder.EncodeAll(make([]byte, 1<<20), nil)
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(8192))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decompress(decoder, bomb, 8192); err == nil {
+		t.Fatalf("Decompressing beyond the chunk size succeeded")
+	}
+}
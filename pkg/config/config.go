@@ -1,19 +1,46 @@
 package config
 
 import (
+	"time"
+
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
 	ReceiverIP       string
 	ReceiverPort     int
+	Transport        string
+	TransportDevice  string
+	UdpBatchSize     int
+	UdpOffload       bool
+	UdpSockets       int
+	UdpReadBuffer    int
 	BandwidthLimit   int
 	ChunkSize        int
 	EncryptedOutput  bool
 	ChunkFecRequired int
 	ChunkFecTotal    int
+	InterleaveDepth  int
+	ShareCacheLimit  int64
 	OutDir           string
+	TempFileMaxAge   time.Duration
 	WatchDir         string
+	WatchPriority    int
+	WatchCompress    bool
+	WatchCopies      int
+	WatchCopySpacing time.Duration
+	SenderId         string
+	ResumePolicy     string
+	IdleFillWindow   time.Duration
+	SpoolDir         string
+	SpoolSizeLimit   int64
+	MirrorPolicy     string
+	ArchiveDir       string
+	FileMode         uint32
+	DirMode          uint32
+	Ownership        string
+
+	AllowUnsafeSymlinks bool
 }
 
 func GetConfig(file string) (Config, error) {
@@ -5,6 +5,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestGetConfig(t *testing.T) {
@@ -22,23 +23,72 @@ func TestGetConfig(t *testing.T) {
 			args: args{configtext: `
 				ReceiverIP = "127.0.0.1"
 				ReceiverPort = 5000
+				Transport = "device"
+				TransportDevice = "/dev/ttyS0"
+				UdpBatchSize = 64
+				UdpOffload = true
+				UdpSockets = 4
+				UdpReadBuffer = 33554432
 				BandwidthLimit = 10000000
 				ChunkSize = 8192
 				EncryptedOutput = true
 				ChunkFecRequired = 5
 				ChunkFecTotal = 10
+				InterleaveDepth = 8
+				ShareCacheLimit = 67108864
 				OutDir = "./out"
-				WatchDir = "./tmp"`},
+				TempFileMaxAge = "168h"
+				WatchDir = "./tmp"
+				WatchPriority = 2
+				WatchCompress = true
+				WatchCopies = 3
+				WatchCopySpacing = "10m"
+				SenderId = "diode-a"
+				ResumePolicy = "restart"
+				IdleFillWindow = "1h"
+				SpoolDir = "./spool"
+				SpoolSizeLimit = 1073741824
+				MirrorPolicy = "apply"
+				ArchiveDir = "./archive"
+				FileMode = 0o640
+				DirMode = 0o750
+				Ownership = "1000:100"
+				AllowUnsafeSymlinks = true`},
 			want: config.Config{
 				ReceiverIP:       "127.0.0.1",
 				ReceiverPort:     5000,
+				Transport:        "device",
+				TransportDevice:  "/dev/ttyS0",
+				UdpBatchSize:     64,
+				UdpOffload:       true,
+				UdpSockets:       4,
+				UdpReadBuffer:    32 << 20,
 				BandwidthLimit:   10000000,
 				ChunkSize:        8192,
 				EncryptedOutput:  true,
 				ChunkFecRequired: 5,
 				ChunkFecTotal:    10,
+				InterleaveDepth:  8,
+				ShareCacheLimit:  64 << 20,
 				OutDir:           "./out",
+				TempFileMaxAge:   168 * time.Hour,
 				WatchDir:         "./tmp",
+				WatchPriority:    2,
+				WatchCompress:    true,
+				WatchCopies:      3,
+				WatchCopySpacing: 10 * time.Minute,
+				SenderId:         "diode-a",
+				ResumePolicy:     "restart",
+				IdleFillWindow:   time.Hour,
+				SpoolDir:         "./spool",
+				SpoolSizeLimit:   1 << 30,
+				MirrorPolicy:     "apply",
+				ArchiveDir:       "./archive",
+				FileMode:         0o640,
+				DirMode:          0o750,
+				Ownership:        "1000:100",
+
+				AllowUnsafeSymlinks: true,
 			},
 			wantErr: false,
 		},
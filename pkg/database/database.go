@@ -1,25 +1,53 @@
 package database
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"oneway-filesync/pkg/structs"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	gormlogger "gorm.io/gorm/logger"
 	"gorm.io/gorm/schema"
 )
 
 type File struct {
 	gorm.Model
-	Path      string `json:"path"`      // Original file path in source machine
-	Hash      []byte `json:"hash"`      // Hash of the file for completeness validation
-	Encrypted bool   `json:"encrypted"` // Whether or not the file is packed as zip
-	Started   bool   `json:"started"`   // Whether or not the file started being sent
-	Finished  bool   `json:"finished"`  // Whether or not the file was sent/recieved successfully
-	Success   bool   `json:"success"`   // Whether or not the finish was successfull
+	TransferId []byte `json:"transferid" gorm:"index"`         // Random id identifying the transfer on the wire
+	Path       string `json:"path"`                            // Original file path in source machine
+	Hash       []byte `json:"hash"`                            // Hash of the bytes sent for completeness validation, known once sending is done
+	Encrypted  bool   `json:"encrypted"`                       // Whether or not the file is packed as zip
+	Compress   bool   `json:"compress"`                        // Whether or not the file is compressed on the way, unless its content is compressed already
+	Started    bool   `json:"started"`                         // Whether or not the file started being sent
+	Finished   bool   `json:"finished"`                        // Whether or not the file was sent/recieved successfully
+	Success    bool   `json:"success"`                         // Whether or not the finish was successfull
+	SentOffset int64  `json:"sentoffset"`                      // Offset up to which the file was surely sent, used for resuming
+	Priority   int    `json:"priority" gorm:"index;default:0"` // Files with a higher priority are sent first and preempt lower ones
+
+	Owner       string    `json:"owner"`       // Sender process holding the lease on the file
+	LeaseExpiry time.Time `json:"leaseexpiry"` // The file may be taken over by another sender after this time
+
+	Copies      int           `json:"copies"`      // How many times the file is sent, all copies share the transfer id so the receiver merges them
+	CopiesSent  int           `json:"copiessent"`  // How many copies were sent so far
+	CopySpacing time.Duration `json:"copyspacing"` // Minimal time between the copies
+	NotBefore   time.Time     `json:"notbefore"`   // The file isn't claimed before this time
+	SentAt      time.Time     `json:"sentat"`      // When the first copy was successfully sent, used for idle fill, cleared once an idle fill copy fails
+	SentSize    int64         `json:"sentsize"`    // Size of the file when the first copy was sent, idle fill is skipped once it changes
+	SentModTime int64         `json:"sentmodtime"` // Modification time of the file when the first copy was sent, idle fill is skipped once it changes
+	IdleFill    bool          `json:"idlefill"`    // Whether the file is being sent again as idle fill, which leaves its result and priority as they were
+
+	Op       structs.Op `json:"op" gorm:"default:0"` // What is done with the path, only writes carry data
+	Target   string     `json:"target"`              // New path of a rename
+	Sequence int64      `json:"sequence"`            // Orders the transfers of a path, taken when the file is queued
+
+	SpoolPath     string            `json:"spoolpath"`                            // Snapshot of the file that is sent instead of the live file, already zipped if encrypted
+	SpoolMetadata *structs.Metadata `json:"spoolmetadata" gorm:"serializer:json"` // Metadata of the file when the snapshot was taken, the snapshot itself is owned by the sender
 }
 type ReceivedFile struct {
 	File
@@ -50,6 +78,310 @@ func OpenDatabase(tableprefix string) (*gorm.DB, error) {
 	return db, nil
 }
 
+const (
+	ResumePolicyResume  = "resume"  // Interrupted files and files taken over from an expired lease continue from their saved offset
+	ResumePolicyRestart = "restart" // Interrupted files and files taken over from an expired lease are sent again from the start
+)
+
+func ValidateResumePolicy(policy string) error {
+	switch policy {
+	case ResumePolicyResume, ResumePolicyRestart, "":
+		return nil
+	default:
+		return fmt.Errorf("unknown resume policy '%s'", policy)
+	}
+}
+
+// How long a claimed file stays with its sender without the lease being renewed,
+// the files of a sender that died are taken over by any sender sharing the queue once it passes
+const LeaseDuration = time.Minute
+
+var ErrLeaseLost = errors.New("lease was taken over by another sender")
+
+// Identifies a sender in the leases it holds
+// A senderid set in the configuration stays the same across restarts so a sender takes the files it was sending
+// when it stopped right back instead of waiting for their leases to expire, senders sharing a queue must each have their own
+// Without one every process gets an id of its own and its files are taken over once their leases expire
+func OwnerId(senderid string) string {
+	if senderid != "" {
+		return senderid
+	}
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%x", hostname, os.Getpid(), suffix)
+}
+
+// Files owner was sending when it stopped are queued again on startup, under the resume policy,
+// keeping their transfer id so the receiver can merge them into the tempfile it already has
+// Idle fill copies are dropped, the files go back to being finished
+// Returns the number of files requeued
+func RequeueInterrupted(db *gorm.DB, owner string, policy string) (int64, error) {
+	if err := ValidateResumePolicy(policy); err != nil {
+		return 0, err
+	}
+	err := db.Model(&File{}).
+		Where("idle_fill = ? AND finished = ? AND owner = ?", true, false, owner).
+		Updates(map[string]interface{}{"finished": true, "idle_fill": false}).Error
+	if err != nil {
+		return 0, err
+	}
+	updates := map[string]interface{}{
+		"started": false,
+		"owner":   "",
+	}
+	if policy == ResumePolicyRestart {
+		updates["sent_offset"] = 0
+	}
+	result := db.Model(&File{}).
+		Where("started = ? AND finished = ? AND idle_fill = ? AND owner = ?", true, false, false, owner).
+		Updates(updates)
+	return result.RowsAffected, result.Error
+}
+
+// Atomically claims the highest priority (then oldest) file that is either waiting to be sent or whose lease expired,
+// so several senders can share one queue without sending the same file twice.
+// A sender doesn't claim files of a lower priority than one it is already sending, they continue once it is done,
+// idle fill copies don't count since any queued file preempts them.
+// A file taken over from an expired lease keeps its transfer id so the receiver merges it into the tempfile it already has,
+// the resume policy decides whether it continues from its saved offset.
+// Returns gorm.ErrRecordNotFound when there is nothing to claim
+func ClaimFile(db *gorm.DB, owner string, policy string) (File, error) {
+	var file File
+	if err := ValidateResumePolicy(policy); err != nil {
+		return file, err
+	}
+
+	now := time.Now().UTC()
+	updates := map[string]interface{}{
+		"started":      true,
+		"owner":        owner,
+		"lease_expiry": now.Add(LeaseDuration),
+	}
+	if policy == ResumePolicyRestart {
+		updates["sent_offset"] = gorm.Expr("CASE WHEN started THEN 0 ELSE sent_offset END")
+	}
+	inflight := db.Model(&File{}).
+		Select("MAX(priority)").
+		Where("finished = ? AND idle_fill = ? AND started = ? AND owner = ? AND lease_expiry >= ?", false, false, true, owner, now)
+	// A transfer waits for the transfers of its paths queued before it, so they leave in the order they were queued
+	table := db.NamingStrategy.TableName("File")
+	earlier := db.Table(table+" AS earlier").
+		Select("1").
+		Where("earlier.deleted_at IS NULL AND earlier.finished = ? AND earlier.idle_fill = ?", false, false).
+		Where("earlier.sequence < " + table + ".sequence").
+		Where("earlier.path = " + table + ".path OR (" + table + ".target <> '' AND earlier.path = " + table + ".target) OR " +
+			"(earlier.target <> '' AND earlier.target IN (" + table + ".path, " + table + ".target))")
+	next := db.Model(&File{}).
+		Select("id").
+		Where("finished = ? AND idle_fill = ? AND (started = ? OR lease_expiry IS NULL OR lease_expiry < ?)", false, false, false, now).
+		Where("not_before IS NULL OR not_before <= ?", now).
+		Where("NOT EXISTS (?)", earlier).
+		Where("priority >= COALESCE((?), priority)", inflight).
+		Order("priority desc, id").
+		Limit(1)
+	result := db.Model(&file).
+		Clauses(clause.Returning{}).
+		Where("id = (?)", next).
+		Updates(updates)
+	if result.Error != nil {
+		return file, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return file, gorm.ErrRecordNotFound
+	}
+	return file, nil
+}
+
+// Extends the lease on a claimed file and saves the offset it can be resumed from,
+// fails with ErrLeaseLost if another sender took the file over in the meantime
+func RenewLease(db *gorm.DB, file *File, sentoffset int64) error {
+	result := db.Model(&File{}).
+		Where("id = ? AND owner = ? AND finished = ?", file.ID, file.Owner, false).
+		Updates(map[string]interface{}{
+			"sent_offset":  sentoffset,
+			"lease_expiry": time.Now().UTC().Add(LeaseDuration),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLeaseLost
+	}
+	file.SentOffset = sentoffset
+	return nil
+}
+
+// Gives a claimed file back to the queue so it continues from sentoffset when it is claimed again,
+// an idle fill copy is dropped instead and the file goes back to being finished.
+// Fails with ErrLeaseLost if another sender took the file over in the meantime
+func ReleaseFile(db *gorm.DB, file *File, sentoffset int64) error {
+	updates := map[string]interface{}{
+		"started":     false,
+		"owner":       "",
+		"sent_offset": sentoffset,
+	}
+	if file.IdleFill {
+		updates = map[string]interface{}{
+			"finished":  true,
+			"idle_fill": false,
+		}
+	}
+	result := db.Model(&File{}).
+		Where("id = ? AND owner = ? AND finished = ?", file.ID, file.Owner, false).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLeaseLost
+	}
+	if file.IdleFill {
+		file.Finished = true
+		file.IdleFill = false
+		return nil
+	}
+	file.Started = false
+	file.SentOffset = sentoffset
+	return nil
+}
+
+// Reports whether file should give way to a file of higher priority,
+// either one its owner already claimed or one that has been waiting in the queue since before waitingsince,
+// an idle fill copy gives way to any file
+func HigherPriority(db *gorm.DB, file *File, waitingsince time.Time) (bool, error) {
+	var count int64
+	now := time.Now().UTC()
+	query := db.Model(&File{}).Where("finished = ? AND idle_fill = ?", false, false)
+	if !file.IdleFill {
+		query = query.Where("priority > ?", file.Priority)
+	}
+	err := query.
+		Where(db.Where("started = ? AND owner = ? AND lease_expiry >= ?", true, file.Owner, now).
+			Or("(started = ? OR lease_expiry IS NULL OR lease_expiry < ?) AND updated_at < ?", false, now, waitingsince)).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// Atomically claims the successfully sent file that was re-sent longest ago among those first sent within window,
+// as another copy of it, but only when owner has nothing else in flight so it uses nothing but idle bandwidth.
+// The copy is marked as idle fill so the file keeps its priority and result, and one whose sender died is claimed again.
+// Deletes and renames aren't sent again since a late copy could undo whatever happened to the path since.
+// Returns gorm.ErrRecordNotFound when there is nothing to claim
+func ClaimIdleFill(db *gorm.DB, owner string, window time.Duration) (File, error) {
+	var file File
+	now := time.Now().UTC()
+	inflight := db.Model(&File{}).
+		Select("id").
+		Where("finished = ? AND started = ? AND owner = ? AND lease_expiry >= ?", false, true, owner, now)
+	next := db.Model(&File{}).
+		Select("id").
+		Where("success = ? AND sent_at >= ? AND op = ?", true, now.Add(-window), structs.OpWrite).
+		Where(db.Where("finished = ?", true).
+			Or("idle_fill = ? AND (lease_expiry IS NULL OR lease_expiry < ?)", true, now)).
+		Where("NOT EXISTS (?)", inflight).
+		Order("updated_at, id").
+		Limit(1)
+	result := db.Model(&file).
+		Clauses(clause.Returning{}).
+		Where("id = (?)", next).
+		Updates(map[string]interface{}{
+			"started":      true,
+			"finished":     false,
+			"owner":        owner,
+			"lease_expiry": now.Add(LeaseDuration),
+			"sent_offset":  0,
+			"idle_fill":    true,
+		})
+	if result.Error != nil {
+		return file, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return file, gorm.ErrRecordNotFound
+	}
+	return file, nil
+}
+
+// Marks a claimed file as finished with its result,
+// a successfully sent file with copies left is queued again for the next copy instead.
+// An idle fill copy leaves the result of the file as it was, only a failed one takes the file out of idle fill.
+// Fails with ErrLeaseLost if another sender took the file over in the meantime
+func FinishFile(db *gorm.DB, file *File) error {
+	if file.IdleFill {
+		return finishIdleFill(db, file)
+	}
+	now := time.Now().UTC()
+	updates := map[string]interface{}{
+		"hash":    file.Hash,
+		"success": file.Success,
+	}
+	copiessent := file.CopiesSent
+	if file.Success {
+		copiessent++
+		updates["copies_sent"] = copiessent
+		if file.SentAt.IsZero() {
+			updates["sent_at"] = now
+			updates["sent_size"] = file.SentSize
+			updates["sent_mod_time"] = file.SentModTime
+		}
+	}
+	again := file.Success && copiessent < file.Copies
+	if again {
+		updates["started"] = false
+		updates["owner"] = ""
+		updates["sent_offset"] = 0
+		updates["not_before"] = now.Add(file.CopySpacing)
+	} else {
+		updates["finished"] = true
+		updates["spool_path"] = "" // The caller removes the snapshot, idle fill copies are read from the live file
+	}
+
+	result := db.Model(&File{}).
+		Where("id = ? AND owner = ?", file.ID, file.Owner).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLeaseLost
+	}
+	file.CopiesSent = copiessent
+	file.Finished = !again
+	if file.Finished {
+		file.SpoolPath = ""
+	}
+	return nil
+}
+
+func finishIdleFill(db *gorm.DB, file *File) error {
+	updates := map[string]interface{}{
+		"finished":  true,
+		"idle_fill": false,
+	}
+	if !file.Success {
+		updates["sent_at"] = time.Time{}
+	}
+	result := db.Model(&File{}).
+		Where("id = ? AND owner = ? AND idle_fill = ?", file.ID, file.Owner, true).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLeaseLost
+	}
+	file.Finished = true
+	file.IdleFill = false
+	return nil
+}
+
+// Reports whether a transfer was already received successfully, so later copies of it can be ignored
+func TransferReceived(db *gorm.DB, transferid []byte) (bool, error) {
+	var count int64
+	err := db.Model(&File{}).Where("transfer_id = ? AND success = ?", transferid, true).Count(&count).Error
+	return count > 0, err
+}
+
 func ClearDatabase(db *gorm.DB) error {
 	stmt := &gorm.Statement{DB: db}
 	err := stmt.Parse(&File{})
@@ -60,33 +392,106 @@ func ClearDatabase(db *gorm.DB) error {
 	return db.Exec(fmt.Sprintf("DELETE FROM %s", tablename)).Error
 }
 
-// Receives a file path, hashes it and pushes it into the database
+// How a queued file is sent
+type SendOptions struct {
+	Encrypted   bool          // Pack the file as an encrypted zip
+	Compress    bool          // Compress the file on the way, unless its content is compressed already
+	Priority    int           // Files with a higher priority are sent first and preempt lower ones
+	Copies      int           // Send the file this many times, at least once
+	CopySpacing time.Duration // Minimal time between the copies
+}
+
+// Receives a file path and pushes it into the database
 // This should be run from an external program on the source machine
-// The sender reads files from this database and sends them.
-func QueueFileForSending(db *gorm.DB, path string, encrypted bool) error {
+// The sender reads files from this database and sends them,
+// the hash is calculated by the sender over the bytes it actually sends.
+func QueueFileForSending(db *gorm.DB, path string, opts SendOptions) error {
+	return queueFile(db, path, "", nil, opts)
+}
+
+// Queues a file whose snapshot was taken into the spool, the snapshot is what gets sent along with the metadata
+// the file had when the snapshot was taken
+func QueueSpooledFileForSending(db *gorm.DB, path string, spoolpath string, metadata structs.Metadata, opts SendOptions) error {
+	return queueFile(db, path, spoolpath, &metadata, opts)
+}
+
+func queueFile(db *gorm.DB, path string, spoolpath string, metadata *structs.Metadata, opts SendOptions) error {
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.Open(path)
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+
+	transferid := structs.NewTransferId()
+	file := File{
+		TransferId:    transferid[:],
+		Sequence:      nextSequence(),
+		Path:          path,
+		Encrypted:     opts.Encrypted,
+		Compress:      opts.Compress,
+		Priority:      opts.Priority,
+		Copies:        opts.Copies,
+		CopySpacing:   opts.CopySpacing,
+		SpoolPath:     spoolpath,
+		SpoolMetadata: metadata,
+		Started:       false,
+		Finished:      false,
+		Success:       false,
+	}
+
+	return db.Create(&file).Error
+}
+
+var sequence struct {
+	lock sync.Mutex
+	last int64
+}
+
+// Sequences follow the clock so they keep growing across restarts, files queued within the same nanosecond still get their own
+func nextSequence() int64 {
+	sequence.lock.Lock()
+	defer sequence.lock.Unlock()
+	next := time.Now().UnixNano()
+	if next <= sequence.last {
+		next = sequence.last + 1
+	}
+	sequence.last = next
+	return next
+}
+
+// Queues the deletion of a path on the receiver, the path doesn't have to exist anymore
+// Deletes and renames are sent once regardless of opts.Copies, a late copy could undo whatever happened to the path since
+func QueueDeleteForSending(db *gorm.DB, path string, opts SendOptions) error {
+	return queueOperation(db, structs.OpDelete, path, "", opts)
+}
+
+// Queues the rename of a path on the receiver, saving the data of the file from being sent again
+func QueueRenameForSending(db *gorm.DB, path string, target string, opts SendOptions) error {
+	target, err := filepath.Abs(target)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	return queueOperation(db, structs.OpRename, path, target, opts)
+}
 
-	hash, err := structs.HashFile(f, encrypted)
+func queueOperation(db *gorm.DB, op structs.Op, path string, target string, opts SendOptions) error {
+	path, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
 
+	transferid := structs.NewTransferId()
 	file := File{
-		Path:      path,
-		Hash:      hash[:],
-		Encrypted: encrypted,
-		Started:   false,
-		Finished:  false,
-		Success:   false,
+		TransferId: transferid[:],
+		Sequence:   nextSequence(),
+		Path:       path,
+		Op:         op,
+		Target:     target,
+		Encrypted:  opts.Encrypted,
+		Priority:   opts.Priority,
 	}
 
 	return db.Create(&file).Error
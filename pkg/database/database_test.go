@@ -1,9 +1,15 @@
 package database
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"oneway-filesync/pkg/structs"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -96,9 +102,619 @@ func TestQueueFileForSending(t *testing.T) {
 				}
 			}
 			defer os.Remove(tt.args.path)
-			if err := QueueFileForSending(tt.args.db, tt.args.path, tt.args.encrypted); (err != nil) != tt.wantErr {
+			if err := QueueFileForSending(tt.args.db, tt.args.path, SendOptions{Encrypted: tt.args.encrypted}); (err != nil) != tt.wantErr {
 				t.Errorf("QueueFileForSending() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestClaimFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		wantOffset int64
+		wantErr    bool
+	}{
+		{"test-resume", ResumePolicyResume, 1000, false},
+		{"test-default", "", 1000, false},
+		{"test-restart", ResumePolicyRestart, 0, false},
+		{"test-unknown-policy", "sometimes", 1000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = configureDatabase(db); err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+			waiting := File{Path: "a"}
+			leased := File{Path: "b", Started: true, Owner: "other", LeaseExpiry: now.Add(LeaseDuration), SentOffset: 1000}
+			expired := File{Path: "c", Started: true, Owner: "other", LeaseExpiry: now.Add(-time.Second), SentOffset: 1000}
+			finished := File{Path: "d", Started: true, Finished: true, SentOffset: 1000}
+			for _, file := range []*File{&waiting, &leased, &expired, &finished} {
+				if err := db.Create(file).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var claimed []File
+			for {
+				file, err := ClaimFile(db, "me", tt.policy)
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					break
+				}
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ClaimFile() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if tt.wantErr {
+					return
+				}
+				claimed = append(claimed, file)
+			}
+			if len(claimed) != 2 || claimed[0].ID != waiting.ID || claimed[1].ID != expired.ID {
+				t.Fatalf("Claimed %+v, want only the waiting and expired files", claimed)
+			}
+			for _, file := range claimed {
+				if !file.Started || file.Owner != "me" || !file.LeaseExpiry.After(now) {
+					t.Fatalf("Claimed file is %+v, want started with a lease owned by me", file)
+				}
+			}
+			if claimed[0].SentOffset != 0 || claimed[1].SentOffset != tt.wantOffset {
+				t.Fatalf("Claimed offsets %d and %d, want 0 and %d", claimed[0].SentOffset, claimed[1].SentOffset, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestRequeueInterrupted(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		wantOffset int64
+		wantErr    bool
+	}{
+		{"test-resume", ResumePolicyResume, 1000, false},
+		{"test-default", "", 1000, false},
+		{"test-restart", ResumePolicyRestart, 0, false},
+		{"test-unknown-policy", "sometimes", 1000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = configureDatabase(db); err != nil {
+				t.Fatal(err)
+			}
+			// The lease of the interrupted file is still valid, it was taken moments before the sender stopped
+			leaseexpiry := time.Now().UTC().Add(LeaseDuration)
+			interrupted := File{Path: "a", Started: true, Owner: "me", LeaseExpiry: leaseexpiry, SentOffset: 1000}
+			other := File{Path: "b", Started: true, Owner: "other", LeaseExpiry: leaseexpiry, SentOffset: 1000}
+			finished := File{Path: "c", Started: true, Finished: true, Owner: "me", SentOffset: 1000}
+			for _, file := range []*File{&interrupted, &other, &finished} {
+				if err := db.Create(file).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			requeued, err := RequeueInterrupted(db, "me", tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RequeueInterrupted() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if requeued != 1 {
+				t.Fatalf("RequeueInterrupted() = %d, want 1", requeued)
+			}
+			claimed, err := ClaimFile(db, "me", tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claimed.ID != interrupted.ID || claimed.SentOffset != tt.wantOffset {
+				t.Fatalf("Claimed %+v, want the interrupted file at offset %d", claimed, tt.wantOffset)
+			}
+			if _, err := ClaimFile(db, "me", tt.policy); !errors.Is(err, gorm.ErrRecordNotFound) {
+				t.Fatalf("ClaimFile() error = %v, want %v with the other sender's lease still valid", err, gorm.ErrRecordNotFound)
+			}
+		})
+	}
+}
+
+func TestOwnerId(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := OwnerId("")
+	if !strings.HasPrefix(got, fmt.Sprintf("%s-%d-", hostname, os.Getpid())) {
+		t.Errorf("OwnerId() = %s, want the hostname and pid", got)
+	}
+	if other := OwnerId(""); other == got {
+		t.Errorf("OwnerId() = %s twice, want an id of its own each time", got)
+	}
+	if got := OwnerId("diode-a"); got != "diode-a" {
+		t.Errorf("OwnerId() = %s, want diode-a", got)
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configureDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&File{Path: "a"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	file, err := ClaimFile(db, "me", ResumePolicyResume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RenewLease(db, &file, 1000); err != nil {
+		t.Fatalf("RenewLease() error = %v", err)
+	}
+
+	// Another sender takes over the file after the lease expired
+	if err := db.Model(&File{}).Where("id = ?", file.ID).Update("lease_expiry", time.Now().UTC().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	takeover, err := ClaimFile(db, "other", ResumePolicyResume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if takeover.ID != file.ID || takeover.SentOffset != 1000 {
+		t.Fatalf("Took over %+v, want file %d at offset 1000", takeover, file.ID)
+	}
+
+	if err := RenewLease(db, &file, 2000); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("RenewLease() error = %v, want %v", err, ErrLeaseLost)
+	}
+	file.Success = true
+	if err := FinishFile(db, &file); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("FinishFile() error = %v, want %v", err, ErrLeaseLost)
+	}
+	if err := FinishFile(db, &takeover); err != nil {
+		t.Fatalf("FinishFile() error = %v", err)
+	}
+}
+
+func TestClaimFile_priority(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configureDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	backup := File{Path: "backup"}
+	other := File{Path: "other"}
+	urgent := File{Path: "urgent", Priority: 10}
+	for _, file := range []*File{&backup, &other, &urgent} {
+		if err := db.Create(file).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimed, err := ClaimFile(db, "me", ResumePolicyResume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.ID != urgent.ID {
+		t.Fatalf("Claimed %s, want the urgent file first", claimed.Path)
+	}
+	// Lower priority files wait while the urgent file is being sent, but not for other senders
+	if _, err := ClaimFile(db, "me", ResumePolicyResume); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("ClaimFile() error = %v, want %v while a file of higher priority is in flight", err, gorm.ErrRecordNotFound)
+	}
+	if claimed, err = ClaimFile(db, "other", ResumePolicyResume); err != nil || claimed.ID != backup.ID {
+		t.Fatalf("ClaimFile() = %s, %v, want the backup for another sender", claimed.Path, err)
+	}
+
+	urgent.Owner = "me"
+	if err := FinishFile(db, &urgent); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err = ClaimFile(db, "me", ResumePolicyResume); err != nil || claimed.ID != other.ID {
+		t.Fatalf("ClaimFile() = %s, %v, want the remaining file once the urgent one finished", claimed.Path, err)
+	}
+}
+
+func TestClaimFile_sequence(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configureDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	write := File{Path: "/a", Sequence: 1}
+	rename := File{Path: "/a", Op: structs.OpRename, Target: "/b", Sequence: 2, Priority: 10}
+	renameagain := File{Path: "/b", Op: structs.OpRename, Target: "/c", Sequence: 3, Priority: 10}
+	other := File{Path: "/d", Sequence: 4}
+	for _, file := range []*File{&write, &rename, &renameagain, &other} {
+		if err := db.Create(file).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The renames wait for the write of their path even though they come first otherwise, every sender holds them back
+	for _, want := range []File{write, other} {
+		claimed, err := ClaimFile(db, want.Path, ResumePolicyResume)
+		if err != nil || claimed.ID != want.ID {
+			t.Fatalf("ClaimFile() = %s, %v, want %s", claimed.Path, err, want.Path)
+		}
+	}
+	if _, err := ClaimFile(db, "me", ResumePolicyResume); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("ClaimFile() error = %v, want %v while earlier transfers of the paths are in flight", err, gorm.ErrRecordNotFound)
+	}
+
+	// A rename waits for the rename that leads to its path
+	write.Owner = write.Path
+	if err := FinishFile(db, &write); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := ClaimFile(db, "me", ResumePolicyResume)
+	if err != nil || claimed.ID != rename.ID {
+		t.Fatalf("ClaimFile() = %s, %v, want the first rename", claimed.Path, err)
+	}
+	if _, err := ClaimFile(db, "other", ResumePolicyResume); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("ClaimFile() error = %v, want %v while the first rename is in flight", err, gorm.ErrRecordNotFound)
+	}
+	claimed.Owner = "me"
+	if err := FinishFile(db, &claimed); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err = ClaimFile(db, "other", ResumePolicyResume); err != nil || claimed.ID != renameagain.ID {
+		t.Fatalf("ClaimFile() = %s, %v, want the second rename", claimed.Path, err)
+	}
+}
+
+func TestQueueFileForSending_sequence(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configureDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := QueueFileForSending(db, ".", SendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := QueueDeleteForSending(db, ".", SendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := QueueRenameForSending(db, ".", "..", SendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var files []File
+	if err := db.Order("id").Find(&files).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(files); i++ {
+		if files[i].Sequence <= files[i-1].Sequence {
+			t.Fatalf("Sequence %d queued after %d, want them growing", files[i].Sequence, files[i-1].Sequence)
+		}
+	}
+}
+
+func TestHigherPriority(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name  string
+		other File
+		want  bool
+	}{
+		{"test-nothing-higher", File{Path: "b", Priority: 0}, false},
+		{"test-waiting", File{Path: "b", Priority: 1}, true},
+		{"test-just-queued", File{Path: "b", Priority: 1, Model: gorm.Model{UpdatedAt: now.Add(time.Minute)}}, false},
+		{"test-sending-same-owner", File{Path: "b", Priority: 1, Started: true, Owner: "me", LeaseExpiry: now.Add(LeaseDuration)}, true},
+		{"test-sending-other-owner", File{Path: "b", Priority: 1, Started: true, Owner: "other", LeaseExpiry: now.Add(LeaseDuration)}, false},
+		{"test-finished", File{Path: "b", Priority: 1, Started: true, Finished: true, Owner: "me"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = configureDatabase(db); err != nil {
+				t.Fatal(err)
+			}
+			file := File{Path: "a", Started: true, Owner: "me", LeaseExpiry: now.Add(LeaseDuration)}
+			if err := db.Create(&file).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Create(&tt.other).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := HigherPriority(db, &file, now.Add(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("HigherPriority() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseFile(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configureDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&File{Path: "a"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	file, err := ClaimFile(db, "me", ResumePolicyRestart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseFile(db, &file, 5000); err != nil {
+		t.Fatalf("ReleaseFile() error = %v", err)
+	}
+	if err := ReleaseFile(db, &file, 5000); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("ReleaseFile() error = %v, want %v for a released file", err, ErrLeaseLost)
+	}
+
+	// A paused file continues where it stopped even under the restart policy
+	resumed, err := ClaimFile(db, "other", ResumePolicyRestart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.ID != file.ID || resumed.SentOffset != 5000 {
+		t.Fatalf("Claimed %+v, want file %d at offset 5000", resumed, file.ID)
+	}
+}
+
+func TestFinishFile_copies(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configureDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	transferid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if err := db.Create(&File{TransferId: transferid, Path: "a", Copies: 2, CopySpacing: time.Hour, SpoolPath: "snapshot"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ClaimFile(db, "me", ResumePolicyResume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Success = true
+	if err := FinishFile(db, &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Finished || file.CopiesSent != 1 || file.SpoolPath != "snapshot" {
+		t.Fatalf("File is %+v after the first copy, want it queued again from its snapshot", file)
+	}
+	// The next copy waits for the spacing
+	if _, err := ClaimFile(db, "me", ResumePolicyResume); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("ClaimFile() error = %v, want %v before the spacing passed", err, gorm.ErrRecordNotFound)
+	}
+	if err := db.Model(&File{}).Where("id = ?", file.ID).Update("not_before", time.Now().UTC().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	file, err = ClaimFile(db, "me", ResumePolicyResume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(file.TransferId, transferid) || file.SentAt.IsZero() {
+		t.Fatalf("Second copy is %+v, want the same transfer with the time of the first copy", file)
+	}
+	file.Success = true
+	if err := FinishFile(db, &file); err != nil {
+		t.Fatal(err)
+	}
+	if !file.Finished || file.CopiesSent != 2 || file.SpoolPath != "" {
+		t.Fatalf("File is %+v after the last copy, want it finished without its snapshot", file)
+	}
+	if err := db.First(&file, file.ID).Error; err != nil || file.SpoolPath != "" {
+		t.Fatalf("File is %+v, %v in the database, want it without its snapshot", file, err)
+	}
+}
+
+func TestClaimIdleFill(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configureDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	old := File{Path: "old", Started: true, Finished: true, Success: true, SentAt: now.Add(-2 * time.Hour)}
+	failed := File{Path: "failed", Started: true, Finished: true, Success: false, SentAt: now}
+	recent := File{Path: "recent", Started: true, Finished: true, Success: true, SentAt: now, Priority: 5}
+	for _, file := range []*File{&old, &failed, &recent} {
+		if err := db.Create(file).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := ClaimIdleFill(db, "me", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.ID != recent.ID || file.Finished || !file.IdleFill || file.Priority != 5 || file.Owner != "me" {
+		t.Fatalf("Claimed %+v, want the recent file as an idle fill copy keeping its priority", file)
+	}
+	// A queued file of any priority preempts the idle fill copy, which doesn't hold queued files back
+	if err := db.Create(&File{Path: "queued", Priority: -1}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if preempt, err := HigherPriority(db, &file, time.Now().Add(time.Second)); err != nil || !preempt {
+		t.Fatalf("HigherPriority() = %v, %v, want the queued file to preempt the idle fill", preempt, err)
+	}
+	// Only one idle fill copy is in flight at a time
+	if _, err := ClaimIdleFill(db, "me", time.Hour); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("ClaimIdleFill() error = %v, want %v while a file is in flight", err, gorm.ErrRecordNotFound)
+	}
+	queued, err := ClaimFile(db, "me", ResumePolicyResume)
+	if err != nil || queued.Path != "queued" {
+		t.Fatalf("ClaimFile() = %+v, %v, want the queued file", queued, err)
+	}
+	if preempt, err := HigherPriority(db, &queued, time.Now().Add(time.Second)); err != nil || preempt {
+		t.Fatalf("HigherPriority() = %v, %v, want the idle fill copy not to preempt anything", preempt, err)
+	}
+	queued.Success = true
+	if err := FinishFile(db, &queued); err != nil {
+		t.Fatal(err)
+	}
+
+	// A preempted idle fill copy is dropped rather than queued
+	if err := ReleaseFile(db, &file, 100); err != nil {
+		t.Fatal(err)
+	}
+	if !file.Finished || file.IdleFill {
+		t.Fatalf("Released idle fill copy is %+v, want the file finished again", file)
+	}
+	if _, err := ClaimFile(db, "me", ResumePolicyResume); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("ClaimFile() error = %v, want %v for a dropped idle fill copy", err, gorm.ErrRecordNotFound)
+	}
+
+	// A failed copy takes the file out of idle fill without touching its result
+	file, err = ClaimIdleFill(db, "me", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Success = false
+	if err := FinishFile(db, &file); err != nil {
+		t.Fatal(err)
+	}
+	var stored File
+	if err := db.First(&stored, file.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Finished || !stored.Success || stored.IdleFill || stored.Priority != file.Priority || !stored.SentAt.IsZero() {
+		t.Fatalf("File is %+v after a failed idle fill copy, want it successful and out of idle fill", stored)
+	}
+	failedid := file.ID
+	file, err = ClaimIdleFill(db, "me", time.Hour)
+	if err != nil || file.ID == failedid {
+		t.Fatalf("ClaimIdleFill() = %+v, %v, want only the other file left for idle fill", file, err)
+	}
+	file.Success = true
+	if err := FinishFile(db, &file); err != nil {
+		t.Fatal(err)
+	}
+	stored = File{}
+	if err := db.First(&stored, file.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Finished || stored.IdleFill || stored.CopiesSent != file.CopiesSent {
+		t.Fatalf("File is %+v after an idle fill copy, want it finished with the copies it had", stored)
+	}
+}
+
+func TestClaimIdleFill_interrupted(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configureDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for _, path := range []string{"a", "b"} {
+		if err := db.Create(&File{Path: path, Started: true, Finished: true, Success: true, SentAt: now}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := ClaimIdleFill(db, "me", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The idle fill copy of a sender that restarted is dropped, not queued
+	requeued, err := RequeueInterrupted(db, "me", ResumePolicyResume)
+	if err != nil || requeued != 0 {
+		t.Fatalf("RequeueInterrupted() = %v, %v, want no files requeued", requeued, err)
+	}
+	if _, err := ClaimFile(db, "me", ResumePolicyResume); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("ClaimFile() error = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	var stored File
+	if err := db.First(&stored, a.ID).Error; err != nil || !stored.Finished || stored.IdleFill {
+		t.Fatalf("File is %+v, %v, want it finished again", stored, err)
+	}
+
+	// The idle fill copy of a sender that died is claimed again once its lease expires, never as a queued file
+	b, err := ClaimIdleFill(db, "dead", time.Hour)
+	if err != nil || b.Path != "b" {
+		t.Fatalf("ClaimIdleFill() = %+v, %v, want b", b, err)
+	}
+	if err := db.Model(&File{}).Where("id = ?", b.ID).Update("lease_expiry", now.Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&File{}).Where("id = ?", a.ID).Update("sent_at", now.Add(-2*time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClaimFile(db, "me", ResumePolicyResume); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("ClaimFile() error = %v, want %v for an expired idle fill copy", err, gorm.ErrRecordNotFound)
+	}
+	file, err := ClaimIdleFill(db, "me", time.Hour)
+	if err != nil || file.ID != b.ID || file.Owner != "me" {
+		t.Fatalf("ClaimIdleFill() = %+v, %v, want the expired copy of b", file, err)
+	}
+}
+
+func TestQueueOperations(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = configureDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	// The paths don't have to exist, they are usually gone by the time the op is queued
+	opts := SendOptions{Encrypted: true, Priority: 3, Copies: 5}
+	if err := QueueDeleteForSending(db, "nonexistent", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := QueueRenameForSending(db, "nonexistent", "renamed", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var files []File
+	if err := db.Order("id").Find(&files).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Op != structs.OpDelete || files[1].Op != structs.OpRename {
+		t.Fatalf("Queued %+v, want a delete and a rename", files)
+	}
+	target, _ := filepath.Abs("renamed")
+	if files[1].Target != target || !filepath.IsAbs(files[0].Path) {
+		t.Fatalf("Queued %+v, want absolute paths", files)
+	}
+	for _, file := range files {
+		if file.Priority != 3 || file.Copies != 0 || !file.Encrypted {
+			t.Fatalf("Queued %+v, want the priority and encryption of the options sent once", file)
+		}
+	}
+
+	// Ops carry no data worth repeating so they are never sent as idle fill
+	now := time.Now().UTC()
+	if err := db.Model(&File{}).Where("1 = 1").Updates(map[string]interface{}{"started": true, "finished": true, "success": true, "sent_at": now}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClaimIdleFill(db, "me", time.Hour); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("ClaimIdleFill() error = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
@@ -2,13 +2,56 @@ package fecdecoder
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"oneway-filesync/pkg/structs"
 
 	"github.com/klauspost/reedsolomon"
 	"github.com/sirupsen/logrus"
 )
 
+var ErrParityMismatch = errors.New("parity mismatch, shares are corrupt")
+
+func reconstructAndVerify(fec reedsolomon.Encoder, received [][]byte) ([][]byte, bool) {
+	shares := append([][]byte{}, received...)
+	if err := fec.Reconstruct(shares); err != nil {
+		return nil, false
+	}
+	ok, err := fec.Verify(shares)
+	return shares, err == nil && ok
+}
+
+// With more than <required> shares we can make sure none of them were corrupted,
+// the missing shares are reconstructed from the first <required> and the parity is checked against the data
+// If the parity doesn't add up we leave out each received share in turn to find the corrupt one,
+// this requires at least <required>+2 shares since with one less the mismatch can only be detected
+// Returns the reconstructed shares and the index of the share that was dropped or -1
+func verifiedReconstruct(fec reedsolomon.Encoder, received [][]byte, required int) ([][]byte, int, error) {
+	if shares, ok := reconstructAndVerify(fec, received); ok {
+		return shares, -1, nil
+	}
+
+	count := 0
+	for _, share := range received {
+		if share != nil {
+			count++
+		}
+	}
+	if count-1 <= required {
+		return nil, -1, ErrParityMismatch
+	}
+	for i := range received {
+		if received[i] == nil {
+			continue
+		}
+		candidate := append([][]byte{}, received...)
+		candidate[i] = nil
+		if shares, ok := reconstructAndVerify(fec, candidate); ok {
+			return shares, i, nil
+		}
+	}
+	return nil, -1, ErrParityMismatch
+}
+
 type fecDecoderConfig struct {
 	required int
 	total    int
@@ -27,16 +70,30 @@ func worker(ctx context.Context, conf *fecDecoderConfig) {
 		case <-ctx.Done():
 			return
 		case chunks := <-conf.input:
+			l := logrus.WithFields(logrus.Fields{
+				"TransferId": chunks[0].TransferId.String(),
+				"DataOffset": chunks[0].DataOffset,
+			})
 			shares := make([][]byte, conf.total)
+			received := 0
 			for _, chunk := range chunks {
+				if shares[chunk.ShareIndex] == nil {
+					received++
+				}
 				shares[chunk.ShareIndex] = chunk.Data
 			}
-			err := fec.ReconstructData(shares)
+
+			if received > conf.required {
+				var dropped int
+				shares, dropped, err = verifiedReconstruct(fec, shares, conf.required)
+				if dropped != -1 {
+					l.Warnf("Dropped corrupt share %d", dropped)
+				}
+			} else {
+				err = fec.ReconstructData(shares)
+			}
 			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"Path": chunks[0].Path,
-					"Hash": fmt.Sprintf("%x", chunks[0].Hash),
-				}).Errorf("Error FEC decoding shares: %v", err)
+				l.Errorf("Error FEC decoding shares: %v", err)
 				continue
 			}
 
@@ -45,10 +102,11 @@ func worker(ctx context.Context, conf *fecDecoderConfig) {
 				copy(data[i*len(shares[0]):], shard)
 			}
 			conf.output <- &structs.Chunk{
-				Path:       chunks[0].Path,
-				Hash:       chunks[0].Hash,
-				Encrypted:  chunks[0].Encrypted,
+				Type:       chunks[0].Type,
+				TransferId: chunks[0].TransferId,
 				DataOffset: chunks[0].DataOffset,
+				Compressed: chunks[0].Compressed,
+				Legacy:     chunks[0].Legacy,
 				Data:       data[:len(data)-int(chunks[0].DataPadding)],
 			}
 		}
@@ -85,3 +85,50 @@ func Test_worker(t *testing.T) {
 		})
 	}
 }
+
+func Test_verifiedReconstruct(t *testing.T) {
+	corrupt := func(chunks []*structs.Chunk, index int) []*structs.Chunk {
+		chunks[index].Data = append([]byte{}, chunks[index].Data...)
+		chunks[index].Data[0] ^= 0xff
+		return chunks
+	}
+	type args struct {
+		required int
+		total    int
+		input    []*structs.Chunk
+	}
+	tests := []struct {
+		name        string
+		args        args
+		wantDropped int
+		wantErr     bool
+	}{
+		{"test-intact", args{2, 4, createChunks(t, 2, 4)}, -1, false},
+		{"test-intact-partial", args{2, 4, createChunks(t, 2, 4)[1:]}, -1, false},
+		{"test-corrupt-data-share", args{2, 4, corrupt(createChunks(t, 2, 4), 1)}, 1, false},
+		{"test-corrupt-parity-share", args{2, 4, corrupt(createChunks(t, 2, 4), 3)}, 3, false},
+		{"test-corrupt-detected-only", args{2, 4, corrupt(createChunks(t, 2, 4), 0)[:3]}, -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fec, err := reedsolomon.New(tt.args.required, tt.args.total-tt.args.required)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shares := make([][]byte, tt.args.total)
+			for _, chunk := range tt.args.input {
+				shares[chunk.ShareIndex] = chunk.Data
+			}
+			got, dropped, err := verifiedReconstruct(fec, shares, tt.args.required)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifiedReconstruct() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if dropped != tt.wantDropped {
+				t.Fatalf("verifiedReconstruct() dropped = %v, want %v", dropped, tt.wantDropped)
+			}
+			if !tt.wantErr && !bytes.Equal(bytes.Join(got[:tt.args.required], nil), make([]byte, 400)) {
+				t.Fatalf("verifiedReconstruct() returned wrong data")
+			}
+		})
+	}
+}
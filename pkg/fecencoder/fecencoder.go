@@ -2,7 +2,6 @@ package fecencoder
 
 import (
 	"context"
-	"fmt"
 	"oneway-filesync/pkg/structs"
 
 	"github.com/klauspost/reedsolomon"
@@ -33,8 +32,8 @@ func worker(ctx context.Context, conf *fecEncoderConfig) {
 			return
 		case chunk := <-conf.input:
 			l := logrus.WithFields(logrus.Fields{
-				"Path": chunk.Path,
-				"Hash": fmt.Sprintf("%x", chunk.Hash),
+				"TransferId": chunk.TransferId.String(),
+				"DataOffset": chunk.DataOffset,
 			})
 
 			padding := (conf.required - (len(chunk.Data) % conf.required)) % conf.required
@@ -58,12 +57,12 @@ func worker(ctx context.Context, conf *fecEncoderConfig) {
 
 			for i, sharedata := range shares {
 				chunk := structs.Chunk{
-					Path:        chunk.Path,
-					Hash:        chunk.Hash,
-					Encrypted:   chunk.Encrypted,
+					Type:        chunk.Type,
+					TransferId:  chunk.TransferId,
 					DataOffset:  chunk.DataOffset,
 					DataPadding: uint32(padding),
 					ShareIndex:  uint32(i),
+					Compressed:  chunk.Compressed,
 					Data:        sharedata,
 				}
 				conf.output <- &chunk
@@ -2,63 +2,334 @@ package filecloser
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io/fs"
 	"oneway-filesync/pkg/database"
 	"oneway-filesync/pkg/structs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
-func normalizePath(path string) string {
-	newpath := strings.ReplaceAll(path, ":", "")
-	if strings.Contains(newpath, "\\") {
-		return filepath.Join(strings.Split(newpath, "\\")...)
-	} else {
+func closeFile(file *structs.OpenTempFile, conf *fileCloserConfig) error {
+	if file.Manifest == nil {
+		return fmt.Errorf("manifest never arrived, leaving tempfile in place")
+	}
 
-		return filepath.Join(strings.Split(newpath, "/")...)
+	var newpath string
+	var err error
+	metadata := file.Manifest.Metadata
+	switch metadata.Type {
+	case structs.EntryDir:
+		if newpath, err = outPath(conf, file.Manifest.Path, false, true); err != nil {
+			return err
+		}
+		// The directory is resolved like the ones above it, a symlink in its place isn't followed
+		if _, err := checkDir(newpath, true); err != nil {
+			return err
+		}
+	case structs.EntrySymlink:
+		if newpath, err = outPath(conf, file.Manifest.Path, false, true); err != nil {
+			return err
+		}
+		if err := checkLinkTarget(conf, newpath, metadata.LinkTarget); err != nil {
+			return err
+		}
+		// A link that changed replaces the previous one, anything else in its place is left alone
+		if info, err := os.Lstat(newpath); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			_ = os.Remove(newpath) // Symlink fails below if this fails
+		}
+		if err := os.Symlink(metadata.LinkTarget, newpath); err != nil {
+			return fmt.Errorf("failed creating symlink: %v", err)
+		}
+	default:
+		if newpath, err = closeData(file, conf); err != nil {
+			return err
+		}
 	}
+
+	return restoreMetadata(newpath, metadata, conf)
 }
-func closeFile(file *structs.OpenTempFile, outdir string) error {
+
+func closeData(file *structs.OpenTempFile, conf *fileCloserConfig) (string, error) {
+	if file.Trailer == nil {
+		return "", fmt.Errorf("trailer never arrived, the file can't be verified, leaving tempfile in place")
+	}
+
 	f, err := os.Open(file.TempFile)
 	if err != nil {
-		return fmt.Errorf("error opening tempfile: %v", err)
+		return "", fmt.Errorf("error opening tempfile: %v", err)
 	}
 
-	hash, err := structs.HashFile(f, false)
+	hash, err := structs.HashFile(f)
 	_ = f.Close() // Ignoring error on purpose
 	if err != nil {
-		return fmt.Errorf("error hashing tempfile: %v", err)
+		return "", fmt.Errorf("error hashing tempfile: %v", err)
 	}
 
-	if hash != file.Hash {
-		return fmt.Errorf("hash mismatch '%v'!='%v'", fmt.Sprintf("%x", hash), fmt.Sprintf("%x", file.Hash))
+	if hash != file.Trailer.Hash {
+		return "", fmt.Errorf("hash mismatch '%v'!='%v'", fmt.Sprintf("%x", hash), fmt.Sprintf("%x", file.Trailer.Hash))
 	}
 
-	newpath := filepath.Join(outdir, normalizePath(file.Path))
-	if file.Encrypted {
-		newpath += ".zip"
-	}
-	err = os.MkdirAll(filepath.Dir(newpath), os.ModePerm)
+	newpath, err := outPath(conf, file.Manifest.Path, file.Manifest.Encrypted, true)
 	if err != nil {
-		return fmt.Errorf("failed creating directory path: %v", err)
+		return "", err
 	}
 
 	err = os.Rename(file.TempFile, newpath)
 	if err != nil {
-		return fmt.Errorf("failed moving tempfile to new location: %v", err)
+		return "", fmt.Errorf("failed moving tempfile to new location: %v", err)
 	}
 
+	return newpath, nil
+}
+
+// Symlinks keep the permissions and times the receiver gives them,
+// changing them would change what they point at instead
+func restoreMetadata(path string, metadata structs.Metadata, conf *fileCloserConfig) error {
+	if metadata.Type != structs.EntrySymlink {
+		mode := fs.FileMode(metadata.Mode)
+		if metadata.Type == structs.EntryDir {
+			if conf.overrides.DirMode != 0 {
+				mode = conf.overrides.DirMode
+			}
+			// Files that arrive later still have to be written into the directory
+			mode |= 0700
+		} else if conf.overrides.FileMode != 0 {
+			mode = conf.overrides.FileMode
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return fmt.Errorf("failed setting mode: %v", err)
+		}
+		if metadata.ModTime != 0 {
+			modtime := time.Unix(0, metadata.ModTime)
+			if err := os.Chtimes(path, modtime, modtime); err != nil {
+				return fmt.Errorf("failed setting modification time: %v", err)
+			}
+		}
+	}
+
+	uid, gid := conf.uid, conf.gid
+	if conf.overrides.Ownership == OwnershipPreserve && metadata.HasOwner {
+		uid, gid = int(metadata.Uid), int(metadata.Gid)
+	} else if !conf.chown {
+		return nil
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed setting ownership: %v", err)
+	}
 	return nil
 }
 
+// Overrides of the metadata recorded by the sender, the zero value keeps the modes and times of the sender
+// and leaves the files owned by the user running the receiver
+type Overrides struct {
+	FileMode  fs.FileMode
+	DirMode   fs.FileMode
+	Ownership string // OwnershipPreserve or "<uid>:<gid>"
+
+	AllowUnsafeSymlinks bool // Creates symlinks whose target is absolute or leads outside of the out dir instead of rejecting them
+}
+
+// Restores the uid and gid of the sender which usually requires running the receiver as root
+const OwnershipPreserve = "preserve"
+
+// Returns whether every file is given the parsed uid and gid
+func parseOwnership(ownership string) (bool, int, int, error) {
+	if ownership == "" || ownership == OwnershipPreserve {
+		return false, 0, 0, nil
+	}
+	ids := strings.Split(ownership, ":")
+	if len(ids) != 2 {
+		return false, 0, 0, fmt.Errorf("ownership '%s' is not '%s' or '<uid>:<gid>'", ownership, OwnershipPreserve)
+	}
+	uid, err := strconv.Atoi(ids[0])
+	if err != nil {
+		return false, 0, 0, fmt.Errorf("bad uid in ownership '%s': %v", ownership, err)
+	}
+	gid, err := strconv.Atoi(ids[1])
+	if err != nil {
+		return false, 0, 0, fmt.Errorf("bad gid in ownership '%s': %v", ownership, err)
+	}
+	return true, uid, gid, nil
+}
+
+func ValidateOwnership(ownership string) error {
+	_, _, _, err := parseOwnership(ownership)
+	return err
+}
+
+// What the receiver does with the deletes and renames that happened in the watched dir
+const (
+	MirrorPolicyArchive = "archive" // Deleted files and files a rename replaces are moved to the archive dir
+	MirrorPolicyApply   = "apply"   // Deletes and renames are applied to the out dir as they are
+	MirrorPolicyIgnore  = "ignore"  // Deletes and renames are only logged
+)
+
+func ValidateMirrorPolicy(policy string) error {
+	switch policy {
+	case MirrorPolicyArchive, MirrorPolicyApply, MirrorPolicyIgnore, "":
+		return nil
+	default:
+		return fmt.Errorf("unknown mirror policy '%s'", policy)
+	}
+}
+
+// Archived paths keep their place in the tree with the time they were archived appended
+// so the same path can be archived any number of times
+func archivePath(conf *fileCloserConfig, path string) error {
+	rel, err := filepath.Rel(conf.outdir, path)
+	if err != nil {
+		return fmt.Errorf("error archiving '%s': %v", path, err)
+	}
+	archived, err := resolvePath(conf.archivedir, rel+"."+time.Now().UTC().Format("20060102T150405.000000000"), true)
+	if err != nil {
+		return fmt.Errorf("error archiving '%s': %v", path, err)
+	}
+	if err = os.Rename(path, archived); err != nil {
+		return fmt.Errorf("failed moving '%s' to the archive: %v", path, err)
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func applyOp(manifest *structs.Manifest, conf *fileCloserConfig) error {
+	path, err := outPath(conf, manifest.Path, manifest.Encrypted, false)
+	if err != nil {
+		return err
+	}
+
+	switch manifest.Op {
+	case structs.OpDelete:
+		if !exists(path) {
+			return nil // Never received or already gone
+		}
+		if conf.policy == MirrorPolicyApply {
+			if err = os.RemoveAll(path); err != nil {
+				return fmt.Errorf("failed deleting '%s': %v", path, err)
+			}
+			return nil
+		}
+		return archivePath(conf, path)
+
+	case structs.OpRename:
+		target, err := outPath(conf, manifest.Target, manifest.Encrypted, false)
+		if err != nil {
+			return err
+		}
+		if !exists(path) {
+			return fmt.Errorf("nothing to rename at '%s'", path)
+		}
+		if conf.policy != MirrorPolicyApply && exists(target) {
+			if err = archivePath(conf, target); err != nil {
+				return err
+			}
+		}
+		if _, err = outPath(conf, manifest.Target, manifest.Encrypted, true); err != nil {
+			return err
+		}
+		if err = os.Rename(path, target); err != nil {
+			return fmt.Errorf("failed renaming '%s' to '%s': %v", path, target, err)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown op %v", manifest.Op)
+	}
+}
+
 type fileCloserConfig struct {
-	db     *gorm.DB
-	outdir string
-	input  chan *structs.OpenTempFile
+	db         *gorm.DB
+	outdir     string
+	tempdir    string
+	policy     string
+	archivedir string
+	overrides  Overrides
+	chown      bool
+	uid        int
+	gid        int
+	input      chan *structs.OpenTempFile
+	rejected   atomic.Uint64 // Transfers whose path was unsafe
+	paths      pathLocks
+}
+
+// A transfer older than one already applied to any of its paths would undo it, transfers of senders that don't order them
+// are always applied
+var ErrSuperseded = errors.New("superseded by a later transfer of the path")
+
+// The transfers of a path are closed one at a time so the check against what was applied to it holds
+// Paths share a fixed number of locks, a rename holds the locks of both of its paths
+type pathLocks [64]sync.Mutex
+
+func (p *pathLocks) lock(paths ...string) func() {
+	var indexes []int
+	for _, path := range paths {
+		h := fnv.New32a()
+		h.Write([]byte(path))
+		index := int(h.Sum32() % uint32(len(p)))
+		if !containsInt(indexes, index) {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes) // Always taken in the same order so two renames can't deadlock
+	for _, index := range indexes {
+		p[index].Lock()
+	}
+	return func() {
+		for _, index := range indexes {
+			p[index].Unlock()
+		}
+	}
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func superseded(manifest *structs.Manifest, conf *fileCloserConfig) (bool, error) {
+	if manifest.Sequence == 0 {
+		return false, nil
+	}
+	paths := []string{manifest.Path}
+	if manifest.Target != "" {
+		paths = append(paths, manifest.Target)
+	}
+	var count int64
+	err := conf.db.Model(&database.File{}).
+		Where("success = ? AND sequence > ? AND (path IN ? OR target IN ?)", true, manifest.Sequence, paths, paths).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func closeOp(file *structs.OpenTempFile, conf *fileCloserConfig, l *logrus.Entry) error {
+	if conf.policy == MirrorPolicyIgnore {
+		l.Infof("Ignored %v under the %s mirror policy", file.Manifest.Op, conf.policy)
+		return nil
+	}
+	if err := applyOp(file.Manifest, conf); err != nil {
+		return err
+	}
+	l.Infof("Successfully applied %v", file.Manifest.Op)
+	return nil
 }
 
 func worker(ctx context.Context, conf *fileCloserConfig) {
@@ -68,38 +339,113 @@ func worker(ctx context.Context, conf *fileCloserConfig) {
 			return
 		case file := <-conf.input:
 			l := logrus.WithFields(logrus.Fields{
-				"TempFile": file.TempFile,
-				"Path":     file.Path,
-				"Hash":     fmt.Sprintf("%x", file.Hash),
+				"TempFile":   file.TempFile,
+				"TransferId": file.TransferId.String(),
 			})
 			dbentry := database.File{
-				Path:      file.Path,
-				Hash:      file.Hash[:],
-				Encrypted: file.Encrypted,
-				Started:   true,
-				Finished:  true,
+				TransferId: file.TransferId[:],
+				Started:    true,
+				Finished:   true,
+			}
+			unlock := func() {}
+			if file.Manifest != nil {
+				l = l.WithField("Path", file.Manifest.Path)
+				dbentry.Path = file.Manifest.Path
+				dbentry.Encrypted = file.Manifest.Encrypted
+				dbentry.Sequence = file.Manifest.Sequence
+				unlock = conf.paths.lock(file.Manifest.Path, file.Manifest.Target)
+			}
+			if file.Trailer != nil {
+				l = l.WithField("Hash", fmt.Sprintf("%x", file.Trailer.Hash))
+				dbentry.Hash = file.Trailer.Hash[:]
 			}
 
-			err := closeFile(file, conf.outdir)
-			if err != nil {
+			var err error
+			stale := false
+			if file.Manifest != nil {
+				if file.Manifest.Op != structs.OpWrite {
+					l = l.WithFields(logrus.Fields{"Op": file.Manifest.Op, "Target": file.Manifest.Target})
+					dbentry.Op = file.Manifest.Op
+					dbentry.Target = file.Manifest.Target
+				}
+				stale, err = superseded(file.Manifest, conf)
+			}
+			switch {
+			case err != nil:
+			case stale:
+				err = ErrSuperseded
+			case dbentry.Op != structs.OpWrite:
+				err = closeOp(file, conf, l)
+			default:
+				if err = closeFile(file, conf); err == nil {
+					l.Infof("Successfully finished writing file")
+				}
+			}
+			if errors.Is(err, ErrUnsafePath) {
 				dbentry.Success = false
+				l.Errorf("Rejected transfer, %d rejected so far: %v", conf.rejected.Add(1), err)
+			} else if errors.Is(err, ErrSuperseded) {
+				dbentry.Success = false
+				l.Warnf("Skipped %v: %v", dbentry.Op, err)
+			} else if err != nil {
+				dbentry.Success = false
+				if len(file.Missing) > 0 || len(file.Corrupt) > 0 {
+					l = l.WithFields(logrus.Fields{"Missing": file.Missing, "Corrupt": file.Corrupt})
+				}
 				l.Error(err)
 			} else {
 				dbentry.Success = true
-				l.Infof("Successfully finished writing file")
 			}
 			if err := conf.db.Save(&dbentry).Error; err != nil {
 				l.Errorf("Failed committing to db: %v", err)
 			}
+			unlock()
+			// A transfer that failed keeps its state so a later copy can fill in what it is missing, one that was
+			// superseded has nothing left to fill in
+			if errors.Is(err, ErrSuperseded) && file.TempFile != "" {
+				if err := os.Remove(file.TempFile); err != nil && !os.IsNotExist(err) {
+					l.Errorf("Failed removing tempfile: %v", err)
+				}
+			}
+			if (dbentry.Success || errors.Is(err, ErrSuperseded)) && file.StateFile != "" {
+				if err := os.Remove(file.StateFile); err != nil && !os.IsNotExist(err) {
+					l.Errorf("Failed removing transfer state: %v", err)
+				}
+			}
 		}
 	}
 }
 
-func CreateFileCloser(ctx context.Context, db *gorm.DB, outdir string, input chan *structs.OpenTempFile, workercount int) {
+// Deletes and renames are applied to outdir under the mirror policy, the archive policy moves what they remove into archivedir
+// Paths leading into tempdir or archivedir are rejected
+func CreateFileCloser(ctx context.Context, db *gorm.DB, outdir string, tempdir string, policy string, archivedir string, overrides Overrides, input chan *structs.OpenTempFile, workercount int) {
+	if err := ValidateMirrorPolicy(policy); err != nil {
+		logrus.Errorf("Error creating file closer: %v", err)
+		return
+	}
+	chown, uid, gid, err := parseOwnership(overrides.Ownership)
+	if err != nil {
+		logrus.Errorf("Error creating file closer: %v", err)
+		return
+	}
+	if policy == "" {
+		policy = MirrorPolicyArchive
+	}
+	// Next to the out dir rather than in it, so the archive isn't mistaken for received files
+	if archivedir == "" {
+		archivedir = filepath.Clean(outdir) + "-archive"
+	}
 	conf := fileCloserConfig{
-		db:     db,
-		outdir: outdir,
-		input:  input,
+		db:         db,
+		outdir:     outdir,
+		tempdir:    tempdir,
+		policy:     policy,
+		archivedir: archivedir,
+		overrides:  overrides,
+		chown:      chown,
+		uid:        uid,
+		gid:        gid,
+		input:      input,
 	}
 	for i := 0; i < workercount; i++ {
 		go worker(ctx, &conf)
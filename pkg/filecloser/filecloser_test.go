@@ -3,8 +3,10 @@ package filecloser
 import (
 	"bytes"
 	"context"
+	"oneway-filesync/pkg/database"
 	"oneway-filesync/pkg/structs"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
@@ -16,31 +18,6 @@ import (
 	gormlogger "gorm.io/gorm/logger"
 )
 
-func Test_normalizePath(t *testing.T) {
-	tests := []struct {
-		name string
-		path string
-		want string
-	}{
-		{"test1", "/tmp/out/check", "tmp/out/check"},
-		{"test2", "c:\\tmp\\out\\check", "c/tmp/out/check"},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if runtime.GOOS == "windows" {
-				tt.want = strings.ReplaceAll(tt.want, "/", "\\")
-				if got := normalizePath(tt.path); got != tt.want {
-					t.Errorf("normalizePath() = %v, want %v", got, tt.want)
-				}
-			} else {
-				if got := normalizePath(tt.path); got != tt.want {
-					t.Errorf("normalizePath() = %v, want %v", got, tt.want)
-				}
-			}
-		})
-	}
-}
-
 func Test_closeFile(t *testing.T) {
 	data := []byte{1, 2, 3, 4}
 	hash := [32]byte{0x9f, 0x64, 0xa7, 0x47, 0xe1, 0xb9, 0x7f, 0x13, 0x1f, 0xab, 0xb6, 0xb4, 0x47, 0x29, 0x6c, 0x9b, 0x6f, 0x02, 0x01, 0xe7, 0x9f, 0xb3, 0xc5, 0x35, 0x6e, 0x6c, 0x77, 0xe8, 0x9b, 0x6a, 0x80, 0x6a}
@@ -56,11 +33,13 @@ func Test_closeFile(t *testing.T) {
 		args    args
 		wantErr bool
 	}{
-		{"test-works", args{&structs.OpenTempFile{TempFile: "a", Path: "b", Hash: hash, Encrypted: false, LastUpdated: time.Now()}, "out"}, false},
-		{"test-hash-mismsatch", args{&structs.OpenTempFile{TempFile: "a", Path: "b", Hash: wronghash, Encrypted: false, LastUpdated: time.Now()}, "out"}, true},
-		{"test-no-such-file", args{&structs.OpenTempFile{TempFile: "/tmp/adsasdasdsadas/adadsada/a", Path: "b", Hash: hash, Encrypted: false, LastUpdated: time.Now()}, "out"}, true},
-		{"test-rename-fail", args{&structs.OpenTempFile{TempFile: "a", Path: "b\x00", Hash: hash, Encrypted: false, LastUpdated: time.Now()}, "out"}, true},
-		{"test-mkdirall-fail", args{&structs.OpenTempFile{TempFile: "a", Path: "b", Hash: hash, Encrypted: false, LastUpdated: time.Now()}, "out\x00"}, true},
+		{"test-works", args{&structs.OpenTempFile{TempFile: "a", Manifest: &structs.Manifest{Path: "b"}, Trailer: &structs.Trailer{Hash: hash}, LastUpdated: time.Now()}, "out"}, false},
+		{"test-hash-mismsatch", args{&structs.OpenTempFile{TempFile: "a", Manifest: &structs.Manifest{Path: "b"}, Trailer: &structs.Trailer{Hash: wronghash}, LastUpdated: time.Now()}, "out"}, true},
+		{"test-no-such-file", args{&structs.OpenTempFile{TempFile: "/tmp/adsasdasdsadas/adadsada/a", Manifest: &structs.Manifest{Path: "b"}, Trailer: &structs.Trailer{Hash: hash}, LastUpdated: time.Now()}, "out"}, true},
+		{"test-rename-fail", args{&structs.OpenTempFile{TempFile: "a", Manifest: &structs.Manifest{Path: "b\x00"}, Trailer: &structs.Trailer{Hash: hash}, LastUpdated: time.Now()}, "out"}, true},
+		{"test-no-manifest", args{&structs.OpenTempFile{TempFile: "a", Trailer: &structs.Trailer{Hash: hash}, LastUpdated: time.Now()}, "out"}, true},
+		{"test-no-trailer", args{&structs.OpenTempFile{TempFile: "a", Manifest: &structs.Manifest{Path: "b"}, LastUpdated: time.Now()}, "out"}, true},
+		{"test-mkdirall-fail", args{&structs.OpenTempFile{TempFile: "a", Manifest: &structs.Manifest{Path: "b"}, Trailer: &structs.Trailer{Hash: hash}, LastUpdated: time.Now()}, "out\x00"}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -72,7 +51,7 @@ func Test_closeFile(t *testing.T) {
 			}
 			defer os.Remove(tt.args.file.TempFile)
 
-			if err := closeFile(tt.args.file, tt.args.outdir); (err != nil) != tt.wantErr {
+			if err := closeFile(tt.args.file, &fileCloserConfig{outdir: tt.args.outdir}); (err != nil) != tt.wantErr {
 				t.Errorf("closeFile() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -94,8 +73,9 @@ func Test_worker(t *testing.T) {
 		args     args
 		expected string
 	}{
-		{"test-dberror", args{&structs.OpenTempFile{TempFile: "a", Path: "b", Hash: hash, Encrypted: false, LastUpdated: time.Now()}, "out"}, "Failed committing to db"},
-		{"test-hash-mismsatch", args{&structs.OpenTempFile{TempFile: "a", Path: "b", Hash: wronghash, Encrypted: false, LastUpdated: time.Now()}, "out"}, "hash mismatch"},
+		{"test-dberror", args{&structs.OpenTempFile{TempFile: "a", Manifest: &structs.Manifest{Path: "b"}, Trailer: &structs.Trailer{Hash: hash}, LastUpdated: time.Now()}, "out"}, "Failed committing to db"},
+		{"test-hash-mismsatch", args{&structs.OpenTempFile{TempFile: "a", Manifest: &structs.Manifest{Path: "b"}, Trailer: &structs.Trailer{Hash: wronghash}, LastUpdated: time.Now()}, "out"}, "hash mismatch"},
+		{"test-unsafe-path", args{&structs.OpenTempFile{TempFile: "a", Manifest: &structs.Manifest{Path: "../../b"}, Trailer: &structs.Trailer{Hash: hash}, LastUpdated: time.Now()}, "out"}, "Rejected transfer, 1 rejected so far"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -127,3 +107,209 @@ func Test_worker(t *testing.T) {
 		})
 	}
 }
+
+func Test_worker_sequence(t *testing.T) {
+	var memLog bytes.Buffer
+	logrus.SetOutput(&memLog)
+	data := []byte{1, 2, 3, 4}
+	hash := [32]byte{0x9f, 0x64, 0xa7, 0x47, 0xe1, 0xb9, 0x7f, 0x13, 0x1f, 0xab, 0xb6, 0xb4, 0x47, 0x29, 0x6c, 0x9b, 0x6f, 0x02, 0x01, 0xe7, 0x9f, 0xb3, 0xc5, 0x35, 0x6e, 0x6c, 0x77, 0xe8, 0x9b, 0x6a, 0x80, 0x6a}
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&database.File{}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	tempfile := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write := &structs.OpenTempFile{TempFile: tempfile("write"), Manifest: &structs.Manifest{Path: "/a", Sequence: 3}, Trailer: &structs.Trailer{Hash: hash}}
+	stale := &structs.OpenTempFile{TempFile: tempfile("stale"), Manifest: &structs.Manifest{Path: "/b", Sequence: 2}, Trailer: &structs.Trailer{Hash: hash}}
+
+	// The delete and the renames were queued before the write of their path but arrive after it
+	ch := make(chan *structs.OpenTempFile, 10)
+	for _, file := range []*structs.OpenTempFile{
+		write,
+		{Manifest: &structs.Manifest{Path: "/a", Op: structs.OpDelete, Sequence: 2}},
+		{Manifest: &structs.Manifest{Path: "/b", Op: structs.OpRename, Target: "/a", Sequence: 1}},
+		{Manifest: &structs.Manifest{Path: "/a", Op: structs.OpRename, Target: "/b", Sequence: 4}},
+		stale,
+		{Manifest: &structs.Manifest{Path: "/b", Op: structs.OpRename, Target: "/c"}},
+	} {
+		ch <- file
+	}
+	conf := fileCloserConfig{db: db, outdir: filepath.Join(dir, "out"), policy: MirrorPolicyApply, input: ch}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(2 * time.Second)
+		cancel()
+	}()
+	worker(ctx, &conf)
+
+	// Unordered transfers are always applied
+	if _, err := os.Stat(filepath.Join(conf.outdir, "c")); err != nil {
+		t.Fatalf("Expected the file to end up where the last rename put it: %v", err)
+	}
+	if n := strings.Count(memLog.String(), ErrSuperseded.Error()); n != 3 {
+		t.Fatalf("Skipped %d transfers, want 3: %s", n, memLog.String())
+	}
+	if _, err := os.Stat(stale.TempFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected the tempfile of the skipped write to be removed")
+	}
+}
+
+func Test_applyOp(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		manifest    structs.Manifest
+		existing    []string
+		wantErr     bool
+		wantExist   []string
+		wantMissing []string
+		wantArchive int
+	}{
+		{"test-delete-apply", MirrorPolicyApply, structs.Manifest{Path: "/tmp/a", Op: structs.OpDelete}, []string{"tmp/a"}, false, nil, []string{"tmp/a"}, 0},
+		{"test-delete-archive", MirrorPolicyArchive, structs.Manifest{Path: "/tmp/a", Op: structs.OpDelete}, []string{"tmp/a"}, false, nil, []string{"tmp/a"}, 1},
+		{"test-delete-encrypted", MirrorPolicyApply, structs.Manifest{Path: "/tmp/a", Op: structs.OpDelete, Encrypted: true}, []string{"tmp/a", "tmp/a.zip"}, false, []string{"tmp/a"}, []string{"tmp/a.zip"}, 0},
+		{"test-delete-missing", MirrorPolicyApply, structs.Manifest{Path: "/tmp/a", Op: structs.OpDelete}, nil, false, nil, nil, 0},
+		{"test-delete-outdir", MirrorPolicyApply, structs.Manifest{Path: "/", Op: structs.OpDelete}, []string{"tmp/a"}, true, []string{"tmp/a"}, nil, 0},
+		{"test-delete-outside", MirrorPolicyApply, structs.Manifest{Path: "../../a", Op: structs.OpDelete}, nil, true, nil, nil, 0},
+		{"test-rename-apply", MirrorPolicyApply, structs.Manifest{Path: "/tmp/a", Op: structs.OpRename, Target: "/tmp/c/b"}, []string{"tmp/a", "tmp/c/b"}, false, []string{"tmp/c/b"}, []string{"tmp/a"}, 0},
+		{"test-rename-archive", MirrorPolicyArchive, structs.Manifest{Path: "/tmp/a", Op: structs.OpRename, Target: "/tmp/c/b"}, []string{"tmp/a", "tmp/c/b"}, false, []string{"tmp/c/b"}, []string{"tmp/a"}, 1},
+		{"test-rename-missing", MirrorPolicyApply, structs.Manifest{Path: "/tmp/a", Op: structs.OpRename, Target: "/tmp/b"}, nil, true, nil, []string{"tmp/b"}, 0},
+		{"test-rename-outside", MirrorPolicyApply, structs.Manifest{Path: "/tmp/a", Op: structs.OpRename, Target: "../../b"}, []string{"tmp/a"}, true, []string{"tmp/a"}, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			conf := fileCloserConfig{outdir: filepath.Join(dir, "out"), policy: tt.policy, archivedir: filepath.Join(dir, "archive")}
+			for _, path := range tt.existing {
+				path = filepath.Join(conf.outdir, path)
+				if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(path), os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := applyOp(&tt.manifest, &conf); (err != nil) != tt.wantErr {
+				t.Fatalf("applyOp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, path := range tt.wantExist {
+				if _, err := os.Stat(filepath.Join(conf.outdir, path)); err != nil {
+					t.Errorf("Expected '%s' to exist: %v", path, err)
+				}
+			}
+			for _, path := range tt.wantMissing {
+				if _, err := os.Stat(filepath.Join(conf.outdir, path)); !os.IsNotExist(err) {
+					t.Errorf("Expected '%s' to be gone", path)
+				}
+			}
+			archived := 0
+			_ = filepath.Walk(conf.archivedir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					archived++
+				}
+				return nil
+			})
+			if archived != tt.wantArchive {
+				t.Errorf("Archived %d files, want %d", archived, tt.wantArchive)
+			}
+		})
+	}
+}
+
+func Test_closeFile_metadata(t *testing.T) {
+	data := []byte{1, 2, 3, 4}
+	hash := [32]byte{0x9f, 0x64, 0xa7, 0x47, 0xe1, 0xb9, 0x7f, 0x13, 0x1f, 0xab, 0xb6, 0xb4, 0x47, 0x29, 0x6c, 0x9b, 0x6f, 0x02, 0x01, 0xe7, 0x9f, 0xb3, 0xc5, 0x35, 0x6e, 0x6c, 0x77, 0xe8, 0x9b, 0x6a, 0x80, 0x6a}
+	modtime := time.Unix(1666000000, 0)
+
+	tests := []struct {
+		name      string
+		metadata  structs.Metadata
+		overrides Overrides
+		wantMode  os.FileMode
+	}{
+		{"test-file", structs.Metadata{Type: structs.EntryFile, Mode: 0640, ModTime: modtime.UnixNano()}, Overrides{}, 0640},
+		{"test-file-override", structs.Metadata{Type: structs.EntryFile, Mode: 0640, ModTime: modtime.UnixNano()}, Overrides{FileMode: 0600}, 0600},
+		{"test-dir", structs.Metadata{Type: structs.EntryDir, Mode: 0755, ModTime: modtime.UnixNano()}, Overrides{}, os.ModeDir | 0755},
+		{"test-dir-readonly", structs.Metadata{Type: structs.EntryDir, Mode: 0555, ModTime: modtime.UnixNano()}, Overrides{}, os.ModeDir | 0755},
+		{"test-dir-override", structs.Metadata{Type: structs.EntryDir, Mode: 0755, ModTime: modtime.UnixNano()}, Overrides{DirMode: 0700}, os.ModeDir | 0700},
+		{"test-symlink", structs.Metadata{Type: structs.EntrySymlink, LinkTarget: "target"}, Overrides{}, os.ModeSymlink},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if runtime.GOOS == "windows" {
+				t.Skip("Modes aren't kept on windows")
+			}
+			dir := t.TempDir()
+			conf := fileCloserConfig{outdir: dir, overrides: tt.overrides}
+			file := &structs.OpenTempFile{TempFile: filepath.Join(dir, "a.tmp"), Manifest: &structs.Manifest{Path: "b", Metadata: tt.metadata}, Trailer: &structs.Trailer{Hash: hash}}
+			if err := os.WriteFile(file.TempFile, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			// Closing twice replaces the entry the first close left behind
+			for i := 0; i < 2; i++ {
+				if err := closeFile(file, &conf); err != nil {
+					t.Fatalf("closeFile() error = %v", err)
+				}
+				if err := os.WriteFile(file.TempFile, data, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			info, err := os.Lstat(filepath.Join(dir, "b"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mode := info.Mode()
+			if tt.metadata.Type == structs.EntrySymlink {
+				mode = mode.Type()
+				if target, err := os.Readlink(filepath.Join(dir, "b")); err != nil || target != "target" {
+					t.Fatalf("Symlink points at '%s', %v", target, err)
+				}
+			} else if !info.ModTime().Equal(modtime) {
+				t.Fatalf("ModTime = %v, want %v", info.ModTime(), modtime)
+			}
+			if mode != tt.wantMode {
+				t.Fatalf("Mode = %v, want %v", mode, tt.wantMode)
+			}
+		})
+	}
+}
+
+func Test_parseOwnership(t *testing.T) {
+	tests := []struct {
+		ownership string
+		wantChown bool
+		wantUid   int
+		wantGid   int
+		wantErr   bool
+	}{
+		{"", false, 0, 0, false},
+		{OwnershipPreserve, false, 0, 0, false},
+		{"1000:100", true, 1000, 100, false},
+		{"1000", false, 0, 0, true},
+		{"root:root", false, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ownership, func(t *testing.T) {
+			chown, uid, gid, err := parseOwnership(tt.ownership)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOwnership() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if chown != tt.wantChown || uid != tt.wantUid || gid != tt.wantGid {
+				t.Fatalf("parseOwnership() = %v, %d, %d, want %v, %d, %d", chown, uid, gid, tt.wantChown, tt.wantUid, tt.wantGid)
+			}
+		})
+	}
+}
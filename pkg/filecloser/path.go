@@ -0,0 +1,203 @@
+package filecloser
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+// Paths come from the other side of the diode and are treated as hostile,
+// a path that could reach outside of the out dir or into the receiver's own folders is rejected as a whole
+var ErrUnsafePath = errors.New("unsafe path")
+
+// Longest file name most filesystems take
+const nameMax = 255
+
+// Names Windows maps to devices whatever their extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func checkName(name string) error {
+	if name == ".." {
+		return fmt.Errorf("%w: parent directory component", ErrUnsafePath)
+	}
+	if len(name) > nameMax {
+		return fmt.Errorf("%w: component of %d bytes is longer than %d", ErrUnsafePath, len(name), nameMax)
+	}
+	if runtime.GOOS == "windows" {
+		if stem, _, _ := strings.Cut(name, "."); reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+			return fmt.Errorf("%w: reserved name '%s'", ErrUnsafePath, name)
+		}
+		if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+			return fmt.Errorf("%w: name '%s' ends with a dot or a space", ErrUnsafePath, name)
+		}
+	}
+	return nil
+}
+
+// Maps a path from the sender, of either a windows or a unix sender, to a relative path under the out dir
+// Both '/' and '\' separate components whichever sender it came from, so a component can't hide a '..' behind the other one
+// The root and the leading drive of absolute paths become the top of the out dir while empty and '.' components are dropped,
+// paths with '..' or drive components, control characters or no components at all are rejected
+func normalizePath(path string) (string, error) {
+	for _, c := range path {
+		if c < 0x20 || c == 0x7f {
+			return "", fmt.Errorf("%w: control character %q", ErrUnsafePath, c)
+		}
+	}
+	var parts []string
+	for i, part := range strings.FieldsFunc(path, func(c rune) bool { return c == '/' || c == '\\' }) {
+		if isDrive(part) {
+			if i != 0 || len(part) != 2 {
+				return "", fmt.Errorf("%w: drive component '%s'", ErrUnsafePath, part)
+			}
+			part = part[:1]
+		}
+		part = strings.ReplaceAll(part, ":", "")
+		if part == "" || part == "." {
+			continue
+		}
+		if err := checkName(part); err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("%w: path has no components", ErrUnsafePath)
+	}
+	newpath := filepath.Join(parts...)
+	if filepath.IsAbs(newpath) || filepath.VolumeName(newpath) != "" || !within(".", newpath) {
+		return "", fmt.Errorf("%w: path '%s' leads outside of the out dir", ErrUnsafePath, path)
+	}
+	return newpath, nil
+}
+
+// A component that is a windows drive, such as 'c:' or 'c:name' which is relative to the drive's current directory
+func isDrive(part string) bool {
+	return len(part) >= 2 && part[1] == ':' && ('a' <= part[0] && part[0] <= 'z' || 'A' <= part[0] && part[0] <= 'Z')
+}
+
+func within(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Checks that dir is a directory and not a symlink to one, creating it if it is missing and create is set
+// Returns false if it is missing
+func checkDir(dir string, create bool) (bool, error) {
+	info, err := os.Lstat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		if !create {
+			return false, nil
+		}
+		// Another worker may be creating it at the same time
+		if err = os.Mkdir(dir, os.ModePerm); err != nil && !errors.Is(err, fs.ErrExist) {
+			return false, fmt.Errorf("failed creating directory path: %v", err)
+		}
+		info, err = os.Lstat(dir)
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return false, fmt.Errorf("%w: '%s' is a symlink", ErrUnsafePath, dir)
+	}
+	if !info.IsDir() {
+		return false, fmt.Errorf("'%s' is not a directory", dir)
+	}
+	return true, nil
+}
+
+// Resolves a relative path under root one directory at a time like openat with O_NOFOLLOW would,
+// so a symlink the sender created earlier can't lead a later path outside of root
+// The last component is left to the caller, renames and removes replace a symlink there rather than follow it
+// The receiver is the only one writing under root so a checked directory isn't swapped for a symlink behind its back
+func resolvePath(root string, rel string, create bool) (string, error) {
+	// The root comes from the config and is trusted
+	if create {
+		if err := os.MkdirAll(root, os.ModePerm); err != nil {
+			return "", fmt.Errorf("failed creating directory path: %v", err)
+		}
+	}
+	dir := root
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		exists, err := checkDir(dir, create)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			break // Nothing below it exists either
+		}
+	}
+	return filepath.Join(root, rel), nil
+}
+
+// Maps a path from the sender into the out dir, the tempdir and the archive dir belong to the receiver
+// so paths that lead into them are rejected, as are paths that are the out dir itself
+func outPath(conf *fileCloserConfig, path string, encrypted bool, create bool) (string, error) {
+	rel, err := normalizePath(path)
+	if err != nil {
+		return "", err
+	}
+	if encrypted {
+		// The suffix has to fit in the name as well
+		rel += ".zip"
+		if err := checkName(filepath.Base(rel)); err != nil {
+			return "", err
+		}
+	}
+	newpath := filepath.Join(conf.outdir, rel)
+	if newpath == filepath.Clean(conf.outdir) || !within(conf.outdir, newpath) {
+		return "", fmt.Errorf("%w: path '%s' leads outside of the out dir", ErrUnsafePath, path)
+	}
+	for _, reserved := range []string{conf.tempdir, conf.archivedir} {
+		if reserved != "" && within(reserved, newpath) {
+			return "", fmt.Errorf("%w: path '%s' is in the receiver's '%s'", ErrUnsafePath, path, reserved)
+		}
+	}
+	return resolvePath(conf.outdir, rel, create)
+}
+
+// A symlink is followed by whoever opens it later, so unless unsafe symlinks are allowed its target has to be relative
+// and stay under the out dir once joined to the directory of the link.
+// '..' is only taken at the start of the target, after a name it could climb out of whatever symlink the name is
+func checkLinkTarget(conf *fileCloserConfig, linkpath string, target string) error {
+	if conf.overrides.AllowUnsafeSymlinks {
+		return nil
+	}
+	if target == "" {
+		return fmt.Errorf("%w: empty symlink target", ErrUnsafePath)
+	}
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" || os.IsPathSeparator(target[0]) {
+		return fmt.Errorf("%w: symlink target '%s' is absolute", ErrUnsafePath, target)
+	}
+	dir := filepath.Dir(linkpath)
+	named := false
+	separator := func(c rune) bool { return c < utf8.RuneSelf && os.IsPathSeparator(uint8(c)) }
+	for _, part := range strings.FieldsFunc(target, separator) {
+		switch {
+		case part == ".":
+		case part == "..":
+			if named {
+				return fmt.Errorf("%w: symlink target '%s' has '..' after a name", ErrUnsafePath, target)
+			}
+			dir = filepath.Dir(dir)
+			if !within(conf.outdir, dir) {
+				return fmt.Errorf("%w: symlink target '%s' leads outside of the out dir", ErrUnsafePath, target)
+			}
+		default:
+			named = true
+		}
+	}
+	return nil
+}
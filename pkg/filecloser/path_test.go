@@ -0,0 +1,295 @@
+package filecloser
+
+import (
+	"crypto/sha256"
+	"errors"
+	"oneway-filesync/pkg/structs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_normalizePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"test1", "/tmp/out/check", "tmp/out/check", false},
+		{"test2", "c:\\tmp\\out\\check", "c/tmp/out/check", false},
+		{"test-dot-components", "/tmp/./out//check/", "tmp/out/check", false},
+		{"test-dots-in-name", "/tmp/..check/a..b", "tmp/..check/a..b", false},
+		{"test-parent", "/tmp/../../etc/passwd", "", true},
+		{"test-parent-windows", "c:\\tmp\\..\\..\\windows", "", true},
+		{"test-parent-only", "..", "", true},
+		{"test-root", "/", "", true},
+		{"test-empty", "", "", true},
+		{"test-dot", ".", "", true},
+		{"test-nul", "/tmp/a\x00b", "", true},
+		{"test-newline", "/tmp/a\nb", "", true},
+		{"test-long-name", "/tmp/" + strings.Repeat("a", 256), "", true},
+		{"test-mixed-separators", "/tmp\\out/check", "tmp/out/check", false},
+		{"test-parent-backslash", "x\\../../../etc/passwd", "", true},
+		{"test-parent-mixed", "a/b\\..\\..\\..\\c", "", true},
+		{"test-parent-slash-windows", "c:\\tmp/../../windows", "", true},
+		{"test-drive-inside", "/tmp/c:/windows", "", true},
+		{"test-drive-relative", "c:windows\\system32", "", true},
+		{"test-colon-in-name", "/tmp/12:00", "tmp/1200", false},
+		{"test-long-path", strings.Repeat("/"+strings.Repeat("a", 255), 20), strings.Repeat("/"+strings.Repeat("a", 255), 20)[1:], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizePath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("normalizePath() error = %v, want %v", err, ErrUnsafePath)
+			}
+			if runtime.GOOS == "windows" {
+				tt.want = strings.ReplaceAll(tt.want, "/", "\\")
+			}
+			if got != tt.want {
+				t.Errorf("normalizePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkName_reserved(t *testing.T) {
+	for _, name := range []string{"CON", "con", "nul.txt", "COM1.tar.gz", "lpt9", "a.", "a "} {
+		if err := checkName(name); (err != nil) != (runtime.GOOS == "windows") {
+			t.Errorf("checkName(%s) error = %v on %s", name, err, runtime.GOOS)
+		}
+	}
+	for _, name := range []string{"console", "COM10", "a.b", ".hidden"} {
+		if err := checkName(name); err != nil {
+			t.Errorf("checkName(%s) error = %v", name, err)
+		}
+	}
+}
+
+// Every hostile path has to fail without touching anything outside of the out dir
+func Test_closeFile_hostile(t *testing.T) {
+	data := []byte{1, 2, 3, 4}
+	hash := [32]byte{0x9f, 0x64, 0xa7, 0x47, 0xe1, 0xb9, 0x7f, 0x13, 0x1f, 0xab, 0xb6, 0xb4, 0x47, 0x29, 0x6c, 0x9b, 0x6f, 0x02, 0x01, 0xe7, 0x9f, 0xb3, 0xc5, 0x35, 0x6e, 0x6c, 0x77, 0xe8, 0x9b, 0x6a, 0x80, 0x6a}
+
+	tests := []struct {
+		name     string
+		manifest structs.Manifest
+		symlinks map[string]string // Planted in the out dir beforehand, name to target relative to the test dir
+	}{
+		{"test-parent", structs.Manifest{Path: "../outside/a"}, nil},
+		{"test-deep-parent", structs.Manifest{Path: "/a/b/../../../../outside/a"}, nil},
+		{"test-windows-parent", structs.Manifest{Path: "c:\\..\\..\\outside\\a"}, nil},
+		{"test-mixed-parent", structs.Manifest{Path: "x\\../../outside/a"}, nil},
+		{"test-nul", structs.Manifest{Path: "/a\x00/../../outside/a"}, nil},
+		{"test-tempdir", structs.Manifest{Path: "/tempfiles/a"}, nil},
+		{"test-archive", structs.Manifest{Path: "/archive/a"}, nil},
+		{"test-symlink-parent", structs.Manifest{Path: "/link/a"}, map[string]string{"link": "outside"}},
+		{"test-symlink-deep-parent", structs.Manifest{Path: "/d/link/a"}, map[string]string{"d/link": "outside"}},
+		{"test-symlink-dir", structs.Manifest{Path: "/link", Metadata: structs.Metadata{Type: structs.EntryDir, Mode: 0o777}}, map[string]string{"link": "outside"}},
+		{"test-symlink-under-symlink", structs.Manifest{Path: "/link/b", Metadata: structs.Metadata{Type: structs.EntrySymlink, LinkTarget: "/"}}, map[string]string{"link": "outside"}},
+		{"test-symlink-absolute-target", structs.Manifest{Path: "/b", Metadata: structs.Metadata{Type: structs.EntrySymlink, LinkTarget: "/etc"}}, nil},
+		{"test-symlink-parent-target", structs.Manifest{Path: "/d/b", Metadata: structs.Metadata{Type: structs.EntrySymlink, LinkTarget: "../../outside"}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			outside := filepath.Join(dir, "outside")
+			if err := os.Mkdir(outside, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			conf := fileCloserConfig{outdir: filepath.Join(dir, "out")}
+			conf.tempdir = filepath.Join(conf.outdir, "tempfiles")
+			conf.archivedir = filepath.Join(conf.outdir, "archive")
+			for name, target := range tt.symlinks {
+				name = filepath.Join(conf.outdir, name)
+				if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(filepath.Join(dir, target), name); err != nil {
+					t.Skipf("Symlinks aren't supported: %v", err)
+				}
+			}
+			tempfile := filepath.Join(dir, "a.tmp")
+			if err := os.WriteFile(tempfile, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			file := &structs.OpenTempFile{TempFile: tempfile, Manifest: &tt.manifest, Trailer: &structs.Trailer{Hash: hash}, LastUpdated: time.Now()}
+			err := closeFile(file, &conf)
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("closeFile() error = %v, want %v", err, ErrUnsafePath)
+			}
+			entries, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("Hostile path wrote %v outside of the out dir", entries)
+			}
+			if info, err := os.Stat(outside); err != nil || info.Mode().Perm() != 0o755 {
+				t.Fatalf("Hostile path changed the directory outside of the out dir")
+			}
+			if _, err := os.Stat(tempfile); err != nil {
+				t.Fatalf("Rejected tempfile was moved: %v", err)
+			}
+		})
+	}
+}
+
+func Test_applyOp_hostile(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest structs.Manifest
+	}{
+		{"test-delete-parent", structs.Manifest{Path: "../outside/a", Op: structs.OpDelete}},
+		{"test-delete-symlink-parent", structs.Manifest{Path: "/link/a", Op: structs.OpDelete}},
+		{"test-delete-tempdir", structs.Manifest{Path: "/tempfiles", Op: structs.OpDelete}},
+		{"test-rename-from-symlink-parent", structs.Manifest{Path: "/link/a", Op: structs.OpRename, Target: "/b"}},
+		{"test-rename-into-symlink-parent", structs.Manifest{Path: "/a", Op: structs.OpRename, Target: "/link/b"}},
+		{"test-rename-into-archive", structs.Manifest{Path: "/a", Op: structs.OpRename, Target: "/archive/b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			outside := filepath.Join(dir, "outside")
+			if err := os.Mkdir(outside, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(outside, "a"), []byte{1}, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			conf := fileCloserConfig{outdir: filepath.Join(dir, "out"), policy: MirrorPolicyApply}
+			conf.tempdir = filepath.Join(conf.outdir, "tempfiles")
+			conf.archivedir = filepath.Join(conf.outdir, "archive")
+			for _, d := range []string{conf.tempdir, conf.archivedir} {
+				if err := os.MkdirAll(d, os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(conf.outdir, "a"), []byte{2}, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(outside, filepath.Join(conf.outdir, "link")); err != nil {
+				t.Skipf("Symlinks aren't supported: %v", err)
+			}
+
+			if err := applyOp(&tt.manifest, &conf); !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("applyOp() error = %v, want %v", err, ErrUnsafePath)
+			}
+			for _, path := range []string{filepath.Join(outside, "a"), filepath.Join(conf.outdir, "a"), conf.tempdir, conf.archivedir} {
+				if _, err := os.Lstat(path); err != nil {
+					t.Errorf("Expected '%s' to be left alone: %v", path, err)
+				}
+			}
+			if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+				t.Errorf("Hostile op changed the directory outside of the out dir: %v", entries)
+			}
+		})
+	}
+}
+
+func Test_checkLinkTarget(t *testing.T) {
+	outdir := filepath.Join(t.TempDir(), "out")
+	tests := []struct {
+		name    string
+		link    string
+		target  string
+		allow   bool
+		wantErr bool
+	}{
+		{"test-sibling", "a/b", "c", false, false},
+		{"test-below", "a/b", "./c/d", false, false},
+		{"test-up-to-outdir", "a/b", "../c", false, false},
+		{"test-outdir", "b", ".", false, false},
+		{"test-absolute", "a/b", "/etc/passwd", false, true},
+		{"test-empty", "a/b", "", false, true},
+		{"test-outside", "a/b", "../../c", false, true},
+		{"test-parent-after-name", "a/b", "c/../../../d", false, true},
+		{"test-parent-after-symlink", "a/b", "c/..", false, true},
+		{"test-allowed-absolute", "a/b", "/etc/passwd", true, false},
+		{"test-allowed-outside", "a/b", "../../c", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := fileCloserConfig{outdir: outdir, overrides: Overrides{AllowUnsafeSymlinks: tt.allow}}
+			err := checkLinkTarget(&conf, filepath.Join(outdir, filepath.FromSlash(tt.link)), filepath.FromSlash(tt.target))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkLinkTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("checkLinkTarget() error = %v, want %v", err, ErrUnsafePath)
+			}
+		})
+	}
+}
+
+func Test_outPath_encrypted(t *testing.T) {
+	conf := fileCloserConfig{outdir: t.TempDir()}
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"test-fits", "/tmp/" + strings.Repeat("a", nameMax-len(".zip")), false},
+		{"test-suffix-too-long", "/tmp/" + strings.Repeat("a", nameMax-len(".zip")+1), true},
+		{"test-dir-name", "/" + strings.Repeat("d", nameMax) + "/a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := outPath(&conf, tt.path, true, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("outPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("outPath() error = %v, want %v", err, ErrUnsafePath)
+			}
+			if err == nil && len(filepath.Base(got)) > nameMax {
+				t.Fatalf("outPath() = %s, its name is longer than %d", got, nameMax)
+			}
+		})
+	}
+}
+
+// Paths that flatten to the same name and paths with the longest names all land where they belong
+func Test_closeFile_names(t *testing.T) {
+	deep := strings.Repeat("/"+strings.Repeat("d", 255), 10)
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"test-underscore-dir", "/a/b_c", "a/b_c"},
+		{"test-underscore-file", "/a_b/c", "a_b/c"},
+		{"test-windows", "c:\\a\\b_c", "c/a/b_c"},
+		{"test-deep", deep, deep[1:]},
+	}
+	dir := t.TempDir()
+	conf := fileCloserConfig{outdir: filepath.Join(dir, "out")}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte(tt.name)
+			tempfile := filepath.Join(dir, "a.tmp")
+			if err := os.WriteFile(tempfile, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			file := &structs.OpenTempFile{TempFile: tempfile, Manifest: &structs.Manifest{Path: tt.path}, Trailer: &structs.Trailer{Hash: sha256.Sum256(data)}, LastUpdated: time.Now()}
+			if err := closeFile(file, &conf); err != nil {
+				t.Fatalf("closeFile() error = %v", err)
+			}
+			// Earlier files are still in place too
+			for _, earlier := range tests[:i+1] {
+				got, err := os.ReadFile(filepath.Join(conf.outdir, filepath.FromSlash(earlier.want)))
+				if err != nil || string(got) != earlier.name {
+					t.Fatalf("'%s' contains '%s', want '%s': %v", earlier.want, got, earlier.name, err)
+				}
+			}
+		})
+	}
+}
@@ -3,84 +3,412 @@ package filereader
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"oneway-filesync/pkg/compressor"
 	"oneway-filesync/pkg/database"
 	"oneway-filesync/pkg/structs"
 	"oneway-filesync/pkg/zip"
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
+// Chunks that end before skip were already sent by an earlier attempt and aren't sent again,
+// they still go through the writer so the hashes cover the whole file
 type chunkWriter struct {
 	buf       bytes.Buffer
 	chunksize int
 	offset    int64
-	sendchunk func(data []byte, offset int64)
+	count     int64
+	skip      int64
+	hashes    [][structs.HASHSIZE]byte
+	sendchunk func(data []byte, offset int64) error
 }
 
-func (w *chunkWriter) dumpChunk() {
+func (w *chunkWriter) dumpChunk() error {
 	b := make([]byte, w.chunksize)
 	n, _ := w.buf.Read(b) // err means EOF
 	if n > 0 {
-		w.sendchunk(b[:n], w.offset)
+		w.hashes = append(w.hashes, structs.ChunkHash(b[:n]))
+		if w.offset+int64(n) > w.skip {
+			if err := w.sendchunk(b[:n], w.offset); err != nil {
+				return err
+			}
+		}
 		w.offset += int64(n)
+		w.count++
 	}
+	return nil
 }
 
 func (w *chunkWriter) Write(p []byte) (int, error) {
 	_, _ = w.buf.Write(p) // bytes.Buffer.Write never returns error
 	if w.buf.Len() > w.chunksize {
-		w.dumpChunk()
+		if err := w.dumpChunk(); err != nil {
+			return 0, err
+		}
 	}
 	return len(p), nil
 }
 
-func (w *chunkWriter) Close() {
+func (w *chunkWriter) Close() error {
 	for {
 		if w.buf.Len() == 0 {
-			break
+			return nil
+		}
+		if err := w.dumpChunk(); err != nil {
+			return err
+		}
+	}
+}
+
+// The manifest is sent once before the data and once after it
+// so that a burst of loss at either end of the transfer can't lose it
+// The trailer and the full hash list can only be sent at the end so they are sent a few more times
+const (
+	manifestCopies = 2
+	hashListCopies = 2
+	trailerCopies  = 3
+)
+
+// The data is sent in windows of this many chunks each led by the hashes of its chunks, so the receiver can check
+// every chunk as it arrives while the file is still read only once. A window is held in memory until it is sent
+const hashWindow = 64
+
+// A chunk that was handed to the pipeline may still be sitting in one of its buffers when the sender dies,
+// so the offset saved for resuming lags this many chunks behind the last chunk emitted
+const resumeMargin = 256
+
+func manifestSender(manifest structs.Manifest, conf *fileReaderConfig, transferid structs.TransferId, realchunksize int) (func(index int), error) {
+	manifestdata, err := manifest.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("error encoding manifest: %v", err)
+	}
+	if len(manifestdata) > realchunksize {
+		return nil, fmt.Errorf("manifest of %d bytes does not fit in a chunk of %d bytes", len(manifestdata), realchunksize)
+	}
+	return func(index int) {
+		conf.output <- &structs.Chunk{
+			Type:       structs.PacketTypeManifest,
+			TransferId: transferid,
+			DataOffset: int64(index),
+			Data:       manifestdata,
+		}
+	}, nil
+}
+
+// Hashes that fit in a single part of a hash list
+func hashesPerPart(realchunksize int) (int, error) {
+	perpart := (realchunksize - structs.HashListHeaderSize) / structs.HASHSIZE
+	if perpart <= 0 {
+		return 0, fmt.Errorf("chunk size of %d bytes is too small for a hash list", realchunksize)
+	}
+	return perpart, nil
+}
+
+// The chunk hashes are split into parts that each fit in a chunk,
+// every part of every copy gets its own offset so the shareassembler keeps them apart
+// The full list follows the data, its parts are numbered after those of the windows which go by their first chunk
+func sendHashList(hashes [][structs.HASHSIZE]byte, conf *fileReaderConfig, transferid structs.TransferId, realchunksize int, index int) error {
+	perpart, err := hashesPerPart(realchunksize)
+	if err != nil {
+		return err
+	}
+	root := structs.MerkleRoot(hashes)
+	parts := (len(hashes) + perpart - 1) / perpart
+	for part := 0; part < parts; part++ {
+		end := (part + 1) * perpart
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		data, err := structs.HashList{
+			First:      int64(part * perpart),
+			ChunkSize:  int64(realchunksize),
+			ChunkCount: int64(len(hashes)),
+			MerkleRoot: root,
+			Hashes:     hashes[part*perpart : end],
+		}.Encode()
+		if err != nil {
+			return fmt.Errorf("error encoding hash list: %v", err)
+		}
+		conf.output <- &structs.Chunk{
+			Type:       structs.PacketTypeHashList,
+			TransferId: transferid,
+			DataOffset: int64(len(hashes) + index*parts + part),
+			Data:       data,
 		}
-		w.dumpChunk()
 	}
+	return nil
 }
 
-func sendfile(file *database.File, conf *fileReaderConfig) error {
-	realchunksize := conf.chunksize - structs.ChunkOverhead(file.Path)
+// Sends the hashes of a window of chunks ahead of them, the part has no chunk count or merkle root
+// as neither is known before the whole file was read
+func sendWindowHashes(window []*structs.Chunk, hashes [][structs.HASHSIZE]byte, conf *fileReaderConfig, realchunksize int) error {
+	first := window[0].DataOffset / int64(realchunksize)
+	data, err := structs.HashList{
+		First:     first,
+		ChunkSize: int64(realchunksize),
+		Hashes:    hashes[first : first+int64(len(window))],
+	}.Encode()
+	if err != nil {
+		return fmt.Errorf("error encoding hash list: %v", err)
+	}
+	conf.output <- &structs.Chunk{
+		Type:       structs.PacketTypeHashList,
+		TransferId: window[0].TransferId,
+		DataOffset: first,
+		Data:       data,
+	}
+	return nil
+}
+
+// Deletes, renames, directories and symlinks carry no data,
+// the manifest alone describes them and the receiver applies them once it arrives
+func sendnodata(manifest structs.Manifest, conf *fileReaderConfig, transferid structs.TransferId, realchunksize int) error {
+	sendmanifest, err := manifestSender(manifest, conf, transferid, realchunksize)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < manifestCopies; i++ {
+		sendmanifest(i)
+	}
+	return nil
+}
+
+// Reads the metadata the receiver restores from info, path is only read for the target of a symlink
+func ReadMetadata(path string, info fs.FileInfo) (structs.Metadata, error) {
+	metadata := structs.Metadata{
+		Mode:    uint32(info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)),
+		ModTime: info.ModTime().UnixNano(),
+	}
+	metadata.Uid, metadata.Gid, metadata.HasOwner = fileOwner(info)
+	switch {
+	case info.Mode().IsRegular():
+		metadata.Type = structs.EntryFile
+	case info.IsDir():
+		metadata.Type = structs.EntryDir
+	case info.Mode()&fs.ModeSymlink != 0:
+		metadata.Type = structs.EntrySymlink
+		target, err := os.Readlink(path)
+		if err != nil {
+			return metadata, fmt.Errorf("error reading symlink: %v", err)
+		}
+		metadata.LinkTarget = target
+	default:
+		return metadata, fmt.Errorf("unsupported file type %v", info.Mode().Type())
+	}
+	return metadata, nil
+}
+
+// Idle fill copies are read from the live file, so its size and modification time are kept along with the first copy
+// to tell whether it still holds what was sent. A snapshot stands for the live file as long as the live file
+// keeps the modification time the snapshot was taken with, otherwise nothing is kept and idle fill skips the file
+func recordSent(file *database.File, info fs.FileInfo) {
+	if file.SpoolPath != "" {
+		modtime := info.ModTime().UnixNano()
+		if file.SpoolMetadata != nil {
+			modtime = file.SpoolMetadata.ModTime
+		}
+		live, err := os.Lstat(file.Path)
+		if err != nil || live.ModTime().UnixNano() != modtime {
+			file.SentSize, file.SentModTime = 0, 0
+			return
+		}
+		info = live
+	}
+	file.SentSize = info.Size()
+	file.SentModTime = info.ModTime().UnixNano()
+}
+
+func changedSinceSent(file *database.File) bool {
+	info, err := os.Lstat(file.Path)
+	return err != nil || info.Size() != file.SentSize || info.ModTime().UnixNano() != file.SentModTime
+}
+
+// The progress callback is called at every chunk boundary with the offset up to which chunks were handed to the pipeline
+// and the offset from which the file can safely be resumed after a crash, an error from it stops the sending
+func sendfile(file *database.File, conf *fileReaderConfig, progress func(sent int64, resumable int64) error) error {
+	realchunksize := conf.chunksize - structs.ChunkOverhead
 	realchunksize *= conf.required // FEC chunk size is BuffferSize/Required
+	if realchunksize <= 0 {
+		return fmt.Errorf("chunk size %d is too small for the chunk overhead of %d", conf.chunksize, structs.ChunkOverhead)
+	}
+
+	var transferid structs.TransferId
+	copy(transferid[:], file.TransferId)
 
-	w := chunkWriter{
+	if file.Op != structs.OpWrite {
+		return sendnodata(structs.Manifest{
+			Path:      file.Path,
+			Encrypted: file.Encrypted,
+			Op:        file.Op,
+			Target:    file.Target,
+			Sequence:  file.Sequence,
+		}, conf, transferid, realchunksize)
+	}
+
+	// A spooled file is sent from its snapshot which is already zipped if the file is encrypted
+	source := file.Path
+	if file.SpoolPath != "" {
+		source = file.SpoolPath
+	}
+	zipped := file.Encrypted && file.SpoolPath != ""
+
+	// Symlinks are sent as links rather than as the file they point at
+	info, err := os.Lstat(source)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	recordSent(file, info)
+	if !info.Mode().IsRegular() {
+		metadata, err := ReadMetadata(source, info)
+		if err != nil {
+			return err
+		}
+		return sendnodata(structs.Manifest{Path: file.Path, Metadata: metadata, Sequence: file.Sequence}, conf, transferid, realchunksize)
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer f.Close()
+
+	info, err = f.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting file info: %v", err)
+	}
+	metadata, err := ReadMetadata(source, info)
+	if err != nil {
+		return err
+	}
+	// The snapshot is owned by the sender and has none of the special mode bits, the file is sent with its own
+	if file.SpoolMetadata != nil {
+		metadata = *file.SpoolMetadata
+	}
+
+	// Encrypted files are deflated by the zip already
+	compress := file.Compress && !file.Encrypted
+	if compress {
+		head := make([]byte, 16)
+		n, _ := f.ReadAt(head, 0) // A short read just means a short file
+		compress = !compressor.AlreadyCompressed(head[:n])
+	}
+	manifest := structs.Manifest{
+		Path:      file.Path,
+		Size:      info.Size(),
+		Encrypted: file.Encrypted,
+		Metadata:  metadata,
+		Sequence:  file.Sequence,
+	}
+	sendmanifest, err := manifestSender(manifest, conf, transferid, realchunksize)
+	if err != nil {
+		return err
+	}
+
+	perpart, err := hashesPerPart(realchunksize)
+	if err != nil {
+		return err
+	}
+	windowsize := hashWindow
+	if perpart < windowsize {
+		windowsize = perpart
+	}
+	var window []*structs.Chunk
+	var w chunkWriter
+	sendwindow := func() error {
+		if len(window) == 0 {
+			return nil
+		}
+		if err := sendWindowHashes(window, w.hashes, conf, realchunksize); err != nil {
+			return err
+		}
+		chunks := window
+		window = nil
+		for _, chunk := range chunks {
+			conf.output <- chunk
+			if progress == nil {
+				continue
+			}
+			resumable := chunk.DataOffset - resumeMargin*int64(realchunksize)
+			if resumable < 0 {
+				resumable = 0
+			}
+			if err := progress(chunk.DataOffset+int64(len(chunk.Data)), resumable); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w = chunkWriter{
 		chunksize: realchunksize,
-		sendchunk: func(data []byte, offset int64) {
-			chunk := structs.Chunk{
-				Path:       file.Path,
-				Encrypted:  file.Encrypted,
+		skip:      file.SentOffset,
+		sendchunk: func(data []byte, offset int64) error {
+			window = append(window, &structs.Chunk{
+				Type:       structs.PacketTypeShare,
+				TransferId: transferid,
 				DataOffset: offset,
 				Data:       data,
+				Compress:   compress,
+			})
+			if len(window) < windowsize {
+				return nil
 			}
-			copy(chunk.Hash[:], file.Hash)
-			conf.output <- &chunk
+			return sendwindow()
 		},
 	}
 
-	f, err := os.Open(file.Path)
-	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
-	}
-	defer f.Close()
+	// The hash covers exactly the bytes that are sent, so it always matches what the receiver gets
+	// even if the file changes after it was queued
+	hasher := sha256.New()
+	out := io.MultiWriter(hasher, &w)
 
-	if file.Encrypted {
-		err = zip.ZipFile(&w, f)
+	sendmanifest(0)
+	if file.Encrypted && !zipped {
+		err = zip.ZipFile(out, f)
 	} else {
-		_, err = io.Copy(&w, f)
+		_, err = io.Copy(out, f)
 	}
 	if err != nil {
 		return err
 	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if err = sendwindow(); err != nil {
+		return err
+	}
+
+	for i := 1; i < manifestCopies; i++ {
+		sendmanifest(i)
+	}
+	for i := 0; i < hashListCopies; i++ {
+		if err = sendHashList(w.hashes, conf, transferid, realchunksize, i); err != nil {
+			return err
+		}
+	}
 
-	w.Close()
+	trailer := structs.Trailer{Size: w.offset, ChunkCount: w.count}
+	copy(trailer.Hash[:], hasher.Sum(nil))
+	file.Hash = trailer.Hash[:]
+	trailerdata, err := trailer.Encode()
+	if err != nil {
+		return fmt.Errorf("error encoding trailer: %v", err)
+	}
+	for i := 0; i < trailerCopies; i++ {
+		conf.output <- &structs.Chunk{
+			Type:       structs.PacketTypeTrailer,
+			TransferId: transferid,
+			DataOffset: int64(i),
+			Data:       trailerdata,
+		}
+	}
 	return nil
 }
 
@@ -92,6 +420,16 @@ type fileReaderConfig struct {
 	output    chan *structs.Chunk
 }
 
+// How often the lease of in flight files is renewed along with the offset saved for resuming after a crash,
+// this is also when they are checked for preemption
+const progressInterval = time.Second
+
+// A file of higher priority that is waiting in the queue only preempts the files being sent after this long,
+// until then it is left to the queuereader which may hand it to an idle filereader
+const preemptAfter = time.Second
+
+var errPaused = errors.New("paused for a file of higher priority")
+
 func worker(ctx context.Context, conf *fileReaderConfig) {
 	for {
 		select {
@@ -99,12 +437,74 @@ func worker(ctx context.Context, conf *fileReaderConfig) {
 			return
 		case file := <-conf.input:
 			l := logrus.WithFields(logrus.Fields{
-				"Path": file.Path,
-				"Hash": fmt.Sprintf("%x", file.Hash),
+				"TransferId": fmt.Sprintf("%x", file.TransferId),
+				"Path":       file.Path,
+				"Hash":       fmt.Sprintf("%x", file.Hash),
 			})
-			l.Infof("Started sending file")
+			if file.Op != structs.OpWrite {
+				l = l.WithFields(logrus.Fields{"Op": file.Op, "Target": file.Target})
+			}
+			if file.SentOffset > 0 {
+				l.Infof("Resuming sending file from offset %d", file.SentOffset)
+			} else if file.IdleFill {
+				l.Infof("Started sending idle fill copy of file")
+			} else {
+				l.Infof("Started sending file")
+			}
 
-			err := sendfile(&file, conf)
+			lastsave := time.Now()
+			progress := func(sent int64, resumable int64) error {
+				if time.Since(lastsave) < progressInterval {
+					return nil
+				}
+				lastsave = time.Now()
+				preempt, err := database.HigherPriority(conf.db, &file, time.Now().Add(-preemptAfter))
+				if err != nil {
+					l.Errorf("Error checking queue for files of higher priority %v", err)
+				}
+				if preempt {
+					// Every chunk before sent is already in the pipeline, so the file continues right after it
+					err = database.ReleaseFile(conf.db, &file, sent)
+					if err == nil {
+						return errPaused
+					}
+					if errors.Is(err, database.ErrLeaseLost) {
+						return err
+					}
+					l.Errorf("Error pausing file in database %v", err)
+				}
+				err = database.RenewLease(conf.db, &file, resumable)
+				if errors.Is(err, database.ErrLeaseLost) {
+					return err
+				}
+				if err != nil {
+					l.Errorf("Error saving progress in database %v", err)
+				}
+				return nil
+			}
+
+			if file.IdleFill && changedSinceSent(&file) {
+				l.Infof("Skipped idle fill copy of file, it changed since it was sent")
+				file.Success = false
+				if err := database.FinishFile(conf.db, &file); err != nil {
+					l.Errorf("Error updating Finished in database %v", err)
+				}
+				continue
+			}
+
+			err := sendfile(&file, conf, progress)
+			if errors.Is(err, errPaused) {
+				if file.Finished {
+					l.Infof("Dropped idle fill copy of file for a file of higher priority")
+				} else {
+					l.Infof("Paused sending file at offset %d for a file of higher priority", file.SentOffset)
+				}
+				continue
+			}
+			if errors.Is(err, database.ErrLeaseLost) {
+				l.Warnf("Stopped sending file, its lease was taken over by another sender")
+				continue
+			}
 			if err != nil {
 				file.Success = false
 				l.Errorf("File sending failed with err: %v", err)
@@ -114,10 +514,16 @@ func worker(ctx context.Context, conf *fileReaderConfig) {
 
 			}
 
-			file.Finished = true
-			err = conf.db.Save(&file).Error
+			spoolpath := file.SpoolPath
+			err = database.FinishFile(conf.db, &file)
 			if err != nil {
 				l.Errorf("Error updating Finished in database %v", err)
+			} else if !file.Finished {
+				l.Infof("Sent copy %d of %d, the next one is sent in %v", file.CopiesSent, file.Copies, file.CopySpacing)
+			} else if spoolpath != "" {
+				if err := os.Remove(spoolpath); err != nil {
+					l.Errorf("Error removing snapshot from spool %v", err)
+				}
 			}
 		}
 	}
@@ -3,9 +3,13 @@ package filereader
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"io/fs"
 	"oneway-filesync/pkg/database"
 	"oneway-filesync/pkg/structs"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -32,19 +36,27 @@ func Test_sendfile(t *testing.T) {
 		{"test-regular", args{
 			file: &database.File{Path: "a", Hash: hash, Encrypted: false},
 			conf: &fileReaderConfig{chunksize: 8192, required: 2},
-		}, 3, false},
+		}, 11, false},
 		{"test-encrypted", args{
 			file: &database.File{Path: "a", Hash: hash, Encrypted: true},
 			conf: &fileReaderConfig{chunksize: 8192, required: 2},
-		}, 1, false},
+		}, 9, false},
+		{"test-chunksize-too-small", args{
+			file: &database.File{Path: "a", Hash: hash, Encrypted: false},
+			conf: &fileReaderConfig{chunksize: structs.ChunkOverhead, required: 2},
+		}, 0, true},
 		{"test-no-such-file", args{
 			file: &database.File{Path: "b", Hash: hash, Encrypted: false},
 			conf: &fileReaderConfig{chunksize: 8192, required: 2},
 		}, 4, true},
+		{"test-rename", args{
+			file: &database.File{Path: "a", Op: structs.OpRename, Target: "c"},
+			conf: &fileReaderConfig{chunksize: 8192, required: 2},
+		}, 2, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			out := make(chan *structs.Chunk, 5)
+			out := make(chan *structs.Chunk, 20)
 			tt.args.conf.output = out
 
 			if tt.name != "test-no-such-file" {
@@ -54,7 +66,7 @@ func Test_sendfile(t *testing.T) {
 			}
 			defer os.Remove(tt.args.file.Path)
 
-			if err := sendfile(tt.args.file, tt.args.conf); (err != nil) != tt.wantErr {
+			if err := sendfile(tt.args.file, tt.args.conf, nil); (err != nil) != tt.wantErr {
 				t.Fatalf("sendfile() error = %v, wantErr %v", err, tt.wantErr)
 			}
 			if !tt.wantErr {
@@ -86,6 +98,10 @@ func Test_worker(t *testing.T) {
 			file: database.File{Path: "b", Hash: hash},
 			conf: &fileReaderConfig{chunksize: 8192, required: 2},
 		}, "File sending failed with err: error opening file:"},
+		{"test-idle-fill-changed", args{
+			file: database.File{Path: "a", Hash: hash, IdleFill: true, SentSize: 3},
+			conf: &fileReaderConfig{chunksize: 8192, required: 2},
+		}, "Skipped idle fill copy of file, it changed since it was sent"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -99,7 +115,7 @@ func Test_worker(t *testing.T) {
 			tt.args.conf.db = db
 			in := make(chan database.File, 5)
 			tt.args.conf.input = in
-			out := make(chan *structs.Chunk, 5)
+			out := make(chan *structs.Chunk, 10)
 			tt.args.conf.output = out
 
 			if tt.name != "test-no-such-file" {
@@ -123,3 +139,314 @@ func Test_worker(t *testing.T) {
 		})
 	}
 }
+
+func Test_sendfile_hash(t *testing.T) {
+	data := []byte("the hash covers the streamed bytes")
+	path := "hashed"
+	if err := os.WriteFile(path, data, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	out := make(chan *structs.Chunk, 10)
+	file := database.File{Path: path}
+	if err := sendfile(&file, &fileReaderConfig{chunksize: 8192, required: 2, output: out}, nil); err != nil {
+		t.Fatal(err)
+	}
+	close(out)
+
+	want := sha256.Sum256(data)
+	if !bytes.Equal(file.Hash, want[:]) {
+		t.Fatalf("file.Hash = %x, want %x", file.Hash, want)
+	}
+	trailers := 0
+	for chunk := range out {
+		if chunk.Type != structs.PacketTypeTrailer {
+			continue
+		}
+		trailers++
+		trailer, err := structs.DecodeTrailer(chunk.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trailer.Hash != want || trailer.Size != int64(len(data)) || trailer.ChunkCount != 1 {
+			t.Fatalf("Trailer = %v, want hash %x size %d and one chunk", trailer, want, len(data))
+		}
+	}
+	if trailers != trailerCopies {
+		t.Fatalf("Got %d trailers, want %d", trailers, trailerCopies)
+	}
+}
+
+func Test_sendfile_resume(t *testing.T) {
+	data := make([]byte, 4*8192)
+	path := "resumed"
+	if err := os.WriteFile(path, data, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	conf := &fileReaderConfig{chunksize: 8192, required: 2, output: make(chan *structs.Chunk, 10)}
+	realchunksize := int64((conf.chunksize - structs.ChunkOverhead) * conf.required)
+	file := database.File{Path: path, SentOffset: realchunksize}
+	if err := sendfile(&file, conf, nil); err != nil {
+		t.Fatal(err)
+	}
+	close(conf.output)
+
+	// The skipped chunk is still covered by the hash list and the merkle root
+	leaf := structs.ChunkHash(data[:realchunksize])
+	leaves := [][structs.HASHSIZE]byte{leaf, leaf, structs.ChunkHash(data[2*realchunksize:])}
+	var offsets []int64
+	hashlists := map[int64]bool{}
+	windows := 0
+	for chunk := range conf.output {
+		switch chunk.Type {
+		case structs.PacketTypeShare:
+			offsets = append(offsets, chunk.DataOffset)
+		case structs.PacketTypeHashList:
+			hashlist, err := structs.DecodeHashList(chunk.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hashlist.ChunkCount == 0 {
+				// Only the chunks that are sent are led by their hashes
+				windows++
+				if len(offsets) != 0 || hashlist.First != 1 || !reflect.DeepEqual(hashlist.Hashes, leaves[1:]) {
+					t.Fatalf("Window hash list = %v after %d chunks, want the hashes of the 2 sent chunks ahead of them", hashlist, len(offsets))
+				}
+				continue
+			}
+			if hashlist.First != 0 || hashlist.ChunkSize != realchunksize || hashlist.ChunkCount != 3 || hashlist.MerkleRoot != structs.MerkleRoot(leaves) || !reflect.DeepEqual(hashlist.Hashes, leaves) {
+				t.Fatalf("Hash list = %v, want the hashes of all 3 chunks and their merkle root", hashlist)
+			}
+			if len(offsets) != 2 {
+				t.Fatalf("Full hash list sent after %d chunks, want it after the data", len(offsets))
+			}
+			if hashlists[chunk.DataOffset] {
+				t.Fatalf("Hash list sent twice at offset %d", chunk.DataOffset)
+			}
+			hashlists[chunk.DataOffset] = true
+		case structs.PacketTypeTrailer:
+			trailer, err := structs.DecodeTrailer(chunk.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if trailer.Hash != sha256.Sum256(data) || trailer.ChunkCount != 3 {
+				t.Fatalf("Trailer = %v, want the hash of the whole file and 3 chunks", trailer)
+			}
+		}
+	}
+	if len(hashlists) != hashListCopies || windows != 1 {
+		t.Fatalf("Got %d hash lists and %d windows, want %d and 1", len(hashlists), windows, hashListCopies)
+	}
+	if !reflect.DeepEqual(offsets, []int64{realchunksize, 2 * realchunksize}) {
+		t.Fatalf("Sent chunks at offsets %v, want only the ones after %d", offsets, realchunksize)
+	}
+}
+
+func Test_sendfile_metadata(t *testing.T) {
+	dir := t.TempDir()
+	modtime := time.Unix(1666000000, 0)
+	regular := filepath.Join(dir, "regular")
+	if err := os.WriteFile(regular, []byte{1, 2, 3}, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(regular, 0640); err != nil { // Not subject to the umask
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(regular, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := os.Mkdir(empty, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(empty, 0750); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("regular", link); err != nil {
+		t.Skipf("Symlinks aren't supported: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		want      structs.Metadata
+		wantCount int
+	}{
+		{"test-file", regular, structs.Metadata{Type: structs.EntryFile, Mode: 0640, ModTime: modtime.UnixNano()}, manifestCopies + 1 + 1 + hashListCopies + trailerCopies},
+		{"test-dir", empty, structs.Metadata{Type: structs.EntryDir, Mode: 0750}, manifestCopies},
+		{"test-symlink", link, structs.Metadata{Type: structs.EntrySymlink, LinkTarget: "regular"}, manifestCopies},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := make(chan *structs.Chunk, 10)
+			if err := sendfile(&database.File{Path: tt.path, Sequence: 42}, &fileReaderConfig{chunksize: 8192, required: 2, output: out}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if len(out) != tt.wantCount {
+				t.Fatalf("Got %d chunks, want %d", len(out), tt.wantCount)
+			}
+			manifest, err := structs.DecodeManifest((<-out).Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.Sequence != 42 {
+				t.Fatalf("Sequence = %d, want the one the file was queued with", manifest.Sequence)
+			}
+			got := manifest.Metadata
+			if got.Type != tt.want.Type || got.LinkTarget != tt.want.LinkTarget {
+				t.Fatalf("Metadata = %+v, want %+v", got, tt.want)
+			}
+			// Only the modes and times that were set are compared, the rest depend on the platform
+			if tt.want.Mode != 0 && got.Mode != tt.want.Mode {
+				t.Fatalf("Mode = %o, want %o", got.Mode, tt.want.Mode)
+			}
+			if tt.want.ModTime != 0 && got.ModTime != tt.want.ModTime {
+				t.Fatalf("ModTime = %d, want %d", got.ModTime, tt.want.ModTime)
+			}
+		})
+	}
+}
+
+func Test_sendfile_spooled(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "live")
+	if err := os.WriteFile(path, []byte("changed after it was queued"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := []byte("as it was queued")
+	spoolpath := filepath.Join(dir, "snapshot")
+	if err := os.WriteFile(spoolpath, snapshot, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot is owned by the sender, the metadata the file had when it was queued is sent instead
+	metadata := structs.Metadata{Type: structs.EntryFile, Mode: uint32(0750 | fs.ModeSetuid), ModTime: 1666000000, HasOwner: true, Uid: 1234, Gid: 5678}
+
+	// The snapshot of an encrypted file is zipped already so it is sent as it is
+	for _, encrypted := range []bool{false, true} {
+		out := make(chan *structs.Chunk, 10)
+		file := database.File{Path: path, SpoolPath: spoolpath, SpoolMetadata: &metadata, Encrypted: encrypted}
+		if err := sendfile(&file, &fileReaderConfig{chunksize: 8192, required: 2, output: out}, nil); err != nil {
+			t.Fatal(err)
+		}
+		close(out)
+		for chunk := range out {
+			if chunk.Type == structs.PacketTypeManifest {
+				manifest, err := structs.DecodeManifest(chunk.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if manifest.Path != path || manifest.Size != int64(len(snapshot)) || manifest.Metadata != metadata {
+					t.Fatalf("Manifest = %+v, want the path and metadata of the live file and the size of the snapshot", manifest)
+				}
+			}
+			if chunk.Type == structs.PacketTypeShare && !bytes.Equal(chunk.Data, snapshot) {
+				t.Fatalf("Sent %q, want the snapshot %q", chunk.Data, snapshot)
+			}
+		}
+	}
+}
+
+func Test_changedSinceSent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "live")
+	if err := os.WriteFile(path, []byte("sent as it is"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	spoolpath := filepath.Join(dir, "snapshot")
+	if err := os.WriteFile(spoolpath, []byte("sent as it is"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modtime := time.Now().Add(-time.Hour)
+	for _, p := range []string{path, spoolpath} {
+		if err := os.Chtimes(p, modtime, modtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, spooled := range []string{"", spoolpath} {
+		file := database.File{Path: path, SpoolPath: spooled}
+		if err := sendfile(&file, &fileReaderConfig{chunksize: 8192, required: 2, output: make(chan *structs.Chunk, 10)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if changedSinceSent(&file) {
+			t.Fatalf("File %+v changed, want it unchanged since it was sent", file)
+		}
+	}
+
+	// A snapshot taken before the live file changed doesn't stand for it
+	if err := os.Chtimes(path, modtime, modtime.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	file := database.File{Path: path, SpoolPath: spoolpath}
+	if err := sendfile(&file, &fileReaderConfig{chunksize: 8192, required: 2, output: make(chan *structs.Chunk, 10)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !changedSinceSent(&file) {
+		t.Fatalf("File %+v unchanged, want the live file to differ from its snapshot", file)
+	}
+
+	file = database.File{Path: path}
+	if err := sendfile(&file, &fileReaderConfig{chunksize: 8192, required: 2, output: make(chan *structs.Chunk, 10)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("changed since it was sent"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !changedSinceSent(&file) {
+		t.Fatalf("File %+v unchanged, want it changed since it was sent", file)
+	}
+}
+
+// Every window of chunks is led by the hashes of its chunks, the file is read once
+func Test_sendfile_windows(t *testing.T) {
+	conf := &fileReaderConfig{chunksize: 8192, required: 2, output: make(chan *structs.Chunk, 2*hashWindow)}
+	realchunksize := (conf.chunksize - structs.ChunkOverhead) * conf.required
+	data := make([]byte, (hashWindow+1)*realchunksize)
+	for i := range data {
+		data[i] = byte(i / realchunksize)
+	}
+	path := filepath.Join(t.TempDir(), "windows")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := database.File{Path: path}
+	calls := 0
+	progress := func(sent int64, resumable int64) error {
+		calls++
+		return nil
+	}
+	if err := sendfile(&file, conf, progress); err != nil {
+		t.Fatal(err)
+	}
+	close(conf.output)
+
+	var hashes map[int64][structs.HASHSIZE]byte
+	for chunk := range conf.output {
+		switch chunk.Type {
+		case structs.PacketTypeHashList:
+			hashlist, err := structs.DecodeHashList(chunk.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hashlist.ChunkCount == 0 {
+				hashes = map[int64][structs.HASHSIZE]byte{}
+				for i, hash := range hashlist.Hashes {
+					hashes[hashlist.First+int64(i)] = hash
+				}
+			}
+		case structs.PacketTypeShare:
+			hash, ok := hashes[chunk.DataOffset/int64(realchunksize)]
+			if !ok || hash != structs.ChunkHash(chunk.Data) {
+				t.Fatalf("Chunk at offset %d isn't led by its hash", chunk.DataOffset)
+			}
+		}
+	}
+	if calls != hashWindow+1 {
+		t.Fatalf("Progress called %d times, want once per chunk", calls)
+	}
+}
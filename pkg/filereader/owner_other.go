@@ -0,0 +1,9 @@
+//go:build !unix
+
+package filereader
+
+import "io/fs"
+
+func fileOwner(info fs.FileInfo) (uid uint32, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -2,47 +2,172 @@ package filewriter
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"io/fs"
+	"oneway-filesync/pkg/database"
 	"oneway-filesync/pkg/structs"
 	"oneway-filesync/pkg/utils"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
-func pathReplace(path string) string {
-	newpath := path
-	newpath = strings.ReplaceAll(newpath, "/", "_")
-	newpath = strings.ReplaceAll(newpath, "\\", "_")
-	newpath = strings.ReplaceAll(newpath, ":", "_")
-	return newpath
+// Chunks of a transfer can arrive before its manifest does,
+// so the tempfile is named by the transfer id alone and the manifest is attached whenever it arrives
+// The lock is held while writing to the tempfile so that a transfer can't be closed mid write
+type openTransfer struct {
+	lock       sync.Mutex
+	file       structs.OpenTempFile
+	written    map[int64]int // Offsets and lengths of the chunks written so far
+	corrupt    map[int64]int // Offsets and lengths of the chunks that failed their hash
+	hashes     map[int64][structs.HASHSIZE]byte
+	chunksize  int64
+	chunkcount int64
+	root       [structs.HASHSIZE]byte
+	verified   bool                             // The hashes match their merkle root
+	ahead      map[int64][structs.HASHSIZE]byte // By offset, the hashes that led their window of chunks until verified
+	checked    map[int64]bool                   // Written chunks that passed the hash that led them
+	closed     bool
+
+	legacy *structs.LegacyFile // Set on transfers of version 1 and 2 senders, which send no manifest or trailer
 }
 
 type fileWriterConfig struct {
-	tempdir string
-	input   chan *structs.Chunk
-	output  chan *structs.OpenTempFile
-	cache   utils.RWMutexMap[string, *structs.OpenTempFile]
+	db        *gorm.DB
+	tempdir   string
+	maxage    time.Duration
+	input     chan *structs.Chunk
+	output    chan *structs.OpenTempFile
+	cache     utils.RWMutexMap[structs.TransferId, *openTransfer]
+	completed utils.RWMutexMap[structs.TransferId, time.Time]
+	partials  utils.RWMutexMap[structs.Trailer, structs.TransferId]
+}
+
+// Once every chunk listed in the trailer has been written the file can be closed right away,
+// deletes and renames have no data so they are complete as soon as their manifest arrives.
+// The transfer is remembered as completed for a while so that copies of packets
+// that are still on the way don't start a new tempfile
+// Must be called with transfer.lock held
+func closeIfComplete(conf *fileWriterConfig, transfer *openTransfer) {
+	file := transfer.file
+	if transfer.closed || file.Manifest == nil {
+		return
+	}
+	if file.Manifest.HasData() {
+		if file.Trailer == nil || int64(len(transfer.written)) < file.Trailer.ChunkCount {
+			return
+		}
+		if file.Trailer.ChunkCount == 0 {
+			// Nothing was written so there is no tempfile yet
+			if f, err := os.OpenFile(file.TempFile, os.O_RDWR|os.O_CREATE, 0600); err == nil {
+				_ = f.Close()
+			}
+		}
+	}
+	transfer.closed = true
+	file.Missing, file.Corrupt = byteRanges(transfer)
+	if file.Trailer != nil {
+		if partial, ok := conf.partials.Load(*file.Trailer); ok && partial == file.TransferId {
+			conf.partials.Delete(*file.Trailer)
+		}
+	}
+	conf.completed.Store(file.TransferId, time.Now())
+	conf.cache.Delete(file.TransferId)
+	conf.output <- &file
+}
+
+// Closes a transfer that stopped arriving with whatever it has,
+// for transfers of version 1 and 2 senders this is the only way they are closed and the trailer is made up here
+// Must be called with transfer.lock held
+func closeIdle(conf *fileWriterConfig, transfer *openTransfer) {
+	transfer.closed = true
+	if transfer.legacy != nil && transfer.file.Trailer == nil {
+		var size int64
+		for offset, length := range transfer.written {
+			if end := offset + int64(length); end > size {
+				size = end
+			}
+		}
+		trailer := transfer.legacy.Trailer(size, int64(len(transfer.written)))
+		transfer.file.Trailer = &trailer
+	}
+	file := transfer.file
+	file.Missing, file.Corrupt = byteRanges(transfer)
+	conf.cache.Delete(file.TransferId)
+	conf.output <- &file
 }
 
-// The manager acts as a "closer"
+// Transfers whose state was saved are picked up again when their next chunk arrives,
+// the ones that were complete when the receiver stopped are closed right away
+func recoverTransfers(conf *fileWriterConfig) {
+	transferids, err := savedTransfers(conf.tempdir)
+	if err != nil {
+		logrus.Errorf("Error listing saved transfers: %v", err)
+		return
+	}
+	for _, transferid := range transferids {
+		transfer := newTransfer(conf, transferid)
+		l := logrus.WithFields(logrus.Fields{
+			"TempFile":   transfer.file.TempFile,
+			"TransferId": transferid.String(),
+		})
+		if err := loadState(transfer); err != nil {
+			l.Errorf("Error loading transfer state: %v", err)
+			continue
+		}
+		transfer.lock.Lock()
+		if _, loaded := conf.cache.LoadOrStore(transferid, transfer); !loaded {
+			checkHashes(transfer, l)
+			l.Infof("Recovered transfer with %d chunks written", len(transfer.written))
+			mergePartial(conf, transfer, l)
+			closeIfComplete(conf, transfer)
+			if !transfer.closed {
+				conf.cache.Delete(transferid) // Loaded again along with its next chunk
+			}
+		}
+		transfer.lock.Unlock()
+	}
+}
+
+// How often tempfiles are checked for being abandoned
+const cleanupInterval = 10 * time.Minute
+
+// The manager acts as a "closer" for transfers whose trailer was lost
 // Since we can never really be sure all the chunks arrive
 // But 30 seconds after no more chunks arrive we can be rather certain
 // no more chunks will arrive
+// Their tempfile and state are kept for later copies to fill in until they are maxage old
 func manager(ctx context.Context, conf *fileWriterConfig) {
+	recoverTransfers(conf)
+	cleanupticker := time.NewTicker(cleanupInterval)
+	if conf.maxage <= 0 {
+		cleanupticker.Stop()
+	} else {
+		removeAbandoned(conf, conf.maxage)
+	}
 	ticker := time.NewTicker(15 * time.Second)
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-cleanupticker.C:
+			removeAbandoned(conf, conf.maxage)
 		case <-ticker.C:
-			conf.cache.Range(func(tempfilepath string, value *structs.OpenTempFile) bool {
-				if time.Since(value.LastUpdated).Seconds() > 30 {
-					conf.cache.Delete(tempfilepath)
-					conf.output <- value
+			conf.cache.Range(func(transferid structs.TransferId, value *openTransfer) bool {
+				value.lock.Lock()
+				if !value.closed && time.Since(value.file.LastUpdated).Seconds() > 30 {
+					closeIdle(conf, value)
+				}
+				value.lock.Unlock()
+				return true
+			})
+			conf.completed.Range(func(transferid structs.TransferId, completed time.Time) bool {
+				if time.Since(completed) > 5*time.Minute {
+					conf.completed.Delete(transferid)
 				}
 				return true
 			})
@@ -50,48 +175,203 @@ func manager(ctx context.Context, conf *fileWriterConfig) {
 	}
 }
 
+func handleManifest(chunk *structs.Chunk, transfer *openTransfer, l *logrus.Entry) {
+	manifest, err := structs.DecodeManifest(chunk.Data)
+	if err != nil {
+		l.Errorf("Error decoding manifest: %v", err)
+		return
+	}
+
+	if transfer.file.Manifest == nil {
+		transfer.file.Manifest = &manifest
+		l.WithField("Path", manifest.Path).Infof("Received manifest")
+		if err := appendState(transfer.file.TempFile, structs.PacketTypeManifest, chunk.Data); err != nil {
+			l.Errorf("Error saving transfer state: %v", err)
+		}
+	}
+}
+
+func handleTrailer(chunk *structs.Chunk, transfer *openTransfer, l *logrus.Entry) {
+	trailer, err := structs.DecodeTrailer(chunk.Data)
+	if err != nil {
+		l.Errorf("Error decoding trailer: %v", err)
+		return
+	}
+
+	if transfer.file.Trailer == nil {
+		transfer.file.Trailer = &trailer
+		if err := appendState(transfer.file.TempFile, structs.PacketTypeTrailer, chunk.Data); err != nil {
+			l.Errorf("Error saving transfer state: %v", err)
+		}
+	}
+}
+
+// Every share of a version 1 or 2 sender carries what the manifest would, the first one makes it up
+func handleLegacy(chunk *structs.Chunk, transfer *openTransfer, l *logrus.Entry) {
+	if transfer.legacy == nil {
+		transfer.legacy = chunk.Legacy
+	}
+	if transfer.file.Manifest == nil {
+		manifest := chunk.Legacy.Manifest()
+		transfer.file.Manifest = &manifest
+		l.WithField("Path", manifest.Path).Infof("Received share of a version 1 or 2 sender")
+		data, err := manifest.Encode()
+		if err == nil {
+			err = appendState(transfer.file.TempFile, structs.PacketTypeManifest, data)
+		}
+		if err != nil {
+			l.Errorf("Error saving transfer state: %v", err)
+		}
+	}
+}
+
+func handleShare(chunk *structs.Chunk, transfer *openTransfer, l *logrus.Entry) {
+	if !validChunk(transfer, chunk.DataOffset, chunk.Data) {
+		// A good copy that was already written is kept
+		if _, ok := transfer.written[chunk.DataOffset]; !ok {
+			length := chunkLength(transfer, chunk.DataOffset, len(chunk.Data))
+			transfer.corrupt[chunk.DataOffset] = length
+			if err := saveDropped(transfer.file.TempFile, chunk.DataOffset, length); err != nil {
+				l.Errorf("Error saving transfer state: %v", err)
+			}
+		}
+		l.Warnf("Dropped chunk at offset %d that failed its hash", chunk.DataOffset)
+		return
+	}
+
+	tempfile, err := os.OpenFile(transfer.file.TempFile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		l.Errorf("Error creating tempfile for chunk: %v", err)
+		return
+	}
+
+	_, err = tempfile.WriteAt(chunk.Data, chunk.DataOffset)
+	_ = tempfile.Close() // Not using defer because of overhead concerns, ignoring error on purpose
+	if err != nil {
+		l.Errorf("Error writing to tempfile: %v", err)
+		return
+	}
+	if _, ok := transfer.ahead[chunk.DataOffset]; ok && !transfer.verified {
+		transfer.checked[chunk.DataOffset] = true
+	}
+	if _, ok := transfer.written[chunk.DataOffset]; ok {
+		return
+	}
+	delete(transfer.corrupt, chunk.DataOffset)
+	transfer.written[chunk.DataOffset] = len(chunk.Data)
+	if err := saveChunk(transfer.file.TempFile, chunk.DataOffset, len(chunk.Data)); err != nil {
+		l.Errorf("Error saving transfer state: %v", err)
+	}
+}
+
+func newTransfer(conf *fileWriterConfig, transferid structs.TransferId) *openTransfer {
+	tempfile := filepath.Join(conf.tempdir, transferid.String()+tempSuffix)
+	return &openTransfer{
+		file: structs.OpenTempFile{
+			TransferId:  transferid,
+			TempFile:    tempfile,
+			StateFile:   stateFile(tempfile),
+			LastUpdated: time.Now(),
+		},
+		written: make(map[int64]int),
+		corrupt: make(map[int64]int),
+		hashes:  make(map[int64][structs.HASHSIZE]byte),
+		ahead:   make(map[int64][structs.HASHSIZE]byte),
+		checked: make(map[int64]bool),
+	}
+}
+
+// Files may be sent several times, copies of a transfer that was already received are ignored
+// while copies of a transfer that wasn't are merged into its tempfile and fill in what the earlier copies lost
+func alreadyReceived(conf *fileWriterConfig, transferid structs.TransferId) bool {
+	if conf.db == nil {
+		return false
+	}
+	received, err := database.TransferReceived(conf.db, transferid[:])
+	if err != nil {
+		logrus.WithField("TransferId", transferid.String()).Errorf("Error looking up transfer in database: %v", err)
+		return false
+	}
+	return received
+}
+
 func worker(ctx context.Context, conf *fileWriterConfig) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case chunk := <-conf.input:
-			tempfilepath := filepath.Join(conf.tempdir, fmt.Sprintf("%s___%x.tmp", pathReplace(chunk.Path), chunk.Hash))
-			l := logrus.WithFields(logrus.Fields{
-				"TempFile": tempfilepath,
-				"Path":     chunk.Path,
-				"Hash":     fmt.Sprintf("%x", chunk.Hash),
-			})
-			tempfile, err := os.OpenFile(tempfilepath, os.O_RDWR|os.O_CREATE, 0600)
-			if err != nil {
-				l.Errorf("Error creating tempfile for chunk: %v", err)
+			if _, ok := conf.completed.Load(chunk.TransferId); ok {
 				continue
 			}
-
-			_, err = tempfile.WriteAt(chunk.Data, chunk.DataOffset)
-			_ = tempfile.Close() // Not using defer because of overhead concerns, ignoring error on purpose
-			if err != nil {
-				l.Errorf("Error writing to tempfile: %v", err)
+			// Version 1 and 2 senders give every send of the same file the same transfer id, sending it again writes it again
+			if _, ok := conf.cache.Load(chunk.TransferId); !ok && chunk.Legacy == nil && alreadyReceived(conf, chunk.TransferId) {
+				conf.completed.Store(chunk.TransferId, time.Now())
 				continue
 			}
 
-			conf.cache.Store(tempfilepath, &structs.OpenTempFile{
-				TempFile:    tempfilepath,
-				Path:        chunk.Path,
-				Hash:        chunk.Hash,
-				Encrypted:   chunk.Encrypted,
-				LastUpdated: time.Now(),
+			// A new entry is locked until its saved state, if any, is loaded
+			transfer := newTransfer(conf, chunk.TransferId)
+			transfer.lock.Lock()
+			actual, loaded := conf.cache.LoadOrStore(chunk.TransferId, transfer)
+			l := logrus.WithFields(logrus.Fields{
+				"TempFile":   transfer.file.TempFile,
+				"TransferId": chunk.TransferId.String(),
 			})
+			if loaded {
+				transfer.lock.Unlock()
+				transfer = actual
+				transfer.lock.Lock()
+			} else if err := loadState(transfer); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				l.Errorf("Error loading transfer state: %v", err)
+			} else {
+				checkHashes(transfer, l)
+			}
+
+			if _, ok := conf.completed.Load(chunk.TransferId); ok && !transfer.closed {
+				// Raced with the transfer completing, this is a new entry that has to go
+				transfer.closed = true
+				conf.cache.Delete(chunk.TransferId)
+			}
+			if transfer.closed {
+				transfer.lock.Unlock()
+				continue
+			}
+			switch chunk.Type {
+			case structs.PacketTypeManifest:
+				handleManifest(chunk, transfer, l)
+			case structs.PacketTypeTrailer:
+				if transfer.file.Trailer == nil {
+					handleTrailer(chunk, transfer, l)
+					checkHashes(transfer, l)
+					mergePartial(conf, transfer, l)
+				}
+			case structs.PacketTypeHashList:
+				handleHashList(chunk, transfer, l)
+			case structs.PacketTypeShare:
+				if chunk.Legacy != nil {
+					handleLegacy(chunk, transfer, l)
+				}
+				handleShare(chunk, transfer, l)
+			}
+			transfer.file.LastUpdated = time.Now()
+			closeIfComplete(conf, transfer)
+			transfer.lock.Unlock()
 		}
 	}
 }
 
-func CreateFileWriter(ctx context.Context, tempdir string, input chan *structs.Chunk, output chan *structs.OpenTempFile, workercount int) {
+// Tempfiles of transfers that didn't complete are removed once they weren't written to for maxage, zero keeps them
+func CreateFileWriter(ctx context.Context, db *gorm.DB, tempdir string, maxage time.Duration, input chan *structs.Chunk, output chan *structs.OpenTempFile, workercount int) {
 	conf := fileWriterConfig{
-		tempdir: tempdir,
-		input:   input,
-		output:  output,
-		cache:   utils.RWMutexMap[string, *structs.OpenTempFile]{},
+		db:        db,
+		tempdir:   tempdir,
+		maxage:    maxage,
+		input:     input,
+		output:    output,
+		cache:     utils.RWMutexMap[structs.TransferId, *openTransfer]{},
+		completed: utils.RWMutexMap[structs.TransferId, time.Time]{},
+		partials:  utils.RWMutexMap[structs.Trailer, structs.TransferId]{},
 	}
 	for i := 0; i < workercount; i++ {
 		go worker(ctx, &conf)
@@ -0,0 +1,271 @@
+package filewriter
+
+import (
+	"bytes"
+	"context"
+	"oneway-filesync/pkg/database"
+	"oneway-filesync/pkg/structs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+func encoded(t *testing.T, enc func() ([]byte, error)) []byte {
+	data, err := enc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func Test_worker(t *testing.T) {
+	transferid := structs.NewTransferId()
+	manifest := &structs.Chunk{Type: structs.PacketTypeManifest, TransferId: transferid, Data: encoded(t, structs.Manifest{Path: "a"}.Encode)}
+	share1 := &structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, DataOffset: 0, Data: []byte{1, 2}}
+	share2 := &structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, DataOffset: 2, Data: []byte{3, 4}}
+	trailer := func(count int64) *structs.Chunk {
+		return &structs.Chunk{Type: structs.PacketTypeTrailer, TransferId: transferid, Data: encoded(t, structs.Trailer{Size: 2 * count, ChunkCount: count}.Encode)}
+	}
+
+	tests := []struct {
+		name     string
+		input    []*structs.Chunk
+		wantData []byte
+		wantDone bool
+	}{
+		{"test-complete", []*structs.Chunk{manifest, share1, share2, trailer(2)}, []byte{1, 2, 3, 4}, true},
+		{"test-trailer-first", []*structs.Chunk{trailer(2), share2, manifest, share1}, []byte{1, 2, 3, 4}, true},
+		{"test-late-share", []*structs.Chunk{manifest, share1, trailer(1), share2}, []byte{1, 2}, true},
+		{"test-empty-file", []*structs.Chunk{manifest, trailer(0)}, []byte{}, true},
+		{"test-missing-share", []*structs.Chunk{manifest, share1, trailer(2)}, nil, false},
+		{"test-missing-manifest", []*structs.Chunk{share1, share2, trailer(2)}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := make(chan *structs.Chunk, 10)
+			output := make(chan *structs.OpenTempFile, 10)
+			conf := fileWriterConfig{tempdir: t.TempDir(), input: input, output: output}
+			for _, chunk := range tt.input {
+				input <- chunk
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(2 * time.Second)
+				cancel()
+			}()
+			worker(ctx, &conf)
+
+			if !tt.wantDone {
+				if len(output) != 0 {
+					t.Fatalf("Incomplete transfer was closed")
+				}
+				return
+			}
+			if len(output) != 1 {
+				t.Fatalf("Expected exactly one closed transfer, got %d", len(output))
+			}
+			file := <-output
+			data, err := os.ReadFile(file.TempFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(tt.wantData) {
+				t.Fatalf("Tempfile contains %v, want %v", data, tt.wantData)
+			}
+		})
+	}
+}
+
+func Test_worker_already_received(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AutoMigrate(&database.File{}); err != nil {
+		t.Fatal(err)
+	}
+	received := structs.NewTransferId()
+	failed := structs.NewTransferId()
+	if err := db.Create(&database.File{TransferId: received[:], Success: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&database.File{TransferId: failed[:], Success: false}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	input := make(chan *structs.Chunk, 10)
+	output := make(chan *structs.OpenTempFile, 10)
+	conf := fileWriterConfig{db: db, tempdir: t.TempDir(), input: input, output: output}
+	for _, transferid := range []structs.TransferId{received, failed} {
+		input <- &structs.Chunk{Type: structs.PacketTypeManifest, TransferId: transferid, Data: encoded(t, structs.Manifest{Path: "a"}.Encode)}
+		input <- &structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, Data: []byte{1, 2}}
+		input <- &structs.Chunk{Type: structs.PacketTypeTrailer, TransferId: transferid, Data: encoded(t, structs.Trailer{Size: 2, ChunkCount: 1}.Encode)}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(2 * time.Second)
+		cancel()
+	}()
+	worker(ctx, &conf)
+
+	// The copy of the received transfer is ignored while the failed one is received again
+	if len(output) != 1 {
+		t.Fatalf("Expected exactly one closed transfer, got %d", len(output))
+	}
+	if file := <-output; file.TransferId != failed {
+		t.Fatalf("Closed transfer %v, want %v", file.TransferId, failed)
+	}
+	if _, err := os.Stat(filepath.Join(conf.tempdir, received.String()+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("Copy of a received transfer created a tempfile")
+	}
+}
+
+func Test_worker_op(t *testing.T) {
+	transferid := structs.NewTransferId()
+	input := make(chan *structs.Chunk, 10)
+	output := make(chan *structs.OpenTempFile, 10)
+	conf := fileWriterConfig{tempdir: t.TempDir(), input: input, output: output}
+	// Ops have no data or trailer, every copy of the manifest after the first is ignored
+	manifest := structs.Manifest{Path: "a", Op: structs.OpRename, Target: "b"}
+	for i := 0; i < 2; i++ {
+		input <- &structs.Chunk{Type: structs.PacketTypeManifest, TransferId: transferid, DataOffset: int64(i), Data: encoded(t, manifest.Encode)}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(2 * time.Second)
+		cancel()
+	}()
+	worker(ctx, &conf)
+
+	if len(output) != 1 {
+		t.Fatalf("Expected exactly one closed transfer, got %d", len(output))
+	}
+	if file := <-output; file.Manifest == nil || *file.Manifest != manifest {
+		t.Fatalf("Closed transfer with manifest %v, want %v", file.Manifest, manifest)
+	}
+}
+
+func Test_worker_tempfile_names(t *testing.T) {
+	deep := strings.Repeat("/"+strings.Repeat("d", 255), 15)
+	paths := []string{"a/b_c", "a_b/c", "a\\b_c", deep}
+	input := make(chan *structs.Chunk, 10*len(paths))
+	output := make(chan *structs.OpenTempFile, len(paths))
+	conf := fileWriterConfig{tempdir: t.TempDir(), input: input, output: output}
+	for i, path := range paths {
+		transferid := structs.NewTransferId()
+		input <- &structs.Chunk{Type: structs.PacketTypeManifest, TransferId: transferid, Data: encoded(t, structs.Manifest{Path: path}.Encode)}
+		input <- &structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, Data: []byte{byte(i)}}
+		input <- &structs.Chunk{Type: structs.PacketTypeTrailer, TransferId: transferid, Data: encoded(t, structs.Trailer{Size: 1, ChunkCount: 1}.Encode)}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(2 * time.Second)
+		cancel()
+	}()
+	worker(ctx, &conf)
+
+	// Tempfiles are named by the transfer id alone, whatever the path they are for
+	if len(output) != len(paths) {
+		t.Fatalf("Expected %d closed transfers, got %d", len(paths), len(output))
+	}
+	tempfiles := map[string]bool{}
+	for i := range paths {
+		file := <-output
+		name := filepath.Base(file.TempFile)
+		if name != file.TransferId.String()+tempSuffix || tempfiles[name] {
+			t.Fatalf("Tempfile '%s' of transfer %v is not named by its transfer id alone", name, file.TransferId)
+		}
+		tempfiles[name] = true
+		if file.Manifest == nil || file.Manifest.Path != paths[i] {
+			t.Fatalf("Closed transfer with manifest %v, want path '%s'", file.Manifest, paths[i])
+		}
+		data, err := os.ReadFile(file.TempFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte{byte(i)}) {
+			t.Fatalf("Tempfile for '%s' contains %v, want %v", paths[i], data, []byte{byte(i)})
+		}
+
+		// The path is kept in the state rather than in the name
+		restored := newTransfer(&conf, file.TransferId)
+		if err := loadState(restored); err != nil {
+			t.Fatal(err)
+		}
+		if restored.file.Manifest == nil || restored.file.Manifest.Path != paths[i] {
+			t.Fatalf("Restored manifest %v, want path '%s'", restored.file.Manifest, paths[i])
+		}
+	}
+}
+
+func Test_worker_legacy(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AutoMigrate(&database.File{}); err != nil {
+		t.Fatal(err)
+	}
+	legacy := &structs.LegacyFile{Path: "a", Hash: [structs.HASHSIZE]byte{1}}
+	transferid := legacy.TransferId()
+	// An earlier send of the same file doesn't keep it from being written again
+	if err := db.Create(&database.File{TransferId: transferid[:], Success: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	input := make(chan *structs.Chunk, 10)
+	output := make(chan *structs.OpenTempFile, 10)
+	conf := fileWriterConfig{db: db, tempdir: t.TempDir(), input: input, output: output}
+	input <- &structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, DataOffset: 2, Data: []byte{3, 4}, Legacy: legacy}
+	input <- &structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, DataOffset: 0, Data: []byte{1, 2}, Legacy: legacy}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(2 * time.Second)
+		cancel()
+	}()
+	worker(ctx, &conf)
+
+	// Without a trailer the transfer is only closed once it stops arriving
+	if len(output) != 0 {
+		t.Fatalf("Transfer of a version 2 sender was closed before it went idle")
+	}
+	transfer, ok := conf.cache.Load(transferid)
+	if !ok {
+		t.Fatalf("Transfer of a version 2 sender isn't open")
+	}
+	if transfer.file.Manifest == nil || *transfer.file.Manifest != legacy.Manifest() {
+		t.Fatalf("Made up manifest %v, want %v", transfer.file.Manifest, legacy.Manifest())
+	}
+	transfer.lock.Lock()
+	closeIdle(&conf, transfer)
+	transfer.lock.Unlock()
+
+	if len(output) != 1 {
+		t.Fatalf("Expected exactly one closed transfer, got %d", len(output))
+	}
+	file := <-output
+	if want := legacy.Trailer(4, 2); file.Trailer == nil || *file.Trailer != want {
+		t.Fatalf("Made up trailer %v, want %v", file.Trailer, want)
+	}
+	if len(file.Missing) != 0 {
+		t.Fatalf("Missing %v of a complete transfer", file.Missing)
+	}
+	data, err := os.ReadFile(file.TempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{1, 2, 3, 4}) {
+		t.Fatalf("Tempfile contains %v, want %v", data, []byte{1, 2, 3, 4})
+	}
+}
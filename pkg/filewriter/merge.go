@@ -0,0 +1,123 @@
+package filewriter
+
+import (
+	"fmt"
+	"oneway-filesync/pkg/structs"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Sending a file again, such as with sendfiles after it failed, starts a new transfer
+// Transfers of the same content have the same trailer so the chunks a failed transfer did receive
+// are merged into the new one, together they can make up the whole file even if neither got all of it
+// The merged transfer takes over and the failed one is removed, it adopts the chunk hashes of the failed one
+// if its own didn't arrive and only takes the chunks that pass them
+// Must be called with transfer.lock held
+func mergePartial(conf *fileWriterConfig, transfer *openTransfer, l *logrus.Entry) {
+	if transfer.file.Trailer == nil {
+		return
+	}
+	trailer := *transfer.file.Trailer
+	previous, ok := conf.partials.Load(trailer)
+	conf.partials.Store(trailer, transfer.file.TransferId)
+	if !ok || previous == transfer.file.TransferId {
+		return
+	}
+	if _, open := conf.cache.Load(previous); open {
+		return // Both are still being received, whichever fails is merged into the next one
+	}
+
+	partial := newTransfer(conf, previous)
+	if err := loadState(partial); err != nil {
+		return // Received successfully or cleaned up since
+	}
+	if partial.file.Trailer == nil || *partial.file.Trailer != trailer {
+		return
+	}
+	l = l.WithField("MergedTransferId", previous.String())
+	checkHashes(partial, l)
+	if partial.verified && !transfer.verified {
+		if err := adoptHashes(transfer, partial); err != nil {
+			l.Errorf("Error saving transfer state: %v", err)
+		}
+		checkHashes(transfer, l)
+	}
+	merged, err := mergeChunks(transfer, partial)
+	if err != nil {
+		l.Errorf("Error merging earlier transfer of the same file: %v", err)
+		return
+	}
+	if transfer.file.Manifest == nil && partial.file.Manifest != nil {
+		manifestdata, err := partial.file.Manifest.Encode()
+		if err == nil {
+			err = appendState(transfer.file.TempFile, structs.PacketTypeManifest, manifestdata)
+		}
+		if err != nil {
+			l.Errorf("Error saving transfer state: %v", err)
+		}
+		transfer.file.Manifest = partial.file.Manifest
+	}
+
+	_ = os.Remove(partial.file.StateFile) // Ignoring error on purpose, it is cleaned up once abandoned
+	_ = os.Remove(partial.file.TempFile)
+	l.Infof("Merged %d chunks from an earlier transfer of the same file", merged)
+}
+
+func mergeChunks(transfer *openTransfer, partial *openTransfer) (int, error) {
+	src, err := os.Open(partial.file.TempFile)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(transfer.file.TempFile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	merged := 0
+	for offset, length := range partial.written {
+		if _, ok := transfer.written[offset]; ok {
+			continue
+		}
+		data := make([]byte, length)
+		if _, err := src.ReadAt(data, offset); err != nil {
+			return merged, fmt.Errorf("error reading chunk at offset %d: %v", offset, err)
+		}
+		if !validChunk(transfer, offset, data) {
+			continue
+		}
+		if _, err := dst.WriteAt(data, offset); err != nil {
+			return merged, fmt.Errorf("error writing chunk at offset %d: %v", offset, err)
+		}
+		delete(transfer.corrupt, offset)
+		transfer.written[offset] = length
+		if err := saveChunk(transfer.file.TempFile, offset, length); err != nil {
+			return merged, err
+		}
+		merged++
+	}
+	return merged, nil
+}
+
+func adoptHashes(transfer *openTransfer, partial *openTransfer) error {
+	hashlist := structs.HashList{
+		ChunkSize:  partial.chunksize,
+		ChunkCount: partial.chunkcount,
+		MerkleRoot: partial.root,
+		Hashes:     make([][structs.HASHSIZE]byte, partial.chunkcount),
+	}
+	for i := range hashlist.Hashes {
+		hashlist.Hashes[i] = partial.hashes[int64(i)]
+	}
+	resetHashes(transfer)
+	if _, err := addHashes(transfer, hashlist); err != nil {
+		return err
+	}
+	data, err := hashlist.Encode()
+	if err != nil {
+		return err
+	}
+	return appendState(transfer.file.TempFile, structs.PacketTypeHashList, data)
+}
@@ -0,0 +1,128 @@
+package filewriter
+
+import (
+	"context"
+	"oneway-filesync/pkg/structs"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_worker_merge(t *testing.T) {
+	trailer := structs.Trailer{Size: 4, ChunkCount: 2, Hash: [structs.HASHSIZE]byte{1}}
+	chunks := func(transferid structs.TransferId, offset int64, data []byte, trailer structs.Trailer) []*structs.Chunk {
+		return []*structs.Chunk{
+			{Type: structs.PacketTypeManifest, TransferId: transferid, Data: encoded(t, structs.Manifest{Path: "a"}.Encode)},
+			{Type: structs.PacketTypeShare, TransferId: transferid, DataOffset: offset, Data: data},
+			{Type: structs.PacketTypeTrailer, TransferId: transferid, Data: encoded(t, trailer.Encode)},
+		}
+	}
+	othercontent := trailer
+	othercontent.Hash[0] = 2
+
+	tests := []struct {
+		name      string
+		second    structs.Trailer
+		wantDone  bool
+		wantMerge bool
+	}{
+		{"test-same-content", trailer, true, true},
+		{"test-other-content", othercontent, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := make(chan *structs.Chunk, 10)
+			output := make(chan *structs.OpenTempFile, 10)
+			conf := fileWriterConfig{tempdir: t.TempDir(), input: input, output: output}
+			run := func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				go func() {
+					time.Sleep(time.Second)
+					cancel()
+				}()
+				worker(ctx, &conf)
+			}
+
+			// The first transfer loses its second chunk and is given up on
+			first := structs.NewTransferId()
+			for _, chunk := range chunks(first, 0, []byte{1, 2}, trailer) {
+				input <- chunk
+			}
+			run()
+			firsttransfer, _ := conf.cache.LoadAndDelete(first)
+
+			// The second loses its first chunk
+			second := structs.NewTransferId()
+			for _, chunk := range chunks(second, 2, []byte{3, 4}, tt.second) {
+				input <- chunk
+			}
+			run()
+
+			if !tt.wantDone {
+				if len(output) != 0 {
+					t.Fatalf("Incomplete transfer was closed")
+				}
+			} else {
+				if len(output) != 1 {
+					t.Fatalf("Expected exactly one closed transfer, got %d", len(output))
+				}
+				file := <-output
+				data, err := os.ReadFile(file.TempFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if file.TransferId != second || string(data) != string([]byte{1, 2, 3, 4}) {
+					t.Fatalf("Closed %v with %v, want the second transfer with the chunks of both", file.TransferId, data)
+				}
+			}
+			if _, err := os.Stat(firsttransfer.file.StateFile); os.IsNotExist(err) != tt.wantMerge {
+				t.Fatalf("State of the first transfer removed = %v, want %v", os.IsNotExist(err), tt.wantMerge)
+			}
+		})
+	}
+}
+
+func Test_recoverTransfers_merge(t *testing.T) {
+	tempdir := t.TempDir()
+	trailer := encoded(t, structs.Trailer{Size: 4, ChunkCount: 2}.Encode)
+	// Only one of them got the manifest
+	for i, data := range [][]byte{{1, 2}, {3, 4}} {
+		offset := int64(2 * i)
+		transfer := newTransfer(&fileWriterConfig{tempdir: tempdir}, structs.NewTransferId())
+		f, err := os.OpenFile(transfer.file.TempFile, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if err := appendState(transfer.file.TempFile, structs.PacketTypeTrailer, trailer); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveChunk(transfer.file.TempFile, offset, len(data)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err := appendState(transfer.file.TempFile, structs.PacketTypeManifest, encoded(t, structs.Manifest{Path: "a"}.Encode)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	output := make(chan *structs.OpenTempFile, 10)
+	conf := fileWriterConfig{tempdir: tempdir, output: output}
+	recoverTransfers(&conf)
+
+	if len(output) != 1 {
+		t.Fatalf("Expected exactly one closed transfer, got %d", len(output))
+	}
+	file := <-output
+	data, err := os.ReadFile(file.TempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string([]byte{1, 2, 3, 4}) || file.Manifest == nil {
+		t.Fatalf("Closed %+v with %v, want the chunks and the manifest of both", file, data)
+	}
+}
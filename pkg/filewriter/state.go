@@ -0,0 +1,184 @@
+package filewriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"oneway-filesync/pkg/structs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The state of a transfer is kept in a sidecar file next to its tempfile so it survives receiver restarts
+// Records are appended as the manifest, the trailer, the hash lists and each chunk are written: type, data length and data
+// Chunks that failed their hash get a record of their own which undoes the record of their writing
+// The tempfile isn't synced so after a power loss a chunk may be listed without its data, the hash check then fails
+// and the transfer is left for a later copy to fill in
+const (
+	tempSuffix  = ".tmp"
+	stateSuffix = ".state"
+
+	recordDropped structs.PacketType = 0x80
+)
+
+func stateFile(tempfile string) string {
+	return strings.TrimSuffix(tempfile, tempSuffix) + stateSuffix
+}
+
+func appendState(tempfile string, recordtype structs.PacketType, data []byte) error {
+	record := make([]byte, 1+4+len(data))
+	record[0] = byte(recordtype)
+	binary.BigEndian.PutUint32(record[1:], uint32(len(data)))
+	copy(record[5:], data)
+
+	f, err := os.OpenFile(stateFile(tempfile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(record)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func saveChunk(tempfile string, offset int64, length int) error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint64(data, uint64(offset))
+	binary.BigEndian.PutUint32(data[8:], uint32(length))
+	return appendState(tempfile, structs.PacketTypeShare, data)
+}
+
+func saveDropped(tempfile string, offset int64, length int) error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint64(data, uint64(offset))
+	binary.BigEndian.PutUint32(data[8:], uint32(length))
+	return appendState(tempfile, recordDropped, data)
+}
+
+// A record cut short by a crash ends the state, whatever it described is received again
+func loadState(transfer *openTransfer) error {
+	data, err := os.ReadFile(stateFile(transfer.file.TempFile))
+	if err != nil {
+		return err
+	}
+	buffer := bytes.NewBuffer(data)
+	for buffer.Len() >= 5 {
+		recordtype := structs.PacketType(buffer.Next(1)[0])
+		length := int(binary.BigEndian.Uint32(buffer.Next(4)))
+		if length > buffer.Len() {
+			break
+		}
+		record := buffer.Next(length)
+		switch recordtype {
+		case structs.PacketTypeManifest:
+			manifest, err := structs.DecodeManifest(record)
+			if err != nil {
+				return fmt.Errorf("error decoding manifest: %v", err)
+			}
+			transfer.file.Manifest = &manifest
+		case structs.PacketTypeTrailer:
+			trailer, err := structs.DecodeTrailer(record)
+			if err != nil {
+				return fmt.Errorf("error decoding trailer: %v", err)
+			}
+			transfer.file.Trailer = &trailer
+		case structs.PacketTypeHashList:
+			hashlist, err := structs.DecodeHashList(record)
+			if err != nil {
+				return fmt.Errorf("error decoding hash list: %v", err)
+			}
+			if _, err := addHashes(transfer, hashlist); err != nil {
+				return err
+			}
+		case structs.PacketTypeShare, recordDropped:
+			if length != 12 {
+				return fmt.Errorf("bad chunk record of %d bytes", length)
+			}
+			offset := int64(binary.BigEndian.Uint64(record))
+			if recordtype == recordDropped {
+				delete(transfer.written, offset)
+				transfer.corrupt[offset] = int(binary.BigEndian.Uint32(record[8:]))
+			} else {
+				delete(transfer.corrupt, offset)
+				transfer.written[offset] = int(binary.BigEndian.Uint32(record[8:]))
+			}
+		default:
+			return fmt.Errorf("unknown record type %d", recordtype)
+		}
+	}
+	// Chunks listed without a tempfile are gone, manual cleanup for example
+	if len(transfer.written) > 0 {
+		if _, err := os.Stat(transfer.file.TempFile); err != nil {
+			transfer.written = make(map[int64]int)
+		}
+	}
+	return nil
+}
+
+// The sidecar is named by the transfer id like the tempfile
+func transferIdOf(name string) (structs.TransferId, bool) {
+	var transferid structs.TransferId
+	if !strings.HasSuffix(name, stateSuffix) {
+		return transferid, false
+	}
+	decoded, err := hex.DecodeString(strings.TrimSuffix(name, stateSuffix))
+	if err != nil || len(decoded) != len(transferid) {
+		return transferid, false
+	}
+	copy(transferid[:], decoded)
+	return transferid, true
+}
+
+// Lists the transfers that have a saved state
+func savedTransfers(tempdir string) ([]structs.TransferId, error) {
+	entries, err := os.ReadDir(tempdir)
+	if err != nil {
+		return nil, err
+	}
+	var transfers []structs.TransferId
+	for _, entry := range entries {
+		if transferid, ok := transferIdOf(entry.Name()); ok {
+			transfers = append(transfers, transferid)
+		}
+	}
+	return transfers, nil
+}
+
+// Removes tempfiles and states that weren't changed for maxage, except those of open transfers
+func removeAbandoned(conf *fileWriterConfig, maxage time.Duration) {
+	entries, err := os.ReadDir(conf.tempdir)
+	if err != nil {
+		logrus.Errorf("Error listing tempfiles: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		stem := strings.TrimSuffix(strings.TrimSuffix(name, tempSuffix), stateSuffix)
+		if stem == name {
+			continue
+		}
+		if transferid, ok := transferIdOf(stem + stateSuffix); ok {
+			if _, open := conf.cache.Load(transferid); open {
+				continue
+			}
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < maxage {
+			continue
+		}
+		path := filepath.Join(conf.tempdir, name)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logrus.Errorf("Error removing abandoned tempfile: %v", err)
+		} else {
+			logrus.WithField("TempFile", path).Infof("Removed abandoned tempfile")
+		}
+	}
+}
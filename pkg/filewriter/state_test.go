@@ -0,0 +1,150 @@
+package filewriter
+
+import (
+	"context"
+	"oneway-filesync/pkg/structs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_worker_restart(t *testing.T) {
+	transferid := structs.NewTransferId()
+	manifest := &structs.Chunk{Type: structs.PacketTypeManifest, TransferId: transferid, Data: encoded(t, structs.Manifest{Path: "a"}.Encode)}
+	share1 := &structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, DataOffset: 0, Data: []byte{1, 2}}
+	share2 := &structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, DataOffset: 2, Data: []byte{3, 4}}
+	trailer := &structs.Chunk{Type: structs.PacketTypeTrailer, TransferId: transferid, Data: encoded(t, structs.Trailer{Size: 4, ChunkCount: 2}.Encode)}
+	tempdir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		input    []*structs.Chunk
+		wantDone bool
+	}{
+		{"test-before-restart", []*structs.Chunk{manifest, share1}, false},
+		{"test-after-restart", []*structs.Chunk{share2, trailer}, true},
+	}
+	// Each run starts from empty caches like a restarted receiver
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := make(chan *structs.Chunk, 10)
+			output := make(chan *structs.OpenTempFile, 10)
+			conf := fileWriterConfig{tempdir: tempdir, input: input, output: output}
+			for _, chunk := range tt.input {
+				input <- chunk
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(2 * time.Second)
+				cancel()
+			}()
+			worker(ctx, &conf)
+
+			if !tt.wantDone {
+				if len(output) != 0 {
+					t.Fatalf("Incomplete transfer was closed")
+				}
+				return
+			}
+			if len(output) != 1 {
+				t.Fatalf("Expected exactly one closed transfer, got %d", len(output))
+			}
+			file := <-output
+			data, err := os.ReadFile(file.TempFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string([]byte{1, 2, 3, 4}) || file.Manifest == nil || file.Manifest.Path != "a" {
+				t.Fatalf("Closed %+v with %v, want the manifest and data from before the restart", file, data)
+			}
+		})
+	}
+}
+
+func Test_recoverTransfers(t *testing.T) {
+	tempdir := t.TempDir()
+	save := func(transferid structs.TransferId, chunkcount int64, offsets ...int64) {
+		tempfile := filepath.Join(tempdir, transferid.String()+tempSuffix)
+		if err := os.WriteFile(tempfile, []byte{1, 2}, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := appendState(tempfile, structs.PacketTypeManifest, encoded(t, structs.Manifest{Path: "a"}.Encode)); err != nil {
+			t.Fatal(err)
+		}
+		if err := appendState(tempfile, structs.PacketTypeTrailer, encoded(t, structs.Trailer{Size: 2 * chunkcount, ChunkCount: chunkcount}.Encode)); err != nil {
+			t.Fatal(err)
+		}
+		for _, offset := range offsets {
+			if err := saveChunk(tempfile, offset, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	complete := structs.NewTransferId()
+	save(complete, 1, 0)
+	incomplete := structs.NewTransferId()
+	save(incomplete, 2, 0)
+	truncated := structs.NewTransferId()
+	save(truncated, 1)
+	// A record cut short by a crash doesn't count
+	f, err := os.OpenFile(filepath.Join(tempdir, truncated.String()+stateSuffix), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{byte(structs.PacketTypeShare), 0, 0, 0, 8, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	output := make(chan *structs.OpenTempFile, 10)
+	conf := fileWriterConfig{tempdir: tempdir, output: output}
+	recoverTransfers(&conf)
+
+	if len(output) != 1 {
+		t.Fatalf("Expected exactly one closed transfer, got %d", len(output))
+	}
+	if file := <-output; file.TransferId != complete || file.StateFile == "" {
+		t.Fatalf("Closed %+v, want the complete transfer", file)
+	}
+	for _, transferid := range []structs.TransferId{incomplete, truncated} {
+		if _, ok := conf.cache.Load(transferid); ok {
+			t.Errorf("Incomplete transfer %v stayed open", transferid)
+		}
+	}
+}
+
+func Test_removeAbandoned(t *testing.T) {
+	tempdir := t.TempDir()
+	conf := fileWriterConfig{tempdir: tempdir}
+	create := func(name string, age time.Duration) string {
+		path := filepath.Join(tempdir, name)
+		if err := os.WriteFile(path, []byte{1}, 0600); err != nil {
+			t.Fatal(err)
+		}
+		modtime := time.Now().Add(-age)
+		if err := os.Chtimes(path, modtime, modtime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	old, recent, open := structs.NewTransferId(), structs.NewTransferId(), structs.NewTransferId()
+	conf.cache.Store(open, newTransfer(&conf, open))
+	want := map[string]bool{
+		create(old.String()+tempSuffix, 2*time.Hour):     false,
+		create(old.String()+stateSuffix, 2*time.Hour):    false,
+		create(recent.String()+tempSuffix, time.Minute):  true,
+		create(recent.String()+stateSuffix, time.Minute): true,
+		create(open.String()+tempSuffix, 2*time.Hour):    true,
+		create("unrelated", 2*time.Hour):                 true,
+	}
+
+	removeAbandoned(&conf, time.Hour)
+
+	for path, exists := range want {
+		if _, err := os.Stat(path); (err == nil) != exists {
+			t.Errorf("'%s' exists = %v, want %v", filepath.Base(path), err == nil, exists)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package filewriter
+
+import (
+	"fmt"
+	"oneway-filesync/pkg/structs"
+	"os"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The sender leads every window of chunks with their hashes and sends the full list after the data,
+// the chunks are checked against the hashes that led them as they arrive and those that fail aren't written
+// The full list is only trusted once all of it arrived and it matches the merkle root it carries, from then on
+// it checks every chunk. Chunks written before it was trusted that didn't pass the same hash ahead of the data,
+// such as when their window's hashes were lost, are read back and checked
+// and those that fail are dropped so a later copy of the transfer can replace them
+
+// Returns whether any hash was new
+func addHashes(transfer *openTransfer, hashlist structs.HashList) (bool, error) {
+	if transfer.chunksize != 0 && (transfer.chunksize != hashlist.ChunkSize || transfer.chunkcount != hashlist.ChunkCount || transfer.root != hashlist.MerkleRoot) {
+		return false, fmt.Errorf("hash list for %d chunks of %d bytes with merkle root %x doesn't match earlier ones for %d chunks of %d bytes with merkle root %x",
+			hashlist.ChunkCount, hashlist.ChunkSize, hashlist.MerkleRoot, transfer.chunkcount, transfer.chunksize, transfer.root)
+	}
+	transfer.chunksize = hashlist.ChunkSize
+	transfer.chunkcount = hashlist.ChunkCount
+	transfer.root = hashlist.MerkleRoot
+	added := false
+	for i, hash := range hashlist.Hashes {
+		index := hashlist.First + int64(i)
+		if _, ok := transfer.hashes[index]; !ok {
+			transfer.hashes[index] = hash
+			added = true
+		}
+	}
+	return added, nil
+}
+
+func handleHashList(chunk *structs.Chunk, transfer *openTransfer, l *logrus.Entry) {
+	if transfer.verified {
+		return
+	}
+	hashlist, err := structs.DecodeHashList(chunk.Data)
+	if err != nil {
+		l.Errorf("Error decoding hash list: %v", err)
+		return
+	}
+	if hashlist.ChunkCount == 0 {
+		// Leads a window of chunks, it only matters until they arrive so it isn't saved
+		for i, hash := range hashlist.Hashes {
+			transfer.ahead[(hashlist.First+int64(i))*hashlist.ChunkSize] = hash
+		}
+		return
+	}
+	added, err := addHashes(transfer, hashlist)
+	if err != nil {
+		l.Errorf("Error adding hash list: %v", err)
+		return
+	}
+	if added {
+		if err := appendState(transfer.file.TempFile, structs.PacketTypeHashList, chunk.Data); err != nil {
+			l.Errorf("Error saving transfer state: %v", err)
+		}
+	}
+	checkHashes(transfer, l)
+}
+
+// Must be called with transfer.lock held
+func checkHashes(transfer *openTransfer, l *logrus.Entry) {
+	if transfer.verified || transfer.chunksize == 0 || int64(len(transfer.hashes)) < transfer.chunkcount {
+		return
+	}
+	leaves := make([][structs.HASHSIZE]byte, transfer.chunkcount)
+	for i := range leaves {
+		hash, ok := transfer.hashes[int64(i)]
+		if !ok {
+			return
+		}
+		leaves[i] = hash
+	}
+	if structs.MerkleRoot(leaves) != transfer.root {
+		l.Errorf("Chunk hashes don't match their merkle root, chunks can't be verified")
+		resetHashes(transfer)
+		return
+	}
+	transfer.verified = true
+	verifyWritten(transfer, l)
+	transfer.ahead = make(map[int64][structs.HASHSIZE]byte)
+	transfer.checked = make(map[int64]bool)
+}
+
+func verifyWritten(transfer *openTransfer, l *logrus.Entry) {
+	if len(transfer.written) == 0 {
+		return
+	}
+	tempfile, err := os.Open(transfer.file.TempFile)
+	if err != nil {
+		l.Errorf("Error opening tempfile for verifying chunks: %v", err)
+		return
+	}
+	defer tempfile.Close()
+
+	for offset, length := range transfer.written {
+		if transfer.checked[offset] && offset%transfer.chunksize == 0 && transfer.ahead[offset] == transfer.hashes[offset/transfer.chunksize] {
+			continue // Passed the same hash when it arrived
+		}
+		data := make([]byte, length)
+		if _, err := tempfile.ReadAt(data, offset); err != nil || !validChunk(transfer, offset, data) {
+			dropChunk(transfer, offset, l)
+		}
+	}
+}
+
+func resetHashes(transfer *openTransfer) {
+	transfer.hashes = make(map[int64][structs.HASHSIZE]byte)
+	transfer.chunksize = 0
+	transfer.chunkcount = 0
+	transfer.root = [structs.HASHSIZE]byte{}
+}
+
+// Until the hashes are verified chunks are checked against the hashes that led them, those without one pass
+func validChunk(transfer *openTransfer, offset int64, data []byte) bool {
+	if !transfer.verified {
+		hash, ok := transfer.ahead[offset]
+		return !ok || structs.ChunkHash(data) == hash
+	}
+	if offset%transfer.chunksize != 0 {
+		return false
+	}
+	hash, ok := transfer.hashes[offset/transfer.chunksize]
+	return ok && structs.ChunkHash(data) == hash
+}
+
+// The length of a chunk is known once the hashes are verified, the data that failed may have any length
+// so it isn't trusted for it. Only the last chunk may be short, its length is known from the trailer
+func chunkLength(transfer *openTransfer, offset int64, length int) int {
+	if !transfer.verified {
+		return length
+	}
+	if trailer := transfer.file.Trailer; trailer != nil {
+		length = int(transfer.chunksize)
+		if remaining := trailer.Size - offset; remaining < int64(length) {
+			length = int(remaining)
+		}
+		return length
+	}
+	if offset/transfer.chunksize < transfer.chunkcount-1 || length > int(transfer.chunksize) {
+		return int(transfer.chunksize)
+	}
+	return length
+}
+
+func dropChunk(transfer *openTransfer, offset int64, l *logrus.Entry) {
+	length := chunkLength(transfer, offset, transfer.written[offset])
+	delete(transfer.written, offset)
+	transfer.corrupt[offset] = length
+	if err := saveDropped(transfer.file.TempFile, offset, length); err != nil {
+		l.Errorf("Error saving transfer state: %v", err)
+	}
+	l.Warnf("Dropped corrupt chunk at offset %d", offset)
+}
+
+// Ranges that weren't written, those whose last chunk failed its hash are corrupt and the rest are missing
+// Without the trailer the size isn't known so only the corrupt ranges can be told
+func byteRanges(transfer *openTransfer) (missing []structs.ByteRange, corrupt []structs.ByteRange) {
+	var covered []structs.ByteRange
+	for offset, length := range transfer.written {
+		covered = append(covered, structs.ByteRange{Offset: offset, Length: int64(length)})
+	}
+	for offset, length := range transfer.corrupt {
+		if _, ok := transfer.written[offset]; !ok {
+			covered = append(covered, structs.ByteRange{Offset: offset, Length: int64(length)})
+			corrupt = append(corrupt, structs.ByteRange{Offset: offset, Length: int64(length)})
+		}
+	}
+	corrupt = mergeRanges(corrupt)
+	if transfer.file.Trailer == nil {
+		return nil, corrupt
+	}
+
+	var next int64
+	for _, r := range mergeRanges(covered) {
+		if r.Offset > next {
+			missing = append(missing, structs.ByteRange{Offset: next, Length: r.Offset - next})
+		}
+		if end := r.Offset + r.Length; end > next {
+			next = end
+		}
+	}
+	if size := transfer.file.Trailer.Size; size > next {
+		missing = append(missing, structs.ByteRange{Offset: next, Length: size - next})
+	}
+	return missing, corrupt
+}
+
+// Sorts the ranges and joins those that touch
+func mergeRanges(ranges []structs.ByteRange) []structs.ByteRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Offset < ranges[j].Offset })
+	var merged []structs.ByteRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].Offset+merged[n-1].Length >= r.Offset {
+			if end := r.Offset + r.Length; end > merged[n-1].Offset+merged[n-1].Length {
+				merged[n-1].Length = end - merged[n-1].Offset
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,159 @@
+package filewriter
+
+import (
+	"context"
+	"oneway-filesync/pkg/structs"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func Test_worker_verify(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5}
+	leaves := [][structs.HASHSIZE]byte{structs.ChunkHash(data[:2]), structs.ChunkHash(data[2:4]), structs.ChunkHash(data[4:])}
+	transferid := structs.NewTransferId()
+	manifest := &structs.Chunk{Type: structs.PacketTypeManifest, TransferId: transferid, Data: encoded(t, structs.Manifest{Path: "a", Size: 5}.Encode)}
+	share := func(offset int64, data ...byte) *structs.Chunk {
+		return &structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, DataOffset: offset, Data: data}
+	}
+	root := structs.MerkleRoot(leaves)
+	badroot := [structs.HASHSIZE]byte{1}
+	hashlistwith := func(root [structs.HASHSIZE]byte, first int, hashes ...[structs.HASHSIZE]byte) *structs.Chunk {
+		return &structs.Chunk{Type: structs.PacketTypeHashList, TransferId: transferid, DataOffset: int64(first), Data: encoded(t, structs.HashList{First: int64(first), ChunkSize: 2, ChunkCount: 3, MerkleRoot: root, Hashes: hashes}.Encode)}
+	}
+	hashlist := func(first int, hashes ...[structs.HASHSIZE]byte) *structs.Chunk {
+		return hashlistwith(root, first, hashes...)
+	}
+	window := func(first int, hashes ...[structs.HASHSIZE]byte) *structs.Chunk {
+		return &structs.Chunk{Type: structs.PacketTypeHashList, TransferId: transferid, DataOffset: int64(first), Data: encoded(t, structs.HashList{First: int64(first), ChunkSize: 2, Hashes: hashes}.Encode)}
+	}
+	trailer := &structs.Chunk{Type: structs.PacketTypeTrailer, TransferId: transferid, Data: encoded(t, structs.Trailer{Size: 5, ChunkCount: 3}.Encode)}
+
+	tests := []struct {
+		name        string
+		input       []*structs.Chunk
+		wantData    []byte
+		wantDone    bool
+		wantMissing []structs.ByteRange
+		wantCorrupt []structs.ByteRange
+	}{
+		{"test-valid", []*structs.Chunk{manifest, share(0, 1, 2), share(2, 3, 4), share(4, 5), hashlist(0, leaves...), trailer}, data, true, nil, nil},
+		{"test-corrupt-written", []*structs.Chunk{manifest, share(0, 1, 2), share(2, 3, 9), share(4, 5), hashlist(0, leaves...), trailer}, nil, false, nil, []structs.ByteRange{{Offset: 2, Length: 2}}},
+		{"test-corrupt-replaced", []*structs.Chunk{manifest, share(0, 1, 2), share(2, 3, 9), share(4, 5), hashlist(0, leaves...), trailer, share(2, 3, 4)}, data, true, nil, nil},
+		{"test-corrupt-dropped", []*structs.Chunk{manifest, hashlist(0, leaves[:1]...), hashlist(1, leaves[1:]...), trailer, share(0, 1, 2), share(2, 3, 4), share(4, 9)}, nil, false, nil, []structs.ByteRange{{Offset: 4, Length: 1}}},
+		{"test-corrupt-kept-good", []*structs.Chunk{manifest, hashlist(0, leaves...), trailer, share(0, 1, 2), share(0, 9, 9), share(2, 3, 4), share(4, 5)}, data, true, nil, nil},
+		{"test-missing-and-corrupt", []*structs.Chunk{manifest, hashlist(0, leaves...), trailer, share(2, 9, 9)}, nil, false, []structs.ByteRange{{Offset: 0, Length: 2}, {Offset: 4, Length: 1}}, []structs.ByteRange{{Offset: 2, Length: 2}}},
+		{"test-bad-root", []*structs.Chunk{manifest, share(0, 1, 2), share(2, 3, 4), share(4, 5), hashlistwith(badroot, 0, leaves...), trailer}, data, true, nil, nil},
+		{"test-parts-disagree", []*structs.Chunk{manifest, hashlist(0, leaves[:1]...), hashlistwith(badroot, 1, leaves[1:]...), share(0, 1, 2), share(2, 3, 9), share(4, 5), trailer}, []byte{1, 2, 3, 9, 5}, true, nil, nil},
+		// A verified hash list checks every chunk before it is written, the trailer isn't needed for it
+		{"test-verified-before-trailer", []*structs.Chunk{manifest, hashlist(0, leaves...), share(0, 1, 2), share(2, 9, 9), share(4, 9, 9, 9), share(2, 3, 4), share(4, 5), trailer}, data, true, nil, nil},
+		{"test-verified-no-trailer", []*structs.Chunk{manifest, hashlist(0, leaves...), share(0, 9, 9, 9), share(4, 9)}, nil, false, nil, []structs.ByteRange{{Offset: 0, Length: 2}, {Offset: 4, Length: 1}}},
+		// The hashes leading a window of chunks check them before they are written
+		{"test-window", []*structs.Chunk{manifest, window(0, leaves...), share(0, 1, 2), share(2, 3, 4), share(4, 5), hashlist(0, leaves...), trailer}, data, true, nil, nil},
+		{"test-window-dropped", []*structs.Chunk{manifest, window(0, leaves[:2]...), share(0, 1, 2), share(2, 9, 9), window(2, leaves[2:]...), share(4, 9), hashlist(0, leaves...), trailer}, nil, false, nil, []structs.ByteRange{{Offset: 2, Length: 3}}},
+		{"test-window-replaced", []*structs.Chunk{manifest, window(0, leaves...), share(2, 9, 9), share(0, 1, 2), share(2, 3, 4), share(4, 5), trailer}, data, true, nil, nil},
+		{"test-window-lost", []*structs.Chunk{manifest, share(0, 1, 2), share(2, 3, 9), window(2, leaves[2:]...), share(4, 5), hashlist(0, leaves...), trailer}, nil, false, nil, []structs.ByteRange{{Offset: 2, Length: 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := make(chan *structs.Chunk, 10)
+			output := make(chan *structs.OpenTempFile, 10)
+			conf := fileWriterConfig{tempdir: t.TempDir(), input: input, output: output}
+			for _, chunk := range tt.input {
+				input <- chunk
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(2 * time.Second)
+				cancel()
+			}()
+			worker(ctx, &conf)
+
+			if !tt.wantDone {
+				if len(output) != 0 {
+					t.Fatalf("Incomplete transfer was closed")
+				}
+				transfer, ok := conf.cache.Load(transferid)
+				if !ok {
+					t.Fatalf("Incomplete transfer is not open")
+				}
+				missing, corrupt := byteRanges(transfer)
+				if !reflect.DeepEqual(missing, tt.wantMissing) || !reflect.DeepEqual(corrupt, tt.wantCorrupt) {
+					t.Fatalf("Missing %v and corrupt %v, want %v and %v", missing, corrupt, tt.wantMissing, tt.wantCorrupt)
+				}
+
+				// The same ranges come back after a restart
+				restarted := newTransfer(&conf, transferid)
+				if err := loadState(restarted); err != nil {
+					t.Fatal(err)
+				}
+				checkHashes(restarted, logrus.WithField("TransferId", transferid.String()))
+				missing, corrupt = byteRanges(restarted)
+				if !restarted.verified || !reflect.DeepEqual(missing, tt.wantMissing) || !reflect.DeepEqual(corrupt, tt.wantCorrupt) {
+					t.Fatalf("Restarted with missing %v and corrupt %v, want %v and %v", missing, corrupt, tt.wantMissing, tt.wantCorrupt)
+				}
+				return
+			}
+			if len(output) != 1 {
+				t.Fatalf("Expected exactly one closed transfer, got %d", len(output))
+			}
+			file := <-output
+			if len(file.Missing) != 0 || len(file.Corrupt) != 0 {
+				t.Fatalf("Complete transfer has missing %v and corrupt %v", file.Missing, file.Corrupt)
+			}
+			got, err := os.ReadFile(file.TempFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(tt.wantData) {
+				t.Fatalf("Tempfile contains %v, want %v", got, tt.wantData)
+			}
+		})
+	}
+}
+
+func Test_mergeRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []structs.ByteRange
+		want   []structs.ByteRange
+	}{
+		{"test-empty", nil, nil},
+		{"test-adjacent", []structs.ByteRange{{Offset: 4, Length: 2}, {Offset: 0, Length: 4}}, []structs.ByteRange{{Offset: 0, Length: 6}}},
+		{"test-gap", []structs.ByteRange{{Offset: 5, Length: 2}, {Offset: 0, Length: 4}}, []structs.ByteRange{{Offset: 0, Length: 4}, {Offset: 5, Length: 2}}},
+		{"test-contained", []structs.ByteRange{{Offset: 0, Length: 8}, {Offset: 2, Length: 2}}, []structs.ByteRange{{Offset: 0, Length: 8}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeRanges(tt.ranges); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Chunks that passed the hash that led them aren't read back once the full list is verified
+func Test_checkHashes_checked(t *testing.T) {
+	data := []byte{1, 2, 3, 4}
+	leaves := [][structs.HASHSIZE]byte{structs.ChunkHash(data[:2]), structs.ChunkHash(data[2:])}
+	conf := fileWriterConfig{tempdir: t.TempDir()}
+	transfer := newTransfer(&conf, structs.NewTransferId())
+	// The tempfile holds neither chunk, only the unchecked one is found out
+	if err := os.WriteFile(transfer.file.TempFile, []byte{9, 9, 9, 9}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	transfer.written = map[int64]int{0: 2, 2: 2}
+	transfer.ahead[0] = leaves[0]
+	transfer.checked[0] = true
+	if _, err := addHashes(transfer, structs.HashList{ChunkSize: 2, ChunkCount: 2, MerkleRoot: structs.MerkleRoot(leaves), Hashes: leaves}); err != nil {
+		t.Fatal(err)
+	}
+	checkHashes(transfer, logrus.WithField("TransferId", transfer.file.TransferId.String()))
+	if !transfer.verified || !reflect.DeepEqual(transfer.written, map[int64]int{0: 2}) || len(transfer.ahead) != 0 {
+		t.Fatalf("Written %v after verifying, want only the checked chunk kept", transfer.written)
+	}
+}
@@ -0,0 +1,112 @@
+// Spreads the shares of consecutive chunks over time so a burst of loss takes out a few shares of many chunks
+// instead of every share of a few
+package interleaver
+
+import (
+	"context"
+	"oneway-filesync/pkg/structs"
+	"time"
+)
+
+// Whatever is buffered is sent once no shares arrived for this long, even if the block isn't full,
+// so the end of a transfer isn't held back waiting for more chunks
+const flushAfter = 100 * time.Millisecond
+
+type shareKey struct {
+	transferId structs.TransferId
+	packetType structs.PacketType
+	dataOffset int64
+}
+
+type interleaverConfig struct {
+	depth  int
+	total  int
+	input  chan *structs.Chunk
+	output chan *structs.Chunk
+}
+
+// Shares are grouped by chunk in the order the chunks arrived
+type block struct {
+	groups   map[shareKey][]*structs.Chunk
+	order    []shareKey
+	complete int
+}
+
+func newBlock() *block {
+	return &block{groups: make(map[shareKey][]*structs.Chunk)}
+}
+
+func (b *block) add(share *structs.Chunk, total int) {
+	key := shareKey{transferId: share.TransferId, packetType: share.Type, dataOffset: share.DataOffset}
+	group, ok := b.groups[key]
+	if !ok {
+		b.order = append(b.order, key)
+	}
+	b.groups[key] = append(group, share)
+	if len(b.groups[key]) == total {
+		b.complete++
+	}
+}
+
+// Sends the first share of every chunk in the block, then the second of every chunk and so on
+func (b *block) send(ctx context.Context, output chan *structs.Chunk) bool {
+	for i := 0; ; i++ {
+		sent := false
+		for _, key := range b.order {
+			group := b.groups[key]
+			if i >= len(group) {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return false
+			case output <- group[i]:
+			}
+			sent = true
+		}
+		if !sent {
+			return true
+		}
+	}
+}
+
+func worker(ctx context.Context, conf *interleaverConfig) {
+	current := newBlock()
+	lastinput := time.Now()
+	ticker := time.NewTicker(flushAfter / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case share := <-conf.input:
+			lastinput = time.Now()
+			current.add(share, conf.total)
+			if current.complete < conf.depth {
+				continue
+			}
+		case <-ticker.C:
+			if len(current.order) == 0 || time.Since(lastinput) < flushAfter {
+				continue
+			}
+		}
+		if !current.send(ctx, conf.output) {
+			return
+		}
+		current = newBlock()
+	}
+}
+
+// The shares of depth consecutive chunks are interleaved, a depth of 1 sends the shares of each chunk back to back
+func CreateInterleaver(ctx context.Context, depth int, total int, input chan *structs.Chunk, output chan *structs.Chunk) {
+	if depth < 1 {
+		depth = 1
+	}
+	conf := interleaverConfig{
+		depth:  depth,
+		total:  total,
+		input:  input,
+		output: output,
+	}
+	go worker(ctx, &conf)
+}
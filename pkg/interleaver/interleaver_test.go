@@ -0,0 +1,64 @@
+package interleaver
+
+import (
+	"context"
+	"oneway-filesync/pkg/structs"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCreateInterleaver(t *testing.T) {
+	type share struct {
+		offset int64
+		index  uint32
+	}
+	shares := func(offsets []int64, total int) []*structs.Chunk {
+		var chunks []*structs.Chunk
+		for _, offset := range offsets {
+			for i := 0; i < total; i++ {
+				chunks = append(chunks, &structs.Chunk{DataOffset: offset, ShareIndex: uint32(i)})
+			}
+		}
+		return chunks
+	}
+	tests := []struct {
+		name  string
+		depth int
+		total int
+		input []*structs.Chunk
+		want  []share
+	}{
+		{"test-depth-1", 1, 2, shares([]int64{0, 1}, 2), []share{{0, 0}, {0, 1}, {1, 0}, {1, 1}}},
+		{"test-depth-2", 2, 3, shares([]int64{0, 1}, 3), []share{{0, 0}, {1, 0}, {0, 1}, {1, 1}, {0, 2}, {1, 2}}},
+		{"test-partial-block", 3, 2, shares([]int64{0, 1}, 2), []share{{0, 0}, {1, 0}, {0, 1}, {1, 1}}},
+		{"test-incomplete-chunk", 2, 3, shares([]int64{0}, 3)[:2], []share{{0, 0}, {0, 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := make(chan *structs.Chunk, len(tt.input))
+			output := make(chan *structs.Chunk, len(tt.input))
+			for _, chunk := range tt.input {
+				input <- chunk
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			CreateInterleaver(ctx, tt.depth, tt.total, input, output)
+
+			var got []share
+			timeout := time.After(2 * time.Second)
+			for len(got) < len(tt.want) {
+				select {
+				case chunk := <-output:
+					got = append(got, share{chunk.DataOffset, chunk.ShareIndex})
+				case <-timeout:
+					t.Fatalf("Got only %v, want %v", got, tt.want)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Got shares in order %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
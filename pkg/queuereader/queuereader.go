@@ -3,6 +3,7 @@ package queuereader
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"oneway-filesync/pkg/database"
 	"time"
@@ -12,8 +13,36 @@ import (
 )
 
 type queueReaderConfig struct {
-	db     *gorm.DB
-	output chan database.File
+	db       *gorm.DB
+	owner    string
+	policy   string
+	idlefill time.Duration
+	output   chan database.File
+}
+
+// Files are claimed one at a time and only handed on once a filereader takes them,
+// while waiting the lease is kept alive so the file isn't taken over by another sender
+func handoff(ctx context.Context, conf *queueReaderConfig, file database.File) bool {
+	renewticker := time.NewTicker(database.LeaseDuration / 4)
+	defer renewticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case conf.output <- file:
+			return true
+		case <-renewticker.C:
+			if err := database.RenewLease(conf.db, &file, file.SentOffset); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"TransferId": fmt.Sprintf("%x", file.TransferId),
+					"Path":       file.Path,
+				}).Errorf("Error renewing lease of queued file %v", err)
+				if errors.Is(err, database.ErrLeaseLost) {
+					return true
+				}
+			}
+		}
+	}
 }
 
 func worker(ctx context.Context, conf *queueReaderConfig) {
@@ -23,28 +52,39 @@ func worker(ctx context.Context, conf *queueReaderConfig) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			var files []database.File
-			conf.db.Where("Started = ? AND Finished = ?", false, false).Limit(100).Find(&files)
-			for _, file := range files {
-				file.Started = true
-				err := conf.db.Save(&file).Error
+			for {
+				file, err := database.ClaimFile(conf.db, conf.owner, conf.policy)
+				if errors.Is(err, gorm.ErrRecordNotFound) && conf.idlefill > 0 {
+					// Nothing is queued so the bandwidth goes to another copy of a recently sent file
+					file, err = database.ClaimIdleFill(conf.db, conf.owner, conf.idlefill)
+				}
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					break
+				}
 				if err != nil {
-					logrus.WithFields(logrus.Fields{
-						"Path": file.Path,
-						"Hash": fmt.Sprintf("%x", file.Hash),
-					}).Errorf("Error setting to Started in database %v", err)
-					continue
+					logrus.Errorf("Error claiming file from queue %v", err)
+					break
+				}
+				if !handoff(ctx, conf, file) {
+					return
 				}
-				conf.output <- file
 			}
 		}
 	}
 }
 
-func CreateQueueReader(ctx context.Context, db *gorm.DB, output chan database.File) {
+// Files sent within the idlefill window are sent again when the sender is idle, zero disables it
+func CreateQueueReader(ctx context.Context, db *gorm.DB, owner string, policy string, idlefill time.Duration, output chan database.File) {
+	if err := database.ValidateResumePolicy(policy); err != nil {
+		logrus.Errorf("Error creating queue reader: %v", err)
+		return
+	}
 	conf := queueReaderConfig{
-		db:     db,
-		output: output,
+		db:       db,
+		owner:    owner,
+		policy:   policy,
+		idlefill: idlefill,
+		output:   output,
 	}
 	go worker(ctx, &conf)
 }
@@ -2,38 +2,77 @@ package receiver
 
 import (
 	"context"
+	"fmt"
+	"io/fs"
+	"oneway-filesync/pkg/compressor"
 	"oneway-filesync/pkg/config"
 	"oneway-filesync/pkg/fecdecoder"
 	"oneway-filesync/pkg/filecloser"
 	"oneway-filesync/pkg/filewriter"
 	"oneway-filesync/pkg/shareassembler"
 	"oneway-filesync/pkg/structs"
+	"oneway-filesync/pkg/transport"
 	"oneway-filesync/pkg/udpreceiver"
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
-	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
-func Receiver(ctx context.Context, db *gorm.DB, conf config.Config) {
+// The time it takes the sender to send the shares of the chunks it interleaves together
+func interleaveSpread(conf config.Config) time.Duration {
+	if conf.InterleaveDepth <= 1 || conf.BandwidthLimit <= 0 {
+		return 0
+	}
+	bytes := conf.InterleaveDepth * conf.ChunkFecTotal * conf.ChunkSize
+	return time.Duration(float64(bytes) / float64(conf.BandwidthLimit) * float64(time.Second))
+}
+
+func Receiver(ctx context.Context, db *gorm.DB, conf config.Config) error {
+	tr, err := transport.New(conf)
+	if err != nil {
+		return fmt.Errorf("failed creating transport: %v", err)
+	}
+	return ReceiverWithTransport(ctx, db, conf, tr)
+}
+
+// Receives over tr instead of the transport conf names, such as a transport.Chan from a sender in the same process
+// The configuration is checked before any stage starts, nothing is received if it is invalid
+func ReceiverWithTransport(ctx context.Context, db *gorm.DB, conf config.Config, tr transport.Transport) error {
+	if err := filecloser.ValidateMirrorPolicy(conf.MirrorPolicy); err != nil {
+		return err
+	}
+	if err := filecloser.ValidateOwnership(conf.Ownership); err != nil {
+		return err
+	}
 	maxprocs := runtime.GOMAXPROCS(0) * 2
 	tmpdir := filepath.Join(conf.OutDir, "tempfiles")
 	err := os.MkdirAll(tmpdir, os.ModePerm)
 	if err != nil {
-		logrus.Errorf("Failed creating tempdir with err %v", err)
-		return
+		return fmt.Errorf("failed creating tempdir: %v", err)
+	}
+
+	overrides := filecloser.Overrides{
+		FileMode:  fs.FileMode(conf.FileMode),
+		DirMode:   fs.FileMode(conf.DirMode),
+		Ownership: conf.Ownership,
+
+		AllowUnsafeSymlinks: conf.AllowUnsafeSymlinks,
 	}
 
 	shares_chan := make(chan *structs.Chunk, 100)
 	sharelist_chan := make(chan []*structs.Chunk, 100)
 	chunks_chan := make(chan *structs.Chunk, 100)
+	decompressed_chan := make(chan *structs.Chunk, 100)
 	finishedfiles_chan := make(chan *structs.OpenTempFile, 5)
 
-	udpreceiver.CreateUdpReceiver(ctx, conf.ReceiverIP, conf.ReceiverPort, conf.ChunkSize, shares_chan, maxprocs)
-	shareassembler.CreateShareAssembler(ctx, conf.ChunkFecRequired, conf.ChunkFecTotal, shares_chan, sharelist_chan, maxprocs)
+	udpreceiver.CreateUdpReceiver(ctx, tr, conf.ChunkSize, shares_chan, maxprocs)
+	shareassembler.CreateShareAssembler(ctx, conf.ChunkFecRequired, conf.ChunkFecTotal, conf.ChunkSize, interleaveSpread(conf), conf.ShareCacheLimit, shares_chan, sharelist_chan, maxprocs)
 	fecdecoder.CreateFecDecoder(ctx, conf.ChunkFecRequired, conf.ChunkFecTotal, sharelist_chan, chunks_chan, maxprocs)
-	filewriter.CreateFileWriter(ctx, tmpdir, chunks_chan, finishedfiles_chan, maxprocs)
-	filecloser.CreateFileCloser(ctx, db, conf.OutDir, finishedfiles_chan, maxprocs)
+	compressor.CreateDecompressor(ctx, (conf.ChunkSize-structs.ChunkOverhead)*conf.ChunkFecRequired, chunks_chan, decompressed_chan, maxprocs)
+	filewriter.CreateFileWriter(ctx, db, tmpdir, conf.TempFileMaxAge, decompressed_chan, finishedfiles_chan, maxprocs)
+	filecloser.CreateFileCloser(ctx, db, conf.OutDir, tmpdir, conf.MirrorPolicy, conf.ArchiveDir, overrides, finishedfiles_chan, maxprocs)
+	return nil
 }
@@ -3,28 +3,68 @@ package sender
 import (
 	"context"
 	"oneway-filesync/pkg/bandwidthlimiter"
+	"oneway-filesync/pkg/compressor"
 	"oneway-filesync/pkg/config"
 	"oneway-filesync/pkg/database"
 	"oneway-filesync/pkg/fecencoder"
 	"oneway-filesync/pkg/filereader"
+	"oneway-filesync/pkg/interleaver"
 	"oneway-filesync/pkg/queuereader"
+	"oneway-filesync/pkg/spool"
 	"oneway-filesync/pkg/structs"
+	"oneway-filesync/pkg/transport"
 	"oneway-filesync/pkg/udpsender"
 	"runtime"
 
+	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
 func Sender(ctx context.Context, db *gorm.DB, conf config.Config) {
+	tr, err := transport.New(conf)
+	if err != nil {
+		logrus.Errorf("Failed creating transport with error: %v", err)
+		return
+	}
+	SenderWithTransport(ctx, db, conf, tr)
+}
+
+// Sends over tr instead of the transport conf names, such as a transport.Chan to a receiver in the same process
+func SenderWithTransport(ctx context.Context, db *gorm.DB, conf config.Config, tr transport.Transport) {
 	maxprocs := runtime.GOMAXPROCS(0) * 2
-	queue_chan := make(chan database.File, 10)
+	queue_chan := make(chan database.File) // Unbuffered so files are only claimed when a filereader is free
 	chunks_chan := make(chan *structs.Chunk, 100)
+	compressed_chan := make(chan *structs.Chunk, 100)
 	shares_chan := make(chan *structs.Chunk, 100)
+	interleaved_chan := make(chan *structs.Chunk, 100)
 	bw_limited_chunks := make(chan *structs.Chunk, 5) // Small buffer to reduce burst
 
-	queuereader.CreateQueueReader(ctx, db, queue_chan)
+	owner := database.OwnerId(conf.SenderId)
+	logrus.Infof("Sender claiming files as %s", owner)
+	// Only a configured id is the same as in a previous run
+	if conf.SenderId != "" {
+		requeued, err := database.RequeueInterrupted(db, owner, conf.ResumePolicy)
+		if err != nil {
+			logrus.Errorf("Failed requeueing interrupted files with error: %v", err)
+		} else if requeued > 0 {
+			logrus.Infof("Requeued %d files interrupted by a previous run", requeued)
+		}
+	}
+
+	sp, err := spool.OpenSpool(conf.SpoolDir, conf.SpoolSizeLimit)
+	if err != nil {
+		logrus.Errorf("Failed to open spool with error: %v", err)
+		return
+	}
+	if err := sp.Clean(db); err != nil {
+		logrus.Errorf("Failed to clean spool with error: %v", err)
+	}
+
+	queuereader.CreateQueueReader(ctx, db, owner, conf.ResumePolicy, conf.IdleFillWindow, queue_chan)
 	filereader.CreateFileReader(ctx, db, conf.ChunkSize, conf.ChunkFecRequired, queue_chan, chunks_chan, maxprocs)
-	fecencoder.CreateFecEncoder(ctx, conf.ChunkFecRequired, conf.ChunkFecTotal, chunks_chan, shares_chan, maxprocs)
-	bandwidthlimiter.CreateBandwidthLimiter(ctx, conf.BandwidthLimit, conf.ChunkSize, shares_chan, bw_limited_chunks, maxprocs)
-	udpsender.CreateUdpSender(ctx, conf.ReceiverIP, conf.ReceiverPort, bw_limited_chunks, maxprocs)
+	compressor.CreateCompressor(ctx, chunks_chan, compressed_chan, maxprocs)
+	fecencoder.CreateFecEncoder(ctx, conf.ChunkFecRequired, conf.ChunkFecTotal, compressed_chan, shares_chan, maxprocs)
+	interleaver.CreateInterleaver(ctx, conf.InterleaveDepth, conf.ChunkFecTotal, shares_chan, interleaved_chan)
+	bandwidthlimiter.CreateBandwidthLimiter(ctx, conf.BandwidthLimit, conf.ChunkSize, interleaved_chan, bw_limited_chunks, maxprocs)
+	udpsender.CreateUdpSender(ctx, tr, bw_limited_chunks, maxprocs)
 }
@@ -0,0 +1,151 @@
+package shareassembler
+
+import (
+	"container/list"
+	"oneway-filesync/pkg/structs"
+	"sync"
+)
+
+// The shares of every chunk that is being assembled are held in memory,
+// a flood of bogus shares with random transfer ids would grow the cache without bound
+// so the cache holds at most limit bytes of shares and makes room by evicting the chunks that were written to least recently
+// Every value is accounted for with valueOverhead bytes on top of its shares so that
+// the markers of completed chunks, which hold no shares, count towards the limit too
+// Markers are moved to the front when their chunk completes and aren't moved by the shares that arrive for them later,
+// so they are evicted before any chunk that is still being assembled
+// Lock order is value.lock then cache.lock, the cache only ever tries to lock a value
+type shareCache struct {
+	lock  sync.Mutex
+	order *list.List // Of *cacheValue, the least recently written to first
+	items map[cacheKey]*list.Element
+	bytes int64
+	limit int64
+}
+
+const valueOverhead = 256
+
+func newShareCache(limit int64) *shareCache {
+	return &shareCache{
+		order: list.New(),
+		items: make(map[cacheKey]*list.Element),
+		limit: limit,
+	}
+}
+
+// Returns the value of key, creating it if needed, and marks it as the most recently written to
+// The marker of a completed chunk is returned as is and reported as completed
+func (c *shareCache) get(key cacheKey, total int) (*cacheValue, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		value := e.Value.(*cacheValue)
+		if value.completed.Load() {
+			return value, true
+		}
+		c.order.MoveToBack(e)
+		return value, false
+	}
+	value := &cacheValue{key: key, seen: make([]bool, total), bytes: valueOverhead}
+	c.items[key] = c.order.PushBack(value)
+	c.bytes += valueOverhead
+	return value, false
+}
+
+// Accounts for n more bytes held by value and makes room until the cache fits its limit again
+// The oldest markers and chunks that can't be decoded yet are evicted first, then the oldest chunks that have
+// at least required shares are flushed rather than dropped, their markers kept only if there is room
+// Values that are locked are skipped, they are in use and evicted next time
+// Must be called with value.lock held, returns the number of incomplete values evicted and the shares flushed
+func (c *shareCache) grow(value *cacheValue, n int64, required int) (int, [][]*structs.Chunk) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if value.removed {
+		return 0, nil
+	}
+	value.bytes += n
+	c.bytes += n
+
+	evicted := 0
+	var flushed [][]*structs.Chunk
+	for pass := 0; pass < 2 && c.bytes > c.limit; pass++ {
+		for e := c.order.Front(); e != nil && c.bytes > c.limit; {
+			next := e.Next()
+			if v := e.Value.(*cacheValue); v != value && v.lock.TryLock() {
+				decodable := !v.completed.Load() && len(v.shares) >= required
+				switch {
+				case decodable && pass == 0:
+				case decodable:
+					shares := takeShares(v)
+					c.completeLocked(v, int64(len(shares)*v.sharelen))
+					flushed = append(flushed, shares)
+					if c.bytes > c.limit {
+						c.removeLocked(v)
+					}
+				default:
+					c.removeLocked(v)
+					if !v.completed.Load() {
+						evicted++
+					}
+				}
+				v.lock.Unlock()
+			}
+			e = next
+		}
+	}
+	return evicted, flushed
+}
+
+// Accounts for the n bytes of shares value no longer holds and moves it to the front as a marker
+// Must be called with value.lock held
+func (c *shareCache) complete(value *cacheValue, n int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.completeLocked(value, n)
+}
+
+func (c *shareCache) completeLocked(value *cacheValue, n int64) {
+	if value.removed {
+		return
+	}
+	value.bytes -= n
+	c.bytes -= n
+	if e, ok := c.items[value.key]; ok && e.Value == value {
+		c.order.MoveToFront(e)
+	}
+}
+
+// Must be called with value.lock held
+func (c *shareCache) remove(value *cacheValue) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(value)
+}
+
+func (c *shareCache) removeLocked(value *cacheValue) {
+	if value.removed {
+		return
+	}
+	value.removed = true
+	c.bytes -= value.bytes
+	if e, ok := c.items[value.key]; ok && e.Value == value {
+		c.order.Remove(e)
+		delete(c.items, value.key)
+	}
+}
+
+// A snapshot of the values for going over them without holding the cache
+func (c *shareCache) values() []*cacheValue {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	values := make([]*cacheValue, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		values = append(values, e.Value.(*cacheValue))
+	}
+	return values
+}
+
+func (c *shareCache) usage() (int, int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len(), c.bytes
+}
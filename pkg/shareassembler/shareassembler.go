@@ -3,92 +3,243 @@ package shareassembler
 import (
 	"context"
 	"oneway-filesync/pkg/structs"
-	"oneway-filesync/pkg/utils"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // Cache docs:
-// For every (FileHash,FileDataOffset) we save a cache of shares
+// For every (TransferId,PacketType,DataOffset) we save a cache of shares
 // Since we need at least <required> shares to create the original data we have to cache them somewhere
-// After we get <required> shares we can pull them and create the data but then up to (<total>-<required>) will continue coming in
+// We hold on to the shares until all <total> of them arrive so that the decoder can verify the parity,
+// if some of them were lost the manager flushes whatever did arrive once the chunk goes quiet
 // The LastUpdated is a field which we can time out based upon and
+// Every share index is kept once so a chunk never holds more than <total> shares
+// Once a chunk is flushed its value stays behind as a marker so the rest of its shares are dropped as they arrive
+// instead of being decoded and written again, the marker times out like any other value, 10*flushAfter after the flush
+// Shares of a later copy that arrive after that are assembled and decoded again, the file writer then drops them
+// if the transfer was already received or merges them into it if it failed
 type cacheKey struct {
-	hash       [structs.HASHSIZE]byte
+	transferId structs.TransferId
+	packetType structs.PacketType
 	dataOffset int64
 }
 type cacheValue struct {
-	shares      chan *structs.Chunk
+	key         cacheKey
+	shares      []*structs.Chunk
+	seen        []bool // By share index
+	sharelen    int
+	bytes       int64
+	removed     bool        // Evicted or timed out, a share for the key starts a new value
+	completed   atomic.Bool // Flushed, the shares that arrive later are dropped
 	lastUpdated atomic.Int64
 	lock        sync.Mutex
 }
 
+// Shares that can't be part of a chunk are dropped before they are cached,
+// they are counted by reason and reported periodically by the manager
+type rejectCounters struct {
+	badIndex       atomic.Uint64
+	badLength      atomic.Uint64
+	badPadding     atomic.Uint64
+	lengthMismatch atomic.Uint64
+	duplicate      atomic.Uint64
+	evicted        atomic.Uint64
+	early          atomic.Uint64
+	late           atomic.Uint64
+}
+
+func (r *rejectCounters) report(cache *shareCache) {
+	if n := r.badIndex.Swap(0); n > 0 {
+		logrus.Errorf("Rejected %d shares with a share index out of range, is ChunkFecTotal the same on both sides?", n)
+	}
+	if n := r.badLength.Swap(0); n > 0 {
+		logrus.Errorf("Rejected %d shares with a length that doesn't fit the chunk size", n)
+	}
+	if n := r.badPadding.Swap(0); n > 0 {
+		logrus.Errorf("Rejected %d shares with padding out of range, is ChunkFecRequired the same on both sides?", n)
+	}
+	if n := r.lengthMismatch.Swap(0); n > 0 {
+		logrus.Errorf("Rejected %d shares with a length different from the other shares of their chunk", n)
+	}
+	if n := r.duplicate.Swap(0); n > 0 {
+		logrus.Warnf("Rejected %d duplicate shares", n)
+	}
+	if n := r.late.Swap(0); n > 0 {
+		logrus.Debugf("Dropped %d shares of chunks that were already assembled", n)
+	}
+	if n := r.early.Swap(0); n > 0 {
+		logrus.Warnf("Flushed %d chunks before the rest of their shares arrived to stay within the share cache limit", n)
+	}
+	if n := r.evicted.Swap(0); n > 0 {
+		chunks, bytes := cache.usage()
+		logrus.Errorf("Evicted %d incomplete chunks to stay within the share cache limit, %d chunks with %d bytes of shares are cached", n, chunks, bytes)
+	}
+}
+
 type shareAssemblerConfig struct {
-	required int
-	total    int
-	input    chan *structs.Chunk
-	output   chan []*structs.Chunk
-	cache    utils.RWMutexMap[cacheKey, *cacheValue]
+	required     int
+	total        int
+	maxShareSize int
+	flushAfter   time.Duration
+	input        chan *structs.Chunk
+	output       chan []*structs.Chunk
+	cache        *shareCache
+	rejects      rejectCounters
+}
+
+// The fec encoder pads every chunk to a multiple of <required> and splits it into equal shares
+func sane(conf *shareAssemblerConfig, chunk *structs.Chunk) bool {
+	switch {
+	case chunk.ShareIndex >= uint32(conf.total):
+		conf.rejects.badIndex.Add(1)
+	case len(chunk.Data) == 0 || len(chunk.Data) > conf.maxShareSize:
+		conf.rejects.badLength.Add(1)
+	case chunk.DataPadding >= uint32(conf.required) || int(chunk.DataPadding) >= len(chunk.Data)*conf.required:
+		conf.rejects.badPadding.Add(1)
+	default:
+		return true
+	}
+	return false
+}
+
+// Leaves the value as the marker of a completed chunk and returns its shares
+// Must be called with value.lock held
+func takeShares(value *cacheValue) []*structs.Chunk {
+	shares := value.shares
+	value.shares = nil
+	value.seen = nil
+	value.completed.Store(true)
+	value.lastUpdated.Store(time.Now().UnixMilli()) // The marker times out from here
+	return shares
+}
+
+// Must be called with value.lock held
+func flush(conf *shareAssemblerConfig, value *cacheValue) {
+	if len(value.shares) < conf.required {
+		return
+	}
+	shares := takeShares(value)
+	conf.cache.complete(value, int64(len(shares)*value.sharelen))
+	conf.output <- shares
 }
 
 // The manager acts as a "Garbage collector"
-// every chunk that didn't get any new shares for the past 10 seconds can be
+// every chunk that didn't get any new shares for flushAfter is flushed with the shares it has,
+// every chunk that didn't get any new shares for 10 times as long can be
 // assumed to never again receive more shares and deleted
 func manager(ctx context.Context, conf *shareAssemblerConfig) {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(conf.flushAfter)
+	reportticker := time.NewTicker(5 * time.Second)
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-reportticker.C:
+			conf.rejects.report(conf.cache)
 		case <-ticker.C:
-			conf.cache.Range(func(key cacheKey, value *cacheValue) bool {
+			for _, value := range conf.cache.values() {
 				lastUpdated := value.lastUpdated.Load()
-				if lastUpdated != 0 && (time.Now().Unix()-lastUpdated) > 10 {
-					conf.cache.Delete(key)
+				if lastUpdated == 0 || !value.lock.TryLock() {
+					continue
+				}
+				idle := time.Since(time.UnixMilli(lastUpdated))
+				if idle > 10*conf.flushAfter {
+					conf.cache.remove(value)
+				} else if idle > conf.flushAfter {
+					flush(conf, value)
 				}
-				return true
-			})
+				value.lock.Unlock()
+			}
 		}
 	}
 }
 
+// Adds the share to its chunk and flushes the chunk once all of its shares arrived
+// Shares of a completed chunk are dropped before they touch the cache, so they can't evict the chunks being assembled
+func addShare(conf *shareAssemblerConfig, chunk *structs.Chunk) {
+	key := cacheKey{transferId: chunk.TransferId, packetType: chunk.Type, dataOffset: chunk.DataOffset}
+	value, completed := conf.cache.get(key, conf.total)
+	if completed {
+		conf.rejects.late.Add(1)
+		return
+	}
+	value.lock.Lock()
+	for value.removed {
+		// Evicted between getting and locking it
+		value.lock.Unlock()
+		if value, completed = conf.cache.get(key, conf.total); completed {
+			conf.rejects.late.Add(1)
+			return
+		}
+		value.lock.Lock()
+	}
+	defer value.lock.Unlock()
+
+	switch {
+	case value.completed.Load():
+		conf.rejects.late.Add(1)
+		return
+	case len(value.shares) > 0 && len(chunk.Data) != value.sharelen:
+		conf.rejects.lengthMismatch.Add(1)
+		return
+	case value.seen[chunk.ShareIndex]:
+		conf.rejects.duplicate.Add(1)
+		return
+	}
+	value.seen[chunk.ShareIndex] = true
+	value.sharelen = len(chunk.Data)
+	value.shares = append(value.shares, chunk)
+	value.lastUpdated.Store(time.Now().UnixMilli())
+	evicted, flushed := conf.cache.grow(value, int64(len(chunk.Data)), conf.required)
+	if evicted > 0 {
+		conf.rejects.evicted.Add(uint64(evicted))
+	}
+	if len(flushed) > 0 {
+		conf.rejects.early.Add(uint64(len(flushed)))
+	}
+	for _, shares := range flushed {
+		conf.output <- shares
+	}
+
+	if len(value.shares) >= conf.total {
+		flush(conf, value)
+	}
+}
+
 func worker(ctx context.Context, conf *shareAssemblerConfig) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case chunk := <-conf.input:
-			value, _ := conf.cache.LoadOrStore(
-				cacheKey{hash: chunk.Hash, dataOffset: chunk.DataOffset},
-				&cacheValue{shares: make(chan *structs.Chunk, conf.total*2)})
-			value.shares <- chunk
-			value.lastUpdated.Store(time.Now().Unix())
-
-			aquired := value.lock.TryLock()
-			if aquired {
-				if len(value.shares) >= conf.required {
-					var shares []*structs.Chunk
-					for i := 0; i < conf.required; i++ {
-						shares = append(shares, <-value.shares)
-					}
-					value.lock.Unlock()
-					conf.output <- shares
-				} else {
-					value.lock.Unlock()
-				}
+			if sane(conf, chunk) {
+				addShare(conf, chunk)
 			}
 		}
 	}
 }
 
-func CreateShareAssembler(ctx context.Context, required int, total int, input chan *structs.Chunk, output chan []*structs.Chunk, workercount int) {
+// Used when the cache limit isn't configured
+const DefaultCacheLimit = 256 << 20
+
+// The sender may interleave the shares of a chunk with those of the next ones,
+// so a chunk only counts as quiet once no shares arrived for longer than that spread
+// Shares of chunks being assembled take up to cachelimit bytes, zero uses DefaultCacheLimit
+func CreateShareAssembler(ctx context.Context, required int, total int, chunksize int, spread time.Duration, cachelimit int64, input chan *structs.Chunk, output chan []*structs.Chunk, workercount int) {
+	if cachelimit <= 0 {
+		cachelimit = DefaultCacheLimit
+	}
 	conf := shareAssemblerConfig{
-		required: required,
-		total:    total,
-		input:    input,
-		output:   output,
-		cache:    utils.RWMutexMap[cacheKey, *cacheValue]{},
+		required:     required,
+		total:        total,
+		maxShareSize: chunksize - structs.ChunkOverhead,
+		flushAfter:   time.Second + 2*spread,
+		input:        input,
+		output:       output,
+		cache:        newShareCache(cachelimit),
 	}
 	for i := 0; i < workercount; i++ {
 		go worker(ctx, &conf)
@@ -0,0 +1,262 @@
+package shareassembler
+
+import (
+	"context"
+	"oneway-filesync/pkg/structs"
+	"testing"
+	"time"
+)
+
+func share(transferid structs.TransferId, offset int64, index uint32, length int) *structs.Chunk {
+	return &structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, DataOffset: offset, ShareIndex: index, Data: make([]byte, length)}
+}
+
+func newConf(limit int64) *shareAssemblerConfig {
+	return &shareAssemblerConfig{
+		required:     2,
+		total:        4,
+		maxShareSize: 100,
+		flushAfter:   time.Second,
+		input:        make(chan *structs.Chunk, 100),
+		output:       make(chan []*structs.Chunk, 100),
+		cache:        newShareCache(limit),
+	}
+}
+
+func Test_sane(t *testing.T) {
+	transferid := structs.NewTransferId()
+	padded := share(transferid, 0, 0, 10)
+	padded.DataPadding = 1
+	badpadding := share(transferid, 0, 0, 10)
+	badpadding.DataPadding = 2
+	tinypadding := share(transferid, 0, 0, 1)
+	tinypadding.DataPadding = 1
+
+	tests := []struct {
+		name    string
+		chunk   *structs.Chunk
+		want    bool
+		counter func(r *rejectCounters) uint64
+	}{
+		{"test-valid", share(transferid, 0, 3, 100), true, nil},
+		{"test-valid-padding", padded, true, nil},
+		{"test-bad-index", share(transferid, 0, 4, 10), false, func(r *rejectCounters) uint64 { return r.badIndex.Load() }},
+		{"test-empty", share(transferid, 0, 0, 0), false, func(r *rejectCounters) uint64 { return r.badLength.Load() }},
+		{"test-too-long", share(transferid, 0, 0, 101), false, func(r *rejectCounters) uint64 { return r.badLength.Load() }},
+		{"test-bad-padding", badpadding, false, func(r *rejectCounters) uint64 { return r.badPadding.Load() }},
+		{"test-padding-one-byte-shares", tinypadding, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := newConf(1 << 20)
+			if got := sane(conf, tt.chunk); got != tt.want {
+				t.Fatalf("sane() = %v, want %v", got, tt.want)
+			}
+			if tt.counter != nil && tt.counter(&conf.rejects) != 1 {
+				t.Fatalf("Rejection wasn't counted under its reason")
+			}
+		})
+	}
+}
+
+func Test_worker(t *testing.T) {
+	transferid := structs.NewTransferId()
+	tests := []struct {
+		name           string
+		input          []*structs.Chunk
+		wantFlushed    int
+		wantDuplicates uint64
+		wantMismatches uint64
+		wantLate       uint64
+	}{
+		{"test-complete", []*structs.Chunk{share(transferid, 0, 0, 10), share(transferid, 0, 1, 10), share(transferid, 0, 2, 10), share(transferid, 0, 3, 10)}, 4, 0, 0, 0},
+		{"test-duplicates", []*structs.Chunk{share(transferid, 0, 0, 10), share(transferid, 0, 0, 10), share(transferid, 0, 0, 10), share(transferid, 0, 1, 10)}, 0, 2, 0, 0},
+		{"test-length-mismatch", []*structs.Chunk{share(transferid, 0, 0, 10), share(transferid, 0, 1, 11), share(transferid, 0, 2, 10), share(transferid, 0, 3, 10)}, 0, 0, 1, 0},
+		{"test-replayed-after-flush", []*structs.Chunk{share(transferid, 0, 0, 10), share(transferid, 0, 1, 10), share(transferid, 0, 2, 10), share(transferid, 0, 3, 10), share(transferid, 0, 3, 10), share(transferid, 0, 0, 10), share(transferid, 0, 1, 10)}, 4, 0, 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := newConf(1 << 20)
+			for _, chunk := range tt.input {
+				conf.input <- chunk
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(2 * time.Second)
+				cancel()
+			}()
+			worker(ctx, conf)
+
+			flushed := 0
+			if len(conf.output) > 0 {
+				flushed = len(<-conf.output)
+			}
+			if flushed != tt.wantFlushed || len(conf.output) != 0 {
+				t.Fatalf("Flushed %d shares, want %d in a single flush", flushed, tt.wantFlushed)
+			}
+			if n := conf.rejects.duplicate.Load(); n != tt.wantDuplicates {
+				t.Fatalf("Counted %d duplicates, want %d", n, tt.wantDuplicates)
+			}
+			if n := conf.rejects.lengthMismatch.Load(); n != tt.wantMismatches {
+				t.Fatalf("Counted %d length mismatches, want %d", n, tt.wantMismatches)
+			}
+			if n := conf.rejects.late.Load(); n != tt.wantLate {
+				t.Fatalf("Counted %d late shares, want %d", n, tt.wantLate)
+			}
+		})
+	}
+}
+
+func Test_worker_limit(t *testing.T) {
+	// Room for three chunks at a time, none with enough shares to decode
+	conf := newConf(3 * (valueOverhead + 2*10))
+	var transferids []structs.TransferId
+	for i := 0; i < 10; i++ {
+		transferids = append(transferids, structs.NewTransferId())
+		conf.input <- share(transferids[i], 0, 0, 20)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(2 * time.Second)
+		cancel()
+	}()
+	worker(ctx, conf)
+
+	chunks, bytes := conf.cache.usage()
+	if bytes > conf.cache.limit || chunks != 3 {
+		t.Fatalf("Cache holds %d chunks with %d bytes, want 3 chunks within %d bytes", chunks, bytes, conf.cache.limit)
+	}
+	if n := conf.rejects.evicted.Load(); n != 7 {
+		t.Fatalf("Counted %d evictions, want 7", n)
+	}
+	// The chunks written to most recently are the ones kept
+	for i, transferid := range transferids {
+		conf.cache.lock.Lock()
+		_, cached := conf.cache.items[cacheKey{transferId: transferid, packetType: structs.PacketTypeShare}]
+		conf.cache.lock.Unlock()
+		if cached != (i >= 7) {
+			t.Fatalf("Chunk %d cached = %v, want %v", i, cached, i >= 7)
+		}
+	}
+}
+
+func Test_manager_completed(t *testing.T) {
+	transferid := structs.NewTransferId()
+	conf := newConf(1 << 20)
+	conf.flushAfter = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager(ctx, conf)
+
+	// Only the required shares arrive at first, the manager flushes them once the chunk goes quiet
+	addShare(conf, share(transferid, 0, 0, 10))
+	addShare(conf, share(transferid, 0, 1, 10))
+	time.Sleep(5 * conf.flushAfter)
+	if len(conf.output) != 1 {
+		t.Fatalf("Expected the quiet chunk to be flushed")
+	}
+	<-conf.output
+
+	// The rest of its shares are dropped while the marker lasts
+	addShare(conf, share(transferid, 0, 2, 10))
+	addShare(conf, share(transferid, 0, 3, 10))
+	if n := conf.rejects.late.Load(); n != 2 {
+		t.Fatalf("Counted %d late shares, want 2", n)
+	}
+	time.Sleep(5 * conf.flushAfter)
+	if len(conf.output) != 0 {
+		t.Fatalf("Late shares of a completed chunk were flushed")
+	}
+
+	// The marker expires 10*flushAfter after the flush, a copy of the chunk is then assembled and decoded again
+	time.Sleep(10 * conf.flushAfter)
+	if chunks, _ := conf.cache.usage(); chunks != 0 {
+		t.Fatalf("Completed marker didn't expire")
+	}
+	addShare(conf, share(transferid, 0, 0, 10))
+	addShare(conf, share(transferid, 0, 1, 10))
+	addShare(conf, share(transferid, 0, 2, 10))
+	addShare(conf, share(transferid, 0, 3, 10))
+	if len(conf.output) != 1 {
+		t.Fatalf("Expected a copy of the chunk to be assembled after its marker expired")
+	}
+}
+
+func Test_addShare_late_marker(t *testing.T) {
+	// Room for the marker of one chunk and the shares of three being assembled
+	conf := newConf(3*valueOverhead + 5*10)
+	completed, first, second, third := structs.NewTransferId(), structs.NewTransferId(), structs.NewTransferId(), structs.NewTransferId()
+	for i := uint32(0); i < 4; i++ {
+		addShare(conf, share(completed, 0, i, 10))
+	}
+	addShare(conf, share(first, 0, 0, 10))
+	addShare(conf, share(first, 0, 1, 10))
+	addShare(conf, share(second, 0, 0, 10))
+	addShare(conf, share(second, 0, 1, 10))
+
+	// Late shares of the completed chunk leave it the least recently written to, so it goes before the chunks being assembled
+	addShare(conf, share(completed, 0, 0, 10))
+	addShare(conf, share(completed, 0, 1, 10))
+	addShare(conf, share(third, 0, 0, 10))
+
+	if n := conf.rejects.late.Load(); n != 2 {
+		t.Fatalf("Counted %d late shares, want 2", n)
+	}
+	if n := conf.rejects.evicted.Load(); n != 0 {
+		t.Fatalf("Evicted %d chunks being assembled, want the marker evicted instead", n)
+	}
+	for _, transferid := range []structs.TransferId{first, second, third} {
+		conf.cache.lock.Lock()
+		_, cached := conf.cache.items[cacheKey{transferId: transferid, packetType: structs.PacketTypeShare}]
+		conf.cache.lock.Unlock()
+		if !cached {
+			t.Fatalf("Chunk being assembled was evicted")
+		}
+	}
+}
+
+func Test_addShare_limit_decodable(t *testing.T) {
+	// Room for the shares of two chunks, the oldest has enough shares and only waits for the rest of them
+	conf := newConf(2 * (valueOverhead + 2*10))
+	decodable, first, second := structs.NewTransferId(), structs.NewTransferId(), structs.NewTransferId()
+	addShare(conf, share(decodable, 0, 0, 10))
+	addShare(conf, share(decodable, 0, 1, 10))
+	addShare(conf, share(first, 0, 0, 10))
+
+	// The chunk that can't be decoded yet goes first even though it is newer
+	addShare(conf, share(second, 0, 0, 10))
+	addShare(conf, share(second, 0, 1, 10))
+	if n := conf.rejects.evicted.Load(); n != 1 {
+		t.Fatalf("Counted %d evictions, want 1", n)
+	}
+	if len(conf.output) != 0 {
+		t.Fatalf("Flushed a chunk while there was one to evict")
+	}
+
+	// Once only decodable chunks are left the oldest is flushed rather than dropped
+	addShare(conf, share(first, 0, 0, 10))
+	if n := conf.rejects.early.Load(); n != 1 {
+		t.Fatalf("Counted %d early flushes, want 1", n)
+	}
+	if n := conf.rejects.evicted.Load(); n != 1 {
+		t.Fatalf("Counted %d evictions, want 1", n)
+	}
+	if len(conf.output) != 1 {
+		t.Fatalf("Expected the decodable chunk to be flushed")
+	}
+	if shares := <-conf.output; len(shares) != 2 || shares[0].TransferId != decodable {
+		t.Fatalf("Flushed the wrong shares")
+	}
+	_, bytes := conf.cache.usage()
+	if bytes > conf.cache.limit {
+		t.Fatalf("Cache holds %d bytes, limit is %d", bytes, conf.cache.limit)
+	}
+	conf.cache.lock.Lock()
+	_, cached := conf.cache.items[cacheKey{transferId: second, packetType: structs.PacketTypeShare}]
+	conf.cache.lock.Unlock()
+	if !cached {
+		t.Fatalf("Newer decodable chunk was flushed too")
+	}
+}
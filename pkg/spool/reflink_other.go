@@ -0,0 +1,12 @@
+//go:build !linux
+
+package spool
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(dst *os.File, src *os.File) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,191 @@
+// Snapshots files into a spool directory when they are queued,
+// the snapshot is what the sender hashes and sends so the file may change or disappear in the meantime
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"oneway-filesync/pkg/database"
+	"oneway-filesync/pkg/filereader"
+	"oneway-filesync/pkg/structs"
+	"oneway-filesync/pkg/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var ErrSpoolFull = errors.New("spool is full")
+
+// Snapshots are written under this suffix and renamed once complete
+const stagingSuffix = ".staging"
+
+// Staging files left behind by a crash are removed once they are this old,
+// younger ones may belong to a copy that is still in progress
+const stagingExpiry = time.Hour
+
+type Spool struct {
+	dir   string
+	limit int64
+}
+
+// An empty dir disables spooling, a nil spool queues files in place
+// A zero limit leaves the size of the spool unlimited
+func OpenSpool(dir string, limit int64) (*Spool, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed creating spool dir: %v", err)
+	}
+	return &Spool{dir: dir, limit: limit}, nil
+}
+
+// The total size of the snapshots, including the ones being written
+func (s *Spool) Usage() (int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	var usage int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue // Removed since it was listed
+		}
+		usage += info.Size()
+	}
+	return usage, nil
+}
+
+// Only regular files are snapshotted, everything else is queued in place
+// Returns ErrSpoolFull without queueing the file when its snapshot doesn't fit,
+// a file larger than the whole spool is taken once the spool is empty
+func (s *Spool) QueueFile(db *gorm.DB, path string, opts database.SendOptions) error {
+	if s == nil {
+		return database.QueueFileForSending(db, path, opts)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return database.QueueFileForSending(db, path, opts)
+	}
+
+	if s.limit > 0 {
+		usage, err := s.Usage()
+		if err != nil {
+			return fmt.Errorf("failed reading spool usage: %v", err)
+		}
+		if usage > 0 && usage+info.Size() > s.limit {
+			return ErrSpoolFull
+		}
+	}
+
+	spoolpath, metadata, err := s.snapshot(path, opts.Encrypted)
+	if err != nil {
+		return err
+	}
+	if err := database.QueueSpooledFileForSending(db, path, spoolpath, metadata, opts); err != nil {
+		_ = os.Remove(spoolpath)
+		return err
+	}
+	return nil
+}
+
+// Returns the metadata of the file along with its snapshot, the snapshot is private to the sender
+// so it doesn't carry the owner or mode of the file
+func (s *Spool) snapshot(path string, encrypted bool) (string, structs.Metadata, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", structs.Metadata{}, fmt.Errorf("error opening file: %v", err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", structs.Metadata{}, fmt.Errorf("error getting file info: %v", err)
+	}
+	metadata, err := filereader.ReadMetadata(path, info)
+	if err != nil {
+		return "", metadata, err
+	}
+
+	spoolpath := filepath.Join(s.dir, structs.NewTransferId().String())
+	staging := spoolpath + stagingSuffix
+	dst, err := os.OpenFile(staging, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", metadata, fmt.Errorf("error creating snapshot: %v", err)
+	}
+
+	if encrypted {
+		err = zip.ZipFile(dst, src)
+	} else if err = reflink(dst, src); err != nil {
+		_, err = io.Copy(dst, src)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(staging)
+		return "", metadata, fmt.Errorf("error writing snapshot: %v", err)
+	}
+	if err = os.Rename(staging, spoolpath); err != nil {
+		_ = os.Remove(staging)
+		return "", metadata, fmt.Errorf("error renaming snapshot: %v", err)
+	}
+	return spoolpath, metadata, nil
+}
+
+// Removes snapshots that no unfinished file refers to, such as ones left behind when the sender died
+// between finishing a file and removing its snapshot
+func (s *Spool) Clean(db *gorm.DB) error {
+	if s == nil {
+		return nil
+	}
+	var spoolpaths []string
+	err := db.Model(&database.File{}).
+		Where("finished = ? AND spool_path != ''", false).
+		Pluck("spool_path", &spoolpaths).Error
+	if err != nil {
+		return err
+	}
+	inuse := make(map[string]bool, len(spoolpaths))
+	for _, spoolpath := range spoolpaths {
+		inuse[spoolpath] = true
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		spoolpath := filepath.Join(s.dir, entry.Name())
+		if inuse[spoolpath] {
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), stagingSuffix) {
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < stagingExpiry {
+				continue
+			}
+		}
+		if err := os.Remove(spoolpath); err != nil {
+			logrus.Errorf("Failed removing stale snapshot '%s': %v", spoolpath, err)
+		} else {
+			logrus.Infof("Removed stale snapshot '%s'", spoolpath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package spool
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"oneway-filesync/pkg/database"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+func openDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AutoMigrate(&database.File{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestQueueFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	data := bytes.Repeat([]byte{1}, 10)
+	modtime := time.Unix(1666000000, 0)
+
+	tests := []struct {
+		name      string
+		path      string
+		limit     int64
+		queued    int // Snapshots already in the spool
+		opts      database.SendOptions
+		wantErr   error
+		wantSpool bool
+	}{
+		{"test-snapshot", path, 0, 0, database.SendOptions{}, nil, true},
+		{"test-encrypted", path, 0, 0, database.SendOptions{Encrypted: true}, nil, true},
+		{"test-fits", path, 25, 1, database.SendOptions{}, nil, true},
+		{"test-full", path, 25, 2, database.SendOptions{}, ErrSpoolFull, false},
+		{"test-larger-than-spool", path, 5, 0, database.SendOptions{}, nil, true},
+		{"test-directory", dir, 0, 0, database.SendOptions{}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path, data, 0640); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, modtime, modtime); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, 0640|os.ModeSetuid|os.ModeSticky); err != nil {
+				t.Fatal(err)
+			}
+			db := openDB(t)
+			sp, err := OpenSpool(filepath.Join(t.TempDir(), "spool"), tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.queued; i++ {
+				if err := os.WriteFile(filepath.Join(sp.dir, string(rune('a'+i))), data, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = sp.QueueFile(db, tt.path, tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("QueueFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var files []database.File
+			if err := db.Find(&files).Error; err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != nil {
+				if len(files) != 0 {
+					t.Fatalf("Queued %v while the spool is full", files)
+				}
+				return
+			}
+			if len(files) != 1 || (files[0].SpoolPath != "") != tt.wantSpool {
+				t.Fatalf("Queued %+v, want spooled %v", files, tt.wantSpool)
+			}
+			if !tt.wantSpool {
+				return
+			}
+
+			// The snapshot doesn't change along with the file
+			if err := os.WriteFile(path, []byte{2}, 0640); err != nil {
+				t.Fatal(err)
+			}
+			snapshot, err := os.ReadFile(files[0].SpoolPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.opts.Encrypted {
+				if !bytes.HasPrefix(snapshot, []byte("PK")) {
+					t.Fatalf("Snapshot of encrypted file isn't a zip")
+				}
+			} else if !bytes.Equal(snapshot, data) {
+				t.Fatalf("Snapshot = %v, want %v", snapshot, data)
+			}
+			// The snapshot belongs to the sender, the file is sent with the metadata it had when it was queued
+			metadata := files[0].SpoolMetadata
+			if metadata == nil || metadata.ModTime != modtime.UnixNano() {
+				t.Fatalf("Queued metadata %+v, want the ModTime %v of the file", metadata, modtime)
+			}
+			if runtime.GOOS != "windows" {
+				if metadata.Mode != uint32(0640|fs.ModeSetuid|fs.ModeSticky) {
+					t.Fatalf("Queued mode %o, want the setuid and sticky bits of the file", metadata.Mode)
+				}
+				if !metadata.HasOwner || int(metadata.Uid) != os.Getuid() {
+					t.Fatalf("Queued owner %d, want %d", metadata.Uid, os.Getuid())
+				}
+			}
+		})
+	}
+}
+
+func TestQueueFile_nil(t *testing.T) {
+	db := openDB(t)
+	sp, err := OpenSpool("", 0)
+	if err != nil || sp != nil {
+		t.Fatalf("OpenSpool() = %v, %v, want a nil spool", sp, err)
+	}
+	if err := sp.QueueFile(db, "spool.go", database.SendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var file database.File
+	if err := db.First(&file).Error; err != nil {
+		t.Fatal(err)
+	}
+	if file.SpoolPath != "" || file.SpoolMetadata != nil {
+		t.Fatalf("Queued %+v in the spool of a nil spool", file)
+	}
+	if err := sp.Clean(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClean(t *testing.T) {
+	db := openDB(t)
+	sp, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(name string, age time.Duration) string {
+		path := filepath.Join(sp.dir, name)
+		if err := os.WriteFile(path, []byte{1}, 0600); err != nil {
+			t.Fatal(err)
+		}
+		modtime := time.Now().Add(-age)
+		if err := os.Chtimes(path, modtime, modtime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	unfinished := entry("unfinished", 48*time.Hour)
+	finished := entry("finished", 0)
+	orphan := entry("orphan", 0)
+	staging := entry("new"+stagingSuffix, 0)
+	stalestaging := entry("old"+stagingSuffix, 2*stagingExpiry)
+	if err := db.Create(&database.File{Path: "a", SpoolPath: unfinished}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&database.File{Path: "b", SpoolPath: finished, Finished: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sp.Clean(db); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{unfinished: true, finished: false, orphan: false, staging: true, stalestaging: false} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Errorf("'%s' exists = %v, want %v", filepath.Base(path), err == nil, want)
+		}
+	}
+}
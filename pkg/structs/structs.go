@@ -2,10 +2,14 @@ package structs
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
-	"oneway-filesync/pkg/zip"
 	"os"
 	"time"
 
@@ -14,17 +18,11 @@ import (
 
 const HASHSIZE = sha256.Size
 
-func HashFile(f *os.File, encrypted bool) ([HASHSIZE]byte, error) {
+func HashFile(f *os.File) ([HASHSIZE]byte, error) {
 	var ret [HASHSIZE]byte
 	h := sha256.New()
 
-	var err error
-	if encrypted {
-		err = zip.ZipFile(h, f)
-	} else {
-		_, err = io.Copy(h, f)
-	}
-	if err != nil {
+	if _, err := io.Copy(h, f); err != nil {
 		return ret, err
 	}
 
@@ -33,73 +31,556 @@ func HashFile(f *os.File, encrypted bool) ([HASHSIZE]byte, error) {
 	return ret, nil
 }
 
+// Every datagram starts with a fixed header:
+//
+//	| Magic (4) | Version (1) | Type (1) | Flags (2) | Body | CRC32C (4, if FlagChecksum) |
+//
+// The magic lets the receiver discard anything that isn't ours and the version
+// lets the format change without breaking receivers that are already deployed.
+// Version 3 replaced the path and hash in every share with a transfer id and a manifest, the shares of version 2
+// and of the headerless version 1 before it are still decoded and mapped onto transfers
+// so the sender and the receiver can be upgraded separately.
+// Version 4 added the chunk hash lists, its other packets are those of version 3 which are still decoded
+// and received without verifying their chunks.
+const (
+	Magic           uint32 = 0x4F574653 // "OWFS"
+	ProtocolVersion uint8  = 4
+	HeaderSize             = 8
+
+	pathVersion     uint8 = 2 // Shares carry the path and hash of their file
+	transferVersion uint8 = 3 // Transfers without chunk hashes
+)
+
+// Header flags
+const (
+	FlagChecksum   uint16 = 1 << iota // Datagram ends with a CRC32C of everything before it
+	FlagCompressed                    // The chunk data was zstd compressed before being split into shares
+)
+
+const ChecksumSize = crc32.Size
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type PacketType uint8
+
+const (
+	PacketTypeShare    PacketType = 1 // Share of a chunk of file data
+	PacketTypeManifest PacketType = 2 // Share of the manifest describing a transfer
+	PacketTypeTrailer  PacketType = 3 // Share of the trailer marking the end of a transfer
+	PacketTypeHashList PacketType = 4 // Share of a part of the list of chunk hashes of a transfer
+)
+
+var (
+	ErrBadMagic           = errors.New("bad magic")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrUnknownPacketType  = errors.New("unknown packet type")
+	ErrMalformed          = errors.New("malformed packet")
+	ErrChecksum           = errors.New("checksum mismatch")
+)
+
+type Header struct {
+	Magic   uint32
+	Version uint8
+	Type    PacketType
+	Flags   uint16
+}
+
+func (h Header) encode(packer *binpacker.Packer) {
+	packer.PushUint32(h.Magic)
+	packer.PushUint8(h.Version)
+	packer.PushUint8(uint8(h.Type))
+	packer.PushUint16(h.Flags)
+}
+
+func decodeHeader(data []byte) (Header, error) {
+	var h Header
+	if len(data) < HeaderSize {
+		return h, ErrMalformed
+	}
+	h.Magic = binary.BigEndian.Uint32(data[0:4])
+	h.Version = data[4]
+	h.Type = PacketType(data[5])
+	h.Flags = binary.BigEndian.Uint16(data[6:8])
+	return h, nil
+}
+
+// Every file sent gets a random transfer id which all of its packets carry
+// This keeps the per share overhead fixed and tells apart concurrent transfers of identical files
+type TransferId [8]byte
+
+func NewTransferId() TransferId {
+	var id TransferId
+	_, _ = rand.Read(id[:]) // crypto/rand.Read never returns an error
+	return id
+}
+
+func (id TransferId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
 type Chunk struct {
-	Path        string
-	Hash        [32]byte // Not using the HASHSIZE const as it causes linting issues
-	Encrypted   bool
+	Type        PacketType
+	TransferId  TransferId
 	DataOffset  int64
 	DataPadding uint32
 	ShareIndex  uint32
+	Compressed  bool // Carried in the header flags
 	Data        []byte
-}
 
-var b2i = map[bool]byte{false: 0, true: 1}
+	Compress bool // Sender side only, asks the compressor stage to try compressing the data
 
-var i2b = [2]bool{false, true}
+	Legacy *LegacyFile // Receiver side only, set on the shares of version 1 and 2 senders
+}
 
-// Returns the percise overhead of a chunk
-// Dependant on path since it's the only variable-length field in a chunk
+// The percise overhead of a chunk: header, transferid(8) offset(8) padding(4) shareindex(4) and checksum
 // This value is required to ensure that every network chunk is of the configured size
-func ChunkOverhead(path string) int {
-	enc, _ := Chunk{Path: path}.Encode()
-	return len(enc)
-}
+const ChunkOverhead = HeaderSize + 8 + 8 + 4 + 4 + ChecksumSize
 
 // Encode chunk into binary buffer
 // No extravagant serialization library was used in order to be 100% what the overhead will be
 func (c Chunk) Encode() ([]byte, error) {
-	pathbytes := []byte(c.Path)
-
 	buffer := new(bytes.Buffer)
 	packer := binpacker.NewPacker(binary.BigEndian, buffer)
-	packer.PushUint32(uint32(len(pathbytes)))
-	packer.PushBytes(pathbytes)
-	packer.PushBytes(c.Hash[:])
-	packer.PushByte(b2i[c.Encrypted])
+	flags := FlagChecksum
+	if c.Compressed {
+		flags |= FlagCompressed
+	}
+	Header{Magic: Magic, Version: ProtocolVersion, Type: c.Type, Flags: flags}.encode(packer)
+	packer.PushBytes(c.TransferId[:])
 	packer.PushInt64(c.DataOffset)
 	packer.PushUint32(c.DataPadding)
 	packer.PushUint32(c.ShareIndex)
-	packer.PushUint32(uint32(len(c.Data)))
-	packer.PushBytes(c.Data)
+	packer.PushBytes(c.Data) // Data takes up the rest of the datagram
+	packer.PushUint32(crc32.Checksum(buffer.Bytes(), crc32c))
 
 	return buffer.Bytes(), packer.Error()
 }
 
 // Decode binary buffer into a Chunk object
+// Returns ErrBadMagic for datagrams that aren't ours, ErrUnsupportedVersion and ErrUnknownPacketType
+// for datagrams from a sender speaking a protocol we don't know, ErrChecksum for datagrams that were
+// corrupted on the way and ErrMalformed for truncated datagrams
 func DecodeChunk(data []byte) (Chunk, error) {
+	h, err := decodeHeader(data)
+	if err != nil || h.Magic != Magic {
+		return decodeLegacyChunk(data)
+	}
+	if h.Version != ProtocolVersion && h.Version != transferVersion && h.Version != pathVersion {
+		return Chunk{}, fmt.Errorf("%w %d", ErrUnsupportedVersion, h.Version)
+	}
+	if h.Flags&FlagChecksum != 0 {
+		if len(data) < HeaderSize+ChecksumSize {
+			return Chunk{}, ErrMalformed
+		}
+		body, checksum := data[:len(data)-ChecksumSize], data[len(data)-ChecksumSize:]
+		if crc32.Checksum(body, crc32c) != binary.BigEndian.Uint32(checksum) {
+			return Chunk{}, ErrChecksum
+		}
+		data = body
+	}
+	if h.Version == pathVersion {
+		if h.Type != PacketTypeShare {
+			return Chunk{}, fmt.Errorf("%w %d", ErrUnknownPacketType, h.Type)
+		}
+		return decodePathShare(data[HeaderSize:])
+	}
+	switch {
+	case h.Type == PacketTypeShare, h.Type == PacketTypeManifest, h.Type == PacketTypeTrailer:
+	case h.Type == PacketTypeHashList && h.Version == ProtocolVersion:
+	default:
+		return Chunk{}, fmt.Errorf("%w %d", ErrUnknownPacketType, h.Type)
+	}
+	c, err := decodeBody(data[HeaderSize:])
+	c.Type = h.Type
+	c.Compressed = h.Flags&FlagCompressed != 0
+	return c, err
+}
+
+func decodeBody(data []byte) (Chunk, error) {
 	var c Chunk
 
+	if len(data) < ChunkOverhead-HeaderSize-ChecksumSize {
+		return c, ErrMalformed
+	}
+
+	buffer := bytes.NewBuffer(data)
+	unpacker := binpacker.NewUnpacker(binary.BigEndian, buffer)
+	var id []byte
+	unpacker.FetchBytes(uint64(len(c.TransferId)), &id)
+	copy(c.TransferId[:], id)
+	unpacker.FetchInt64(&c.DataOffset)
+	unpacker.FetchUint32(&c.DataPadding)
+	unpacker.FetchUint32(&c.ShareIndex)
+	unpacker.FetchBytes(uint64(buffer.Len()), &c.Data)
+
+	return c, unpacker.Error()
+}
+
+// Version 1 and 2 senders send neither manifests nor trailers, every share carries the path and hash of its file instead
+// The receiver makes the transfer up from them, its manifest as soon as a share arrives
+// and its trailer once the file stops arriving, the way their receivers closed files
+type LegacyFile struct {
+	Path      string
+	Hash      [HASHSIZE]byte
+	Encrypted bool
+}
+
+// The same file sent again gets the same transfer id so its shares are merged like copies of a transfer
+func (f LegacyFile) TransferId() TransferId {
+	h := sha256.New()
+	h.Write([]byte(f.Path))
+	h.Write([]byte{0, b2i[f.Encrypted]})
+	h.Write(f.Hash[:])
+	var id TransferId
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// Version 1 and 2 senders send no metadata, files are given the mode their receivers left them with
+func (f LegacyFile) Manifest() Manifest {
+	return Manifest{Path: f.Path, Encrypted: f.Encrypted, Metadata: Metadata{Type: EntryFile, Mode: 0600}}
+}
+
+// There are no chunk hashes to verify the chunks against, only the hash of the whole file
+func (f LegacyFile) Trailer(size int64, chunkcount int64) Trailer {
+	return Trailer{Size: size, ChunkCount: chunkcount, Hash: f.Hash}
+}
+
+func decodePathShare(data []byte) (Chunk, error) {
+	var c Chunk
+	var f LegacyFile
+
+	// Fixed size fields: pathlen(4) hash(32) encrypted(1) offset(8) padding(4) shareindex(4)
+	const fixedsize = 4 + HASHSIZE + 1 + 8 + 4 + 4
+	if len(data) < fixedsize || int64(binary.BigEndian.Uint32(data)) > int64(len(data)-fixedsize) {
+		return c, ErrMalformed
+	}
+
 	buffer := bytes.NewBuffer(data)
 	unpacker := binpacker.NewUnpacker(binary.BigEndian, buffer)
-	unpacker.StringWithUint32Prefix(&c.Path)
+	unpacker.StringWithUint32Prefix(&f.Path)
 	var hashslice []byte
 	unpacker.FetchBytes(uint64(HASHSIZE), &hashslice)
-	copy(c.Hash[:], hashslice)
+	copy(f.Hash[:], hashslice)
 	var enc byte
 	unpacker.FetchByte(&enc)
-	c.Encrypted = i2b[enc]
+	f.Encrypted = enc != 0
 	unpacker.FetchInt64(&c.DataOffset)
 	unpacker.FetchUint32(&c.DataPadding)
 	unpacker.FetchUint32(&c.ShareIndex)
-	unpacker.BytesWithUint32Prefix(&c.Data)
+	unpacker.FetchBytes(uint64(buffer.Len()), &c.Data)
 
+	c.Type = PacketTypeShare
+	c.TransferId = f.TransferId()
+	c.Legacy = &f
 	return c, unpacker.Error()
 }
 
+// Decodes the headerless version 1 layout, the shares of version 2 with the length of their data and no header
+// Since it has no magic to go by the datagram has to be consumed exactly for it to be recognized
+func decodeLegacyChunk(data []byte) (Chunk, error) {
+	// Fixed size fields: pathlen(4) hash(32) encrypted(1) offset(8) padding(4) shareindex(4) datalen(4)
+	const fixedsize = 4 + HASHSIZE + 1 + 8 + 4 + 4 + 4
+	if len(data) < fixedsize || int64(binary.BigEndian.Uint32(data)) > int64(len(data)-fixedsize) {
+		return Chunk{}, ErrBadMagic
+	}
+	pathlen := int(binary.BigEndian.Uint32(data))
+	datalen := binary.BigEndian.Uint32(data[fixedsize-4+pathlen:])
+	if int64(datalen) != int64(len(data)-fixedsize-pathlen) {
+		return Chunk{}, ErrBadMagic
+	}
+	// Without the length of the data the rest is the layout of version 2
+	share := append(append([]byte{}, data[:fixedsize-4+pathlen]...), data[fixedsize+pathlen:]...)
+	return decodePathShare(share)
+}
+
+// What a transfer does to its path on the receiver
+type Op uint8
+
+const (
+	OpWrite  Op = iota // The data of the transfer is written to the path
+	OpDelete           // The path was removed on the sender, there is no data
+	OpRename           // The path was renamed to Target on the sender, there is no data
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpWrite:
+		return "write"
+	case OpDelete:
+		return "delete"
+	case OpRename:
+		return "rename"
+	default:
+		return fmt.Sprintf("op(%d)", uint8(op))
+	}
+}
+
+// What kind of entry is at the path of a transfer, only files carry data
+type EntryType uint8
+
+const (
+	EntryFile EntryType = iota
+	EntryDir
+	EntrySymlink
+)
+
+// The attributes of an entry that the receiver restores once it is written
+type Metadata struct {
+	Type       EntryType
+	Mode       uint32 // Permission bits along with the setuid, setgid and sticky bits of fs.FileMode
+	ModTime    int64  // Unix nanoseconds
+	HasOwner   bool   // Ownership isn't available on every platform
+	Uid        uint32
+	Gid        uint32
+	LinkTarget string
+}
+
+// The manifest describes a transfer, it is sent as its own FEC protected chunk
+// a few times during the transfer so that losing one copy doesn't lose the file
+type Manifest struct {
+	Path      string
+	Size      int64
+	Encrypted bool
+	Op        Op
+	Target    string // New path of a rename
+	Metadata  Metadata
+	Sequence  int64 // Orders the transfers of a path, the receiver skips one older than what it applied to the path, 0 is unordered
+}
+
+// Ops, directories and symlinks are described by the manifest alone
+func (m Manifest) HasData() bool {
+	return m.Op == OpWrite && m.Metadata.Type == EntryFile
+}
+
+func (m Manifest) Encode() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	packer := binpacker.NewPacker(binary.BigEndian, buffer)
+	packer.PushUint32(uint32(len(m.Path)))
+	packer.PushString(m.Path)
+	packer.PushInt64(m.Size)
+	packer.PushByte(b2i[m.Encrypted])
+	packer.PushByte(byte(m.Op))
+	packer.PushUint32(uint32(len(m.Target)))
+	packer.PushString(m.Target)
+	packer.PushByte(byte(m.Metadata.Type))
+	packer.PushUint32(m.Metadata.Mode)
+	packer.PushInt64(m.Metadata.ModTime)
+	packer.PushByte(b2i[m.Metadata.HasOwner])
+	packer.PushUint32(m.Metadata.Uid)
+	packer.PushUint32(m.Metadata.Gid)
+	packer.PushUint32(uint32(len(m.Metadata.LinkTarget)))
+	packer.PushString(m.Metadata.LinkTarget)
+	packer.PushInt64(m.Sequence)
+
+	return buffer.Bytes(), packer.Error()
+}
+
+// A length prefix has to fit in what is left of the buffer, a bogus one would otherwise be allocated as it is
+func prefixFits(buffer *bytes.Buffer) bool {
+	return buffer.Len() >= 4 && int64(binary.BigEndian.Uint32(buffer.Bytes())) <= int64(buffer.Len()-4)
+}
+
+func DecodeManifest(data []byte) (Manifest, error) {
+	var m Manifest
+
+	buffer := bytes.NewBuffer(data)
+	unpacker := binpacker.NewUnpacker(binary.BigEndian, buffer)
+	if !prefixFits(buffer) {
+		return m, ErrMalformed
+	}
+	unpacker.StringWithUint32Prefix(&m.Path)
+	unpacker.FetchInt64(&m.Size)
+	var enc byte
+	unpacker.FetchByte(&enc)
+	m.Encrypted = enc != 0
+	var op byte
+	unpacker.FetchByte(&op)
+	m.Op = Op(op)
+	if !prefixFits(buffer) {
+		return m, ErrMalformed
+	}
+	unpacker.StringWithUint32Prefix(&m.Target)
+	var entrytype, hasowner byte
+	unpacker.FetchByte(&entrytype)
+	m.Metadata.Type = EntryType(entrytype)
+	unpacker.FetchUint32(&m.Metadata.Mode)
+	unpacker.FetchInt64(&m.Metadata.ModTime)
+	unpacker.FetchByte(&hasowner)
+	m.Metadata.HasOwner = hasowner != 0
+	unpacker.FetchUint32(&m.Metadata.Uid)
+	unpacker.FetchUint32(&m.Metadata.Gid)
+	if !prefixFits(buffer) {
+		return m, ErrMalformed
+	}
+	unpacker.StringWithUint32Prefix(&m.Metadata.LinkTarget)
+	// Manifests of senders that didn't order their transfers end here
+	if buffer.Len() > 0 {
+		unpacker.FetchInt64(&m.Sequence)
+	}
+	if unpacker.Error() != nil {
+		return m, ErrMalformed
+	}
+	if m.Op > OpRename {
+		return m, fmt.Errorf("%w: unknown op %d", ErrMalformed, op)
+	}
+	if m.Metadata.Type > EntrySymlink {
+		return m, fmt.Errorf("%w: unknown entry type %d", ErrMalformed, entrytype)
+	}
+
+	return m, nil
+}
+
+// The trailer is sent a few times after the last chunk of a transfer,
+// it lets the receiver know when every chunk has been written so it can close the file right away
+// The hash is calculated over the exact bytes that were sent so it can only be known at the end
+type Trailer struct {
+	Size       int64 // Total bytes sent
+	ChunkCount int64
+	Hash       [HASHSIZE]byte
+}
+
+const trailerSize = 8 + 8 + HASHSIZE
+
+func (t Trailer) Encode() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	packer := binpacker.NewPacker(binary.BigEndian, buffer)
+	packer.PushInt64(t.Size)
+	packer.PushInt64(t.ChunkCount)
+	packer.PushBytes(t.Hash[:])
+
+	return buffer.Bytes(), packer.Error()
+}
+
+func DecodeTrailer(data []byte) (Trailer, error) {
+	var t Trailer
+
+	if len(data) != trailerSize {
+		return t, ErrMalformed
+	}
+
+	buffer := bytes.NewBuffer(data)
+	unpacker := binpacker.NewUnpacker(binary.BigEndian, buffer)
+	unpacker.FetchInt64(&t.Size)
+	unpacker.FetchInt64(&t.ChunkCount)
+	var hashslice []byte
+	unpacker.FetchBytes(uint64(HASHSIZE), &hashslice)
+	copy(t.Hash[:], hashslice)
+
+	return t, unpacker.Error()
+}
+
+// The hashes of the chunks of a transfer, split into parts that each fit in a chunk
+// Every window of chunks is led by a part with their hashes and no chunk count, so the receiver can check
+// every chunk as it arrives and drop the bad ones for a later copy to replace
+// After the data the full list follows, every part of it carries the chunk count and the merkle root of all the hashes,
+// so the receiver knows when it has all of them and a part that went bad on the way can't fail good chunks
+// Chunk i starts at offset i*ChunkSize
+type HashList struct {
+	First      int64 // Index of the chunk of the first hash
+	ChunkSize  int64
+	ChunkCount int64
+	MerkleRoot [HASHSIZE]byte
+	Hashes     [][HASHSIZE]byte
+}
+
+const HashListHeaderSize = 8 + 8 + 8 + HASHSIZE + 4
+
+func (h HashList) Encode() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	packer := binpacker.NewPacker(binary.BigEndian, buffer)
+	packer.PushInt64(h.First)
+	packer.PushInt64(h.ChunkSize)
+	packer.PushInt64(h.ChunkCount)
+	packer.PushBytes(h.MerkleRoot[:])
+	packer.PushUint32(uint32(len(h.Hashes)))
+	for _, hash := range h.Hashes {
+		packer.PushBytes(hash[:])
+	}
+
+	return buffer.Bytes(), packer.Error()
+}
+
+func DecodeHashList(data []byte) (HashList, error) {
+	var h HashList
+
+	if len(data) < HashListHeaderSize {
+		return h, ErrMalformed
+	}
+	count := binary.BigEndian.Uint32(data[HashListHeaderSize-4:])
+	if len(data) != HashListHeaderSize+int(count)*HASHSIZE {
+		return h, ErrMalformed
+	}
+	h.First = int64(binary.BigEndian.Uint64(data))
+	h.ChunkSize = int64(binary.BigEndian.Uint64(data[8:]))
+	h.ChunkCount = int64(binary.BigEndian.Uint64(data[16:]))
+	copy(h.MerkleRoot[:], data[24:])
+	if h.First < 0 || h.ChunkSize <= 0 || h.ChunkCount < 0 || (h.ChunkCount > 0 && h.First+int64(count) > h.ChunkCount) {
+		return h, ErrMalformed
+	}
+	h.Hashes = make([][HASHSIZE]byte, count)
+	for i := range h.Hashes {
+		copy(h.Hashes[i][:], data[HashListHeaderSize+i*HASHSIZE:])
+	}
+	return h, nil
+}
+
+// Leaves and inner nodes are hashed with a different prefix so neither can pass for the other,
+// a node without a sibling moves up a level as it is
+func MerkleRoot(leaves [][HASHSIZE]byte) [HASHSIZE]byte {
+	if len(leaves) == 0 {
+		return [HASHSIZE]byte{}
+	}
+	level := append([][HASHSIZE]byte(nil), leaves...)
+	for len(level) > 1 {
+		next := level[:0]
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{1})
+			h.Write(level[i][:])
+			h.Write(level[i+1][:])
+			var node [HASHSIZE]byte
+			copy(node[:], h.Sum(nil))
+			next = append(next, node)
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func ChunkHash(data []byte) [HASHSIZE]byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	var leaf [HASHSIZE]byte
+	copy(leaf[:], h.Sum(nil))
+	return leaf
+}
+
+// A range of bytes of a file
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+func (r ByteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Offset, r.Offset+r.Length)
+}
+
+var b2i = map[bool]byte{false: 0, true: 1}
+
 type OpenTempFile struct {
+	TransferId  TransferId
 	TempFile    string
-	Path        string
-	Hash        [HASHSIZE]byte
-	Encrypted   bool
+	StateFile   string    // Saved state of the transfer, removed once the file is closed successfully
+	Manifest    *Manifest // nil until the manifest arrives
+	Trailer     *Trailer  // nil until the trailer arrives
 	LastUpdated time.Time
+
+	Missing []ByteRange // Ranges of the file that weren't received when it was closed
+	Corrupt []ByteRange // Ranges of the file whose chunks failed their hash and weren't received again
 }
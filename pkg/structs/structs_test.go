@@ -1,9 +1,16 @@
 package structs_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"oneway-filesync/pkg/structs"
 	"reflect"
 	"testing"
+
+	"github.com/zhuangsirui/binpacker"
 )
 
 func TestChunk(t *testing.T) {
@@ -15,13 +22,21 @@ func TestChunk(t *testing.T) {
 		args args
 	}{
 		{"test", args{structs.Chunk{
-			Path:        "/tmp/abc",
-			Encrypted:   true,
+			Type:        structs.PacketTypeShare,
+			TransferId:  structs.NewTransferId(),
 			DataOffset:  17124124,
 			DataPadding: 5,
 			ShareIndex:  4,
 			Data:        make([]byte, 3000),
 		}}},
+		{"test-compressed", args{structs.Chunk{
+			Type:       structs.PacketTypeShare,
+			TransferId: structs.NewTransferId(),
+			DataOffset: 8192,
+			ShareIndex: 1,
+			Compressed: true,
+			Data:       []byte{1, 2, 3},
+		}}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -41,3 +56,327 @@ func TestChunk(t *testing.T) {
 		})
 	}
 }
+
+// Encodes a chunk in the headerless version 1 layout
+func encodeLegacy(path string, c structs.Chunk) []byte {
+	buffer := new(bytes.Buffer)
+	packer := binpacker.NewPacker(binary.BigEndian, buffer)
+	packer.PushUint32(uint32(len(path)))
+	packer.PushString(path)
+	packer.PushBytes(make([]byte, structs.HASHSIZE))
+	packer.PushByte(0)
+	packer.PushInt64(c.DataOffset)
+	packer.PushUint32(c.DataPadding)
+	packer.PushUint32(c.ShareIndex)
+	packer.PushUint32(uint32(len(c.Data)))
+	packer.PushBytes(c.Data)
+	return buffer.Bytes()
+}
+
+// Encodes a share in the version 2 layout, which carries the path and hash of its file
+func encodeVersion2(f structs.LegacyFile, c structs.Chunk) []byte {
+	buffer := new(bytes.Buffer)
+	packer := binpacker.NewPacker(binary.BigEndian, buffer)
+	packer.PushUint32(structs.Magic)
+	packer.PushUint8(2)
+	packer.PushUint8(uint8(structs.PacketTypeShare))
+	packer.PushUint16(structs.FlagChecksum)
+	packer.PushUint32(uint32(len(f.Path)))
+	packer.PushString(f.Path)
+	packer.PushBytes(f.Hash[:])
+	packer.PushByte(1)
+	packer.PushInt64(c.DataOffset)
+	packer.PushUint32(c.DataPadding)
+	packer.PushUint32(c.ShareIndex)
+	packer.PushBytes(c.Data)
+	packer.PushUint32(crc32.Checksum(buffer.Bytes(), crc32.MakeTable(crc32.Castagnoli)))
+	return buffer.Bytes()
+}
+
+func TestDecodeChunk_version2(t *testing.T) {
+	file := structs.LegacyFile{Path: "/tmp/abc", Hash: [structs.HASHSIZE]byte{1, 2, 3}, Encrypted: true}
+	data := encodeVersion2(file, structs.Chunk{DataOffset: 8192, DataPadding: 3, ShareIndex: 2, Data: []byte{4, 5, 6}})
+	want := structs.Chunk{
+		Type:        structs.PacketTypeShare,
+		TransferId:  file.TransferId(),
+		DataOffset:  8192,
+		DataPadding: 3,
+		ShareIndex:  2,
+		Data:        []byte{4, 5, 6},
+		Legacy:      &file,
+	}
+	got, err := structs.DecodeChunk(data)
+	if err != nil {
+		t.Fatalf("DecodeChunk() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeChunk() = %v, want %v", got, want)
+	}
+
+	// The transfer id tells files apart by path, content and encryption and nothing else
+	other := file
+	other.Path = "/tmp/def"
+	unencrypted := file
+	unencrypted.Encrypted = false
+	if file.TransferId() == other.TransferId() || file.TransferId() == unencrypted.TransferId() {
+		t.Errorf("Different files got the same transfer id")
+	}
+	again, err := structs.DecodeChunk(encodeVersion2(file, structs.Chunk{DataOffset: 0, Data: []byte{7}}))
+	if err != nil || again.TransferId != want.TransferId {
+		t.Errorf("Shares of the same file got transfer ids %v and %v, error = %v", want.TransferId, again.TransferId, err)
+	}
+
+	manifest := file.Manifest()
+	if manifest.Path != file.Path || !manifest.Encrypted || !manifest.HasData() || manifest.Metadata.Mode != 0600 {
+		t.Errorf("Manifest() = %v", manifest)
+	}
+
+	// Version 2 only ever sent shares
+	manifesttype := append([]byte{}, data...)
+	manifesttype[5] = uint8(structs.PacketTypeManifest)
+	checksum := manifesttype[len(manifesttype)-crc32.Size:]
+	binary.BigEndian.PutUint32(checksum, crc32.Checksum(manifesttype[:len(manifesttype)-crc32.Size], crc32.MakeTable(crc32.Castagnoli)))
+	if _, err := structs.DecodeChunk(manifesttype); !errors.Is(err, structs.ErrUnknownPacketType) {
+		t.Errorf("DecodeChunk() of a version 2 manifest error = %v, want %v", err, structs.ErrUnknownPacketType)
+	}
+	hugepath := encodeVersion2(structs.LegacyFile{Path: "a"}, structs.Chunk{})
+	binary.BigEndian.PutUint32(hugepath[structs.HeaderSize:], 0xffffffff)
+	binary.BigEndian.PutUint32(hugepath[len(hugepath)-crc32.Size:], crc32.Checksum(hugepath[:len(hugepath)-crc32.Size], crc32.MakeTable(crc32.Castagnoli)))
+	if _, err := structs.DecodeChunk(hugepath); !errors.Is(err, structs.ErrMalformed) {
+		t.Errorf("DecodeChunk() of a version 2 share with a bogus path length error = %v, want %v", err, structs.ErrMalformed)
+	}
+}
+
+// A share exactly as the headerless version 1 sender encoded it
+func TestDecodeChunk_version1(t *testing.T) {
+	data := []byte{
+		0x00, 0x00, 0x00, 0x04, '/', 't', 'm', 'p', // Path
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, // Hash
+		0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20,
+		0x01,                                           // Encrypted
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, // DataOffset
+		0x00, 0x00, 0x00, 0x01, // DataPadding
+		0x00, 0x00, 0x00, 0x03, // ShareIndex
+		0x00, 0x00, 0x00, 0x02, 0xaa, 0xbb, // Data
+	}
+	file := structs.LegacyFile{Path: "/tmp", Encrypted: true}
+	for i := range file.Hash {
+		file.Hash[i] = byte(i + 1)
+	}
+	want := structs.Chunk{
+		Type:        structs.PacketTypeShare,
+		TransferId:  file.TransferId(),
+		DataOffset:  8192,
+		DataPadding: 1,
+		ShareIndex:  3,
+		Data:        []byte{0xaa, 0xbb},
+		Legacy:      &file,
+	}
+	got, err := structs.DecodeChunk(data)
+	if err != nil {
+		t.Fatalf("DecodeChunk() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeChunk() = %v, want %v", got, want)
+	}
+	// A version 2 share of the same file belongs to the same transfer
+	version2, err := structs.DecodeChunk(encodeVersion2(file, structs.Chunk{DataOffset: 8192, Data: []byte{0xaa}}))
+	if err != nil || version2.TransferId != got.TransferId {
+		t.Errorf("Version 1 share got transfer id %v, version 2 share %v, error = %v", got.TransferId, version2.TransferId, err)
+	}
+
+	for _, bad := range [][]byte{data[:len(data)-1], append(append([]byte{}, data...), 0), {0x00, 0x00, 0x00, 0xff}} {
+		if _, err := structs.DecodeChunk(bad); !errors.Is(err, structs.ErrBadMagic) {
+			t.Errorf("DecodeChunk(%v) error = %v, want %v", bad, err, structs.ErrBadMagic)
+		}
+	}
+}
+
+func TestDecodeChunk(t *testing.T) {
+	chunk := structs.Chunk{Type: structs.PacketTypeManifest, TransferId: structs.NewTransferId(), DataOffset: 8192, ShareIndex: 2, Data: make([]byte, 100)}
+	current, err := chunk.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	futureversion := append([]byte{}, current...)
+	futureversion[4] = structs.ProtocolVersion + 1
+	unknowntype := append([]byte{}, current...)
+	unknowntype[5] = 0xff
+	checksum := unknowntype[len(unknowntype)-crc32.Size:]
+	binary.BigEndian.PutUint32(checksum, crc32.Checksum(unknowntype[:len(unknowntype)-crc32.Size], crc32.MakeTable(crc32.Castagnoli)))
+	corrupt := append([]byte{}, current...)
+	corrupt[len(corrupt)-crc32.Size-1] ^= 0x80
+	legacy := encodeLegacy("/tmp/abc", chunk)
+	legacyfile := structs.LegacyFile{Path: "/tmp/abc"}
+	legacychunk := structs.Chunk{Type: structs.PacketTypeShare, TransferId: legacyfile.TransferId(), DataOffset: chunk.DataOffset, ShareIndex: chunk.ShareIndex, Data: chunk.Data, Legacy: &legacyfile}
+	// Version 3 packets are those of version 4 without the hash lists
+	reencode := func(version uint8, packettype structs.PacketType) []byte {
+		data := append([]byte{}, current...)
+		data[4] = version
+		data[5] = uint8(packettype)
+		binary.BigEndian.PutUint32(data[len(data)-crc32.Size:], crc32.Checksum(data[:len(data)-crc32.Size], crc32.MakeTable(crc32.Castagnoli)))
+		return data
+	}
+	previousversion := reencode(structs.ProtocolVersion-1, structs.PacketTypeManifest)
+	previoushashlist := reencode(structs.ProtocolVersion-1, structs.PacketTypeHashList)
+	version1 := reencode(1, structs.PacketTypeManifest)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    structs.Chunk
+		wantErr error
+	}{
+		{"test-current", current, chunk, nil},
+		{"test-legacy", legacy, legacychunk, nil},
+		{"test-legacy-trailing-garbage", append(legacy, 0), structs.Chunk{}, structs.ErrBadMagic},
+		{"test-previous-version", previousversion, chunk, nil},
+		{"test-previous-version-hash-list", previoushashlist, structs.Chunk{}, structs.ErrUnknownPacketType},
+		{"test-version-1", version1, structs.Chunk{}, structs.ErrUnsupportedVersion},
+		{"test-garbage", bytes.Repeat([]byte{0xff}, 100), structs.Chunk{}, structs.ErrBadMagic},
+		{"test-empty", []byte{}, structs.Chunk{}, structs.ErrBadMagic},
+		{"test-future-version", futureversion, structs.Chunk{}, structs.ErrUnsupportedVersion},
+		{"test-unknown-type", unknowntype, structs.Chunk{}, structs.ErrUnknownPacketType},
+		{"test-corrupt", corrupt, structs.Chunk{}, structs.ErrChecksum},
+		{"test-truncated", current[:structs.HeaderSize+10], structs.Chunk{}, structs.ErrChecksum},
+		{"test-truncated-header", current[:structs.HeaderSize+2], structs.Chunk{}, structs.ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := structs.DecodeChunk(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DecodeChunk() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeChunk() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifest(t *testing.T) {
+	for _, manifest := range []structs.Manifest{
+		{Path: "/tmp/abc", Size: 1 << 40, Encrypted: true},
+		{Path: "/tmp/abc", Op: structs.OpDelete},
+		{Path: "/tmp/abc", Op: structs.OpRename, Target: "/tmp/def", Sequence: 1666000000123456789},
+		{Path: "/tmp/abc", Size: 12, Metadata: structs.Metadata{Mode: 0o4755, ModTime: 1666000000123456789, HasOwner: true, Uid: 1000, Gid: 100}},
+		{Path: "/tmp/abc", Metadata: structs.Metadata{Type: structs.EntryDir, Mode: 0o1777}},
+		{Path: "/tmp/abc", Metadata: structs.Metadata{Type: structs.EntrySymlink, Mode: 0o777, LinkTarget: "../def"}},
+	} {
+		buf, err := manifest.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := structs.DecodeManifest(buf)
+		if err != nil {
+			t.Fatalf("DecodeManifest() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, manifest) {
+			t.Errorf("DecodeManifest() = %v, want %v", got, manifest)
+		}
+		// Senders that don't order their transfers leave the sequence out
+		unordered := manifest
+		unordered.Sequence = 0
+		if got, err := structs.DecodeManifest(buf[:len(buf)-8]); err != nil || !reflect.DeepEqual(got, unordered) {
+			t.Errorf("DecodeManifest() without a sequence = %v, %v, want %v", got, err, unordered)
+		}
+
+		unknownop := append([]byte(nil), buf...)
+		unknownop[4+len(manifest.Path)+8+1] = 0xff
+		unknowntype := append([]byte(nil), buf...)
+		unknowntype[4+len(manifest.Path)+8+1+1+4+len(manifest.Target)] = 0xff
+		hugetarget := append([]byte(nil), buf...)
+		binary.BigEndian.PutUint32(hugetarget[4+len(manifest.Path)+8+1+1:], 0xffffffff)
+		for _, data := range [][]byte{{}, {0xff, 0xff, 0xff, 0xff}, buf[:len(buf)-1], unknownop, unknowntype, hugetarget} {
+			if _, err := structs.DecodeManifest(data); err == nil {
+				t.Errorf("DecodeManifest(%v) expected error", data)
+			}
+		}
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	trailer := structs.Trailer{Size: 1 << 40, ChunkCount: 12345, Hash: [structs.HASHSIZE]byte{1, 2, 3}}
+	buf, err := trailer.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := structs.DecodeTrailer(buf)
+	if err != nil {
+		t.Fatalf("DecodeTrailer() error = %v", err)
+	}
+	if got != trailer {
+		t.Errorf("DecodeTrailer() = %v, want %v", got, trailer)
+	}
+	if _, err := structs.DecodeTrailer(buf[:len(buf)-1]); err == nil {
+		t.Errorf("DecodeTrailer() of truncated trailer expected error")
+	}
+}
+
+func TestHashList(t *testing.T) {
+	hashlist := structs.HashList{First: 12, ChunkSize: 8192, ChunkCount: 20, MerkleRoot: [structs.HASHSIZE]byte{4, 5, 6}, Hashes: [][structs.HASHSIZE]byte{{1}, {2}, {3}}}
+	buf, err := hashlist.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := structs.DecodeHashList(buf)
+	if err != nil {
+		t.Fatalf("DecodeHashList() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, hashlist) {
+		t.Errorf("DecodeHashList() = %v, want %v", got, hashlist)
+	}
+
+	// The part leading a window of chunks has no chunk count
+	window := structs.HashList{First: 64, ChunkSize: 8192, Hashes: [][structs.HASHSIZE]byte{{1}}}
+	windowbuf, err := window.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := structs.DecodeHashList(windowbuf); err != nil || !reflect.DeepEqual(got, window) {
+		t.Errorf("DecodeHashList() = %v, %v, want %v", got, err, window)
+	}
+
+	zerochunksize := append([]byte(nil), buf...)
+	binary.BigEndian.PutUint64(zerochunksize[8:], 0)
+	hugecount := append([]byte(nil), buf...)
+	binary.BigEndian.PutUint32(hugecount[structs.HashListHeaderSize-4:], 0xffffffff)
+	pastcount := append([]byte(nil), buf...)
+	binary.BigEndian.PutUint64(pastcount[16:], 14)
+	negativecount := append([]byte(nil), buf...)
+	binary.BigEndian.PutUint64(negativecount[16:], 1<<63)
+	for _, data := range [][]byte{{}, buf[:len(buf)-1], append(buf, 0), zerochunksize, hugecount, pastcount, negativecount} {
+		if _, err := structs.DecodeHashList(data); !errors.Is(err, structs.ErrMalformed) {
+			t.Errorf("DecodeHashList(%v) error = %v, want %v", data, err, structs.ErrMalformed)
+		}
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	a, b, c := structs.ChunkHash([]byte{1}), structs.ChunkHash([]byte{2}), structs.ChunkHash([]byte{3})
+	node := func(l, r [structs.HASHSIZE]byte) [structs.HASHSIZE]byte {
+		return sha256.Sum256(append(append([]byte{1}, l[:]...), r[:]...))
+	}
+
+	tests := []struct {
+		name   string
+		leaves [][structs.HASHSIZE]byte
+		want   [structs.HASHSIZE]byte
+	}{
+		{"test-empty", nil, [structs.HASHSIZE]byte{}},
+		{"test-single", [][structs.HASHSIZE]byte{a}, a},
+		{"test-pair", [][structs.HASHSIZE]byte{a, b}, node(a, b)},
+		{"test-odd", [][structs.HASHSIZE]byte{a, b, c}, node(node(a, b), c)},
+		{"test-order", [][structs.HASHSIZE]byte{b, a, c}, node(node(b, a), c)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := structs.MerkleRoot(tt.leaves); got != tt.want {
+				t.Errorf("MerkleRoot() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+	if structs.ChunkHash([]byte{1}) == sha256.Sum256([]byte{1}) {
+		t.Errorf("ChunkHash() is a plain sha256, leaves could pass for nodes")
+	}
+}
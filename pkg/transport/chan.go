@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"net"
+	"sync"
+)
+
+// Carries datagrams between a sender and a receiver in the same process, for tests and embedding
+// Unlike a link it never loses a datagram, a sender blocks while the receiver is behind
+// and its datagrams are dropped once the receiver is closed
+type Chan struct {
+	datagrams chan []byte
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func NewChan(capacity int) *Chan {
+	return &Chan{
+		datagrams: make(chan []byte, capacity),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (c *Chan) Dial() (Sender, error) {
+	return &chanSender{c}, nil
+}
+
+func (c *Chan) Listen() (Receiver, error) {
+	return &chanReceiver{c}, nil
+}
+
+type chanSender struct {
+	c *Chan
+}
+
+func (s *chanSender) Write(b []byte) (int, error) {
+	datagram := append([]byte{}, b...) // The caller may reuse b
+	select {
+	case <-s.c.closed:
+		return 0, net.ErrClosed
+	case s.c.datagrams <- datagram:
+		return len(b), nil
+	}
+}
+
+func (s *chanSender) Close() error {
+	return nil
+}
+
+type chanReceiver struct {
+	c *Chan
+}
+
+func (r *chanReceiver) Read(b []byte) (int, error) {
+	select {
+	case <-r.c.closed:
+		return 0, net.ErrClosed
+	case datagram := <-r.c.datagrams:
+		return copy(b, datagram), nil
+	}
+}
+
+func (r *chanReceiver) Close() error {
+	r.c.once.Do(func() { close(r.c.closed) })
+	return nil
+}
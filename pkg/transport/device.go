@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// For serial diodes and anything else that shows up as a character device or a named pipe
+// The device carries a single stream so all of the sender workers share one sender that writes whole frames at a time
+// A serial device has to be set up beforehand, such as with `stty raw` and the link's baud rate
+type Device struct {
+	path   string
+	sender *streamSender
+}
+
+func NewDevice(path string) *Device {
+	d := &Device{path: path}
+	d.sender = &streamSender{open: func() (io.WriteCloser, error) {
+		// Opening a named pipe no one reads fails right away instead of blocking until someone does
+		return os.OpenFile(d.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	}}
+	return d
+}
+
+func (d *Device) Dial() (Sender, error) {
+	return &deviceSender{d.sender}, nil
+}
+
+// Workers close their sender as they stop, the device stays open for the others
+type deviceSender struct {
+	*streamSender
+}
+
+func (s *deviceSender) Close() error {
+	return nil
+}
+
+func (d *Device) Listen() (Receiver, error) {
+	// Checked here so a wrong path is reported up front, the device is opened again by the reading goroutine
+	if _, err := os.Stat(d.path); err != nil {
+		return nil, err
+	}
+	receiver := newStreamReceiver(nil)
+	go func() {
+		for {
+			file, err := os.OpenFile(d.path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+			if err == nil {
+				err = receiver.readStream(&deviceReader{file, receiver.closed})
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.Errorf("Error reading from device '%s': %v", d.path, err)
+			select {
+			case <-receiver.closed:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	return receiver, nil
+}
+
+// A named pipe reads as ended whenever it has no writer, the device is kept open
+// and read again until the next writer shows up so a writer always finds it open
+type deviceReader struct {
+	*os.File
+	closed chan struct{}
+}
+
+func (r *deviceReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.File.Read(b)
+		if n > 0 || !errors.Is(err, io.EOF) {
+			return n, err
+		}
+		select {
+		case <-r.closed:
+			return 0, net.ErrClosed
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
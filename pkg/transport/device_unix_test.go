@@ -0,0 +1,23 @@
+//go:build unix
+
+package transport
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDevice_fifo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "diode")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, NewDevice(path))
+}
+
+func TestDevice_missing(t *testing.T) {
+	if _, err := NewDevice(filepath.Join(t.TempDir(), "missing")).Listen(); err == nil {
+		t.Fatal("Listen() on a missing device succeeded")
+	}
+}
@@ -0,0 +1,232 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"oneway-filesync/pkg/structs"
+	"sync"
+)
+
+// What the link simulator does to the datagrams crossing it, the rates are chances per datagram
+type Impairments struct {
+	Seed         int64   // The same seed impairs the same datagrams the same way whatever order they are sent in
+	Loss         float64 // Datagrams lost on their own
+	BurstRate    float64 // Chance a burst of loss starts at a datagram
+	BurstLength  int     // Shares of a chunk lost in a row once a burst starts
+	Duplicate    float64 // Datagrams that arrive twice
+	Reorder      float64 // Datagrams held back and let through after the next ReorderDepth datagrams
+	ReorderDepth int
+	Corrupt      float64 // Datagrams with a random bit flipped
+}
+
+// Counts of what the link simulator did so far
+type LinkStats struct {
+	Sent       uint64
+	Lost       uint64
+	Duplicated uint64
+	Reordered  uint64
+	Corrupted  uint64
+}
+
+func (s LinkStats) String() string {
+	return fmt.Sprintf("%d sent, %d lost, %d duplicated, %d reordered, %d corrupted", s.Sent, s.Lost, s.Duplicated, s.Reordered, s.Corrupted)
+}
+
+// Simulates a lossy link on the sending end of another transport, usually a Chan in tests
+// The fate of every datagram is drawn from a hash of the seed, the datagram and how many times the same datagram
+// crossed the link before, so the sender's workers racing each other don't change which datagrams are impaired
+// A chunk is known by its type, offset and share index alone, its transfer id and data change from run to run
+// A burst that starts at a share takes the shares of the same chunk that follow it, as they would be lost back to back
+// without interleaving, whatever arrives in between, other datagrams only lose themselves to a burst
+// Held back datagrams are let through by later ones or when the sender closes, so reordering loses nothing
+// The link remembers a hash of every datagram it saw, it is meant for tests
+type Lossy struct {
+	inner       Transport
+	impairments Impairments
+	lock        sync.Mutex
+	seen        map[[sha256.Size]byte]uint64 // Times each datagram, by its identity, crossed the link
+	held        []heldDatagram
+	stats       LinkStats
+}
+
+type heldDatagram struct {
+	datagram []byte
+	left     int // Datagrams to let through before this one
+}
+
+func NewLossy(inner Transport, impairments Impairments) *Lossy {
+	return &Lossy{
+		inner:       inner,
+		impairments: impairments,
+		seen:        make(map[[sha256.Size]byte]uint64),
+	}
+}
+
+// The draws for one datagram, a splitmix64 sequence started from its hash
+type draws uint64
+
+func newDraws(seed int64, id [sha256.Size]byte, copies uint64) *draws {
+	var prefix [16]byte
+	binary.BigEndian.PutUint64(prefix[:], uint64(seed))
+	binary.BigEndian.PutUint64(prefix[8:], copies)
+	h := sha256.New()
+	h.Write(prefix[:])
+	h.Write(id[:])
+	d := draws(binary.BigEndian.Uint64(h.Sum(nil)))
+	return &d
+}
+
+// What makes a datagram the same datagram across runs, datagrams that aren't chunks are known by their bytes
+func identity(datagram []byte) ([sha256.Size]byte, *structs.Chunk) {
+	chunk, err := structs.DecodeChunk(datagram)
+	if err != nil {
+		return sha256.Sum256(datagram), nil
+	}
+	return shareIdentity(chunk.Type, chunk.DataOffset, chunk.ShareIndex), &chunk
+}
+
+func shareIdentity(packettype structs.PacketType, offset int64, index uint32) [sha256.Size]byte {
+	var id [1 + 8 + 4]byte
+	id[0] = byte(packettype)
+	binary.BigEndian.PutUint64(id[1:], uint64(offset))
+	binary.BigEndian.PutUint32(id[9:], index)
+	return sha256.Sum256(id[:])
+}
+
+func (d *draws) next() uint64 {
+	*d += 0x9e3779b97f4a7c15
+	z := uint64(*d)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (d *draws) float64() float64 {
+	return float64(d.next()>>11) / (1 << 53)
+}
+
+// Whether a burst starts at the copy of the datagram with this identity, the second of its draws
+func (l *Lossy) burstStarts(id [sha256.Size]byte, copies uint64) bool {
+	draw := newDraws(l.impairments.Seed, id, copies)
+	draw.next()
+	return draw.float64() < l.impairments.BurstRate
+}
+
+// Whether a burst started at the share or at one of the BurstLength-1 shares of its chunk before it
+func (l *Lossy) inBurst(id [sha256.Size]byte, chunk *structs.Chunk, copies uint64) bool {
+	if chunk == nil {
+		return l.burstStarts(id, copies)
+	}
+	for i := 0; i == 0 || i < l.impairments.BurstLength && uint32(i) <= chunk.ShareIndex; i++ {
+		if l.burstStarts(shareIdentity(chunk.Type, chunk.DataOffset, chunk.ShareIndex-uint32(i)), copies) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Lossy) Stats() LinkStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.stats
+}
+
+func (l *Lossy) Dial() (Sender, error) {
+	inner, err := l.inner.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return &lossySender{link: l, inner: inner}, nil
+}
+
+func (l *Lossy) Listen() (Receiver, error) {
+	return l.inner.Listen()
+}
+
+type lossySender struct {
+	link  *Lossy
+	inner Sender
+}
+
+// Decides the fate of a datagram, returns the datagrams to pass on in its place
+// Must be called with l.lock held
+func (l *Lossy) impair(datagram []byte) [][]byte {
+	imp := l.impairments
+	l.stats.Sent++
+	id, chunk := identity(datagram)
+	copies := l.seen[id]
+	l.seen[id]++
+	draw := newDraws(imp.Seed, id, copies)
+	// Every decision draws whatever the earlier ones were so the draws line up across runs
+	lost := draw.float64() < imp.Loss
+	draw.next() // Whether a burst starts here, see burstStarts
+	duplicate := draw.float64() < imp.Duplicate
+	reorder := draw.float64() < imp.Reorder
+	corrupt := draw.float64() < imp.Corrupt
+	bit := int(draw.next() % uint64(8*len(datagram)))
+
+	// Whatever was held back lets one more datagram through, lost or not
+	var out [][]byte
+	held := l.held[:0]
+	for _, h := range l.held {
+		if h.left--; h.left < 0 {
+			out = append(out, h.datagram)
+		} else {
+			held = append(held, h)
+		}
+	}
+	l.held = held
+
+	if imp.BurstRate > 0 && l.inBurst(id, chunk, copies) {
+		lost = true
+	}
+	if lost {
+		l.stats.Lost++
+		return out
+	}
+
+	datagram = append([]byte{}, datagram...) // The caller may reuse it
+	if corrupt {
+		l.stats.Corrupted++
+		datagram[bit/8] ^= 1 << (bit % 8)
+	}
+	if reorder && imp.ReorderDepth > 0 {
+		l.stats.Reordered++
+		l.held = append(l.held, heldDatagram{datagram: datagram, left: imp.ReorderDepth})
+	} else {
+		out = append(out, datagram)
+	}
+	if duplicate {
+		l.stats.Duplicated++
+		out = append(out, datagram)
+	}
+	return out
+}
+
+// A datagram lost on the link isn't an error, just like with UDP
+func (s *lossySender) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return s.inner.Write(b)
+	}
+	s.link.lock.Lock()
+	defer s.link.lock.Unlock()
+	for _, datagram := range s.link.impair(b) {
+		if _, err := s.inner.Write(datagram); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Lets through whatever is still held back
+func (s *lossySender) Close() error {
+	s.link.lock.Lock()
+	held := s.link.held
+	s.link.held = nil
+	s.link.lock.Unlock()
+	for _, h := range held {
+		_, _ = s.inner.Write(h.datagram)
+	}
+	return s.inner.Close()
+}
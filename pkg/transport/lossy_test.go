@@ -0,0 +1,213 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"oneway-filesync/pkg/structs"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func inOrder(n int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+func numbered(t *testing.T, i int) []byte {
+	datagram := make([]byte, 16)
+	binary.BigEndian.PutUint64(datagram, uint64(i))
+	return datagram
+}
+
+// The shares of chunks of ten shares each, numbered in their data
+func numberedShare(t *testing.T, i int) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(i))
+	datagram, err := structs.Chunk{Type: structs.PacketTypeShare, DataOffset: int64(i / 10 * 8192), ShareIndex: uint32(i % 10), Data: data}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return datagram
+}
+
+// Sends the datagrams made in the order given over a link with the impairments and returns what arrived
+func sendOverLossy(t *testing.T, order []int, impairments Impairments, datagram func(*testing.T, int) []byte) ([][]byte, LinkStats) {
+	n := len(order)
+	link := NewLossy(NewChan(4*n), impairments)
+	receiver, err := link.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sender, err := link.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range order {
+		if _, err := sender.Write(datagram(t, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Lets the datagrams still held back through
+	if err := sender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stats := link.Stats()
+	var received [][]byte
+	buf := make([]byte, 100)
+	for i := uint64(0); i < stats.Sent-stats.Lost+stats.Duplicated; i++ {
+		n, err := receiver.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, append([]byte{}, buf[:n]...))
+	}
+	return received, stats
+}
+
+func TestLossy_seed(t *testing.T) {
+	impairments := Impairments{Seed: 7, Loss: 0.1, BurstRate: 0.01, BurstLength: 10, Duplicate: 0.05, Reorder: 0.05, ReorderDepth: 3, Corrupt: 0.05}
+	first, firststats := sendOverLossy(t, inOrder(1000), impairments, numberedShare)
+	again, againstats := sendOverLossy(t, inOrder(1000), impairments, numberedShare)
+	if !reflect.DeepEqual(first, again) || firststats != againstats {
+		t.Fatalf("The same seed impaired the link differently: %v and %v", firststats, againstats)
+	}
+	impairments.Seed = 8
+	other, _ := sendOverLossy(t, inOrder(1000), impairments, numberedShare)
+	if reflect.DeepEqual(first, other) {
+		t.Fatalf("Different seeds impaired the link the same way")
+	}
+}
+
+// The sender's workers race each other, which datagrams are impaired mustn't depend on the order they reach the link
+func TestLossy_seed_order(t *testing.T) {
+	impairments := Impairments{Seed: 7, Loss: 0.1, BurstRate: 0.01, BurstLength: 4, Duplicate: 0.05, Reorder: 0.05, ReorderDepth: 3, Corrupt: 0.05}
+	order := inOrder(1000)
+	first, firststats := sendOverLossy(t, order, impairments, numberedShare)
+	rand.New(rand.NewSource(1)).Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	shuffled, shuffledstats := sendOverLossy(t, order, impairments, numberedShare)
+
+	sorted := func(datagrams [][]byte) [][]byte {
+		sort.Slice(datagrams, func(i, j int) bool { return bytes.Compare(datagrams[i], datagrams[j]) < 0 })
+		return datagrams
+	}
+	if !reflect.DeepEqual(sorted(first), sorted(shuffled)) || firststats != shuffledstats {
+		t.Fatalf("The same seed impaired the link differently in another order: %v and %v", firststats, shuffledstats)
+	}
+}
+
+// Every run sends its chunks under a new transfer id, a chunk is impaired the same way in all of them
+func TestLossy_seed_transfers(t *testing.T) {
+	impairments := Impairments{Seed: 7, Loss: 0.2, Duplicate: 0.1}
+	var sent [2]LinkStats
+	var lost [2][]bool
+	for run := range sent {
+		link := NewLossy(NewChan(4000), impairments)
+		sender, err := link.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		transferid := structs.NewTransferId()
+		for i := 0; i < 1000; i++ {
+			datagram, err := structs.Chunk{Type: structs.PacketTypeShare, TransferId: transferid, DataOffset: int64(i / 10 * 8192), ShareIndex: uint32(i % 10), Data: []byte{byte(run), byte(i)}}.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := link.Stats().Lost
+			if _, err := sender.Write(datagram); err != nil {
+				t.Fatal(err)
+			}
+			lost[run] = append(lost[run], link.Stats().Lost != before)
+		}
+		sender.Close()
+		sent[run] = link.Stats()
+	}
+	if !reflect.DeepEqual(lost[0], lost[1]) || sent[0] != sent[1] {
+		t.Fatalf("The same seed impaired the chunks of two transfers differently: %v and %v", sent[0], sent[1])
+	}
+}
+
+func TestLossy_impairments(t *testing.T) {
+	n := 10000
+	tests := []struct {
+		name        string
+		impairments Impairments
+		check       func(received [][]byte, stats LinkStats) bool
+	}{
+		{"test-none", Impairments{}, func(received [][]byte, stats LinkStats) bool {
+			return len(received) == n && stats == LinkStats{Sent: uint64(n)}
+		}},
+		{"test-loss", Impairments{Loss: 0.1}, func(received [][]byte, stats LinkStats) bool {
+			return stats.Lost > 800 && stats.Lost < 1200 && len(received) == n-int(stats.Lost)
+		}},
+		{"test-duplicate", Impairments{Duplicate: 0.1}, func(received [][]byte, stats LinkStats) bool {
+			return stats.Duplicated > 800 && len(received) == n+int(stats.Duplicated)
+		}},
+		{"test-reorder", Impairments{Reorder: 0.1, ReorderDepth: 5}, func(received [][]byte, stats LinkStats) bool {
+			late := 0
+			for i := 1; i < len(received); i++ {
+				if binary.BigEndian.Uint64(received[i]) < binary.BigEndian.Uint64(received[i-1]) {
+					late++
+				}
+			}
+			return stats.Reordered > 800 && late > 0
+		}},
+		{"test-corrupt", Impairments{Corrupt: 0.1}, func(received [][]byte, stats LinkStats) bool {
+			corrupted := 0
+			for i, datagram := range received {
+				want := make([]byte, 16)
+				binary.BigEndian.PutUint64(want, uint64(i))
+				if !bytes.Equal(datagram, want) {
+					corrupted++
+				}
+			}
+			return stats.Corrupted > 800 && corrupted == int(stats.Corrupted)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.impairments.Seed = 1
+			received, stats := sendOverLossy(t, inOrder(n), tt.impairments, numbered)
+			if !tt.check(received, stats) {
+				t.Fatalf("Link didn't impair as configured, %d datagrams arrived: %v", len(received), stats)
+			}
+		})
+	}
+}
+
+func TestLossy_burst(t *testing.T) {
+	n := 10000
+	received, stats := sendOverLossy(t, inOrder(n), Impairments{Seed: 1, BurstRate: 0.01, BurstLength: 4}, numberedShare)
+	arrived := make([]bool, n)
+	for _, datagram := range received {
+		chunk, err := structs.DecodeChunk(datagram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		arrived[binary.BigEndian.Uint64(chunk.Data)] = true
+	}
+	// The shares of a chunk are lost in runs of a burst, unless the run reaches the last share
+	bursts := 0
+	for i := 0; i < n; {
+		if arrived[i] {
+			i++
+			continue
+		}
+		start := i
+		for i < n && !arrived[i] && (i == start || i%10 != 0) {
+			i++
+		}
+		if i-start < 4 && i%10 != 0 {
+			t.Fatalf("Lost a run of %d shares from share %d, want bursts of 4", i-start, start)
+		}
+		bursts++
+	}
+	if bursts < 50 || stats.Lost != uint64(n-len(received)) {
+		t.Fatalf("Link didn't impair as configured, %d datagrams arrived: %v", len(received), stats)
+	}
+}
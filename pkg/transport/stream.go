@@ -0,0 +1,186 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Byte stream transports carry every datagram in a frame of a marker, its length and the datagram
+// A serial link may drop or garble bytes so a reader that loses its place in the stream
+// skips ahead to the next marker, datagrams garbled in the meantime fail their checksum on the receiver
+var frameMarker = [2]byte{0xa5, 0x5a}
+
+const (
+	frameHeaderSize = 6
+	maxFrameSize    = 1 << 20
+)
+
+var errFrameTooLong = errors.New("datagram too long for a frame")
+
+func encodeFrame(datagram []byte) ([]byte, error) {
+	if len(datagram) == 0 || len(datagram) > maxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", errFrameTooLong, len(datagram))
+	}
+	frame := make([]byte, frameHeaderSize+len(datagram))
+	copy(frame, frameMarker[:])
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(datagram)))
+	copy(frame[frameHeaderSize:], datagram)
+	return frame, nil
+}
+
+// Returns the next frame's datagram and the number of bytes skipped to find it
+func readFrame(r *bufio.Reader) ([]byte, int, error) {
+	skipped := 0
+	for {
+		header, err := r.Peek(frameHeaderSize)
+		if err != nil {
+			return nil, skipped, err
+		}
+		length := binary.BigEndian.Uint32(header[2:])
+		if header[0] != frameMarker[0] || header[1] != frameMarker[1] || length == 0 || length > maxFrameSize {
+			_, _ = r.Discard(1)
+			skipped++
+			continue
+		}
+		_, _ = r.Discard(frameHeaderSize)
+		datagram := make([]byte, length)
+		if _, err := io.ReadFull(r, datagram); err != nil {
+			return nil, skipped, err
+		}
+		return datagram, skipped, nil
+	}
+}
+
+// Writes a frame per datagram to a stream it opens on first use,
+// a stream that fails is closed and opened again for the next datagram
+type streamSender struct {
+	lock   sync.Mutex
+	open   func() (io.WriteCloser, error)
+	stream io.WriteCloser
+}
+
+func (s *streamSender) Write(b []byte) (int, error) {
+	frame, err := encodeFrame(b)
+	if err != nil {
+		return 0, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stream == nil {
+		if s.stream, err = s.open(); err != nil {
+			s.stream = nil
+			return 0, err
+		}
+	}
+	// A frame is written whole or the stream is dropped, so a partial frame is never followed by another
+	if _, err := s.stream.Write(frame); err != nil {
+		s.stream.Close()
+		s.stream = nil
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *streamSender) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stream == nil {
+		return nil
+	}
+	err := s.stream.Close()
+	s.stream = nil
+	return err
+}
+
+// Hands out the datagrams its streams read, every stream is read by a goroutine of its own
+type streamReceiver struct {
+	datagrams chan []byte
+	closed    chan struct{}
+	once      sync.Once
+	lock      sync.Mutex
+	streams   map[io.Closer]bool
+	onClose   func() error
+}
+
+func newStreamReceiver(onClose func() error) *streamReceiver {
+	return &streamReceiver{
+		datagrams: make(chan []byte, 100),
+		closed:    make(chan struct{}),
+		streams:   make(map[io.Closer]bool),
+		onClose:   onClose,
+	}
+}
+
+// Reads frames from stream until it ends or fails, returns the error it ended with
+// Returns net.ErrClosed if the receiver was closed
+func (r *streamReceiver) readStream(stream io.ReadCloser) error {
+	r.lock.Lock()
+	select {
+	case <-r.closed:
+		r.lock.Unlock()
+		stream.Close()
+		return net.ErrClosed
+	default:
+	}
+	r.streams[stream] = true
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		delete(r.streams, stream)
+		r.lock.Unlock()
+		stream.Close()
+	}()
+
+	reader := bufio.NewReaderSize(stream, 64*1024)
+	for {
+		datagram, skipped, err := readFrame(reader)
+		if skipped > 0 {
+			logrus.Warnf("Skipped %d bytes of a stream to find the next frame", skipped)
+		}
+		if err != nil {
+			select {
+			case <-r.closed:
+				return net.ErrClosed
+			default:
+				return err
+			}
+		}
+		select {
+		case <-r.closed:
+			return net.ErrClosed
+		case r.datagrams <- datagram:
+		}
+	}
+}
+
+func (r *streamReceiver) Read(b []byte) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, net.ErrClosed
+	case datagram := <-r.datagrams:
+		return copy(b, datagram), nil
+	}
+}
+
+func (r *streamReceiver) Close() error {
+	var err error
+	r.once.Do(func() {
+		r.lock.Lock()
+		close(r.closed)
+		for stream := range r.streams {
+			stream.Close()
+		}
+		r.lock.Unlock()
+		if r.onClose != nil {
+			err = r.onClose()
+		}
+	})
+	return err
+}
@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// For diodes that take TCP on the low side and deliver it from a proxy on the high side
+// Every sender worker keeps a connection of its own and the receiver reads from every connection it accepts
+type TCP struct {
+	address string
+}
+
+func NewTCP(address string) *TCP {
+	return &TCP{address: address}
+}
+
+func (t *TCP) Dial() (Sender, error) {
+	return &streamSender{open: func() (io.WriteCloser, error) {
+		return net.DialTimeout("tcp", t.address, 5*time.Second)
+	}}, nil
+}
+
+func (t *TCP) Listen() (Receiver, error) {
+	listener, err := net.Listen("tcp", t.address)
+	if err != nil {
+		return nil, err
+	}
+	receiver := newStreamReceiver(listener.Close)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logrus.Errorf("Error accepting connection: %v", err)
+					receiver.Close()
+				}
+				return
+			}
+			go func() {
+				if err := receiver.readStream(conn); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					logrus.Warnf("Connection from %s failed: %v", conn.RemoteAddr(), err)
+				}
+			}()
+		}
+	}()
+	return receiver, nil
+}
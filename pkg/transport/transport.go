@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"oneway-filesync/pkg/config"
+	"strconv"
+)
+
+// A transport carries datagrams one way, from the sender across the diode to the receiver
+type Transport interface {
+	// Opens a sending end, every sender worker opens its own
+	Dial() (Sender, error)
+	// Opens the receiving end, the receiver workers all read from it
+	Listen() (Receiver, error)
+}
+
+// Every Write sends a single datagram, a datagram that couldn't be sent is lost like it would be on the link
+type Sender interface {
+	io.WriteCloser
+}
+
+// Every Read returns a single datagram, the part of it that doesn't fit the buffer is discarded
+// Once closed Read returns net.ErrClosed
+type Receiver interface {
+	io.ReadCloser
+}
+
+// The backends config.Config.Transport picks from
+const (
+	TransportUDP    = "udp"    // A datagram per UDP datagram to ReceiverIP:ReceiverPort
+	TransportTCP    = "tcp"    // Length prefixed datagrams over TCP to ReceiverIP:ReceiverPort, for diodes that proxy TCP
+	TransportDevice = "device" // Length prefixed datagrams over TransportDevice, a character device or named pipe
+)
+
+func ValidateTransport(transport string) error {
+	switch transport {
+	case TransportUDP, TransportTCP, TransportDevice, "":
+		return nil
+	default:
+		return fmt.Errorf("unknown transport '%s'", transport)
+	}
+}
+
+// Creates the transport config.Config names, UDP is the default
+func New(conf config.Config) (Transport, error) {
+	if err := ValidateTransport(conf.Transport); err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(conf.ReceiverIP, strconv.Itoa(conf.ReceiverPort))
+	switch conf.Transport {
+	case TransportTCP:
+		return NewTCP(address), nil
+	case TransportDevice:
+		if conf.TransportDevice == "" {
+			return nil, fmt.Errorf("transport '%s' requires TransportDevice", conf.Transport)
+		}
+		return NewDevice(conf.TransportDevice), nil
+	default:
+		return NewUDP(address, UDPOptions{
+			BatchSize:  conf.UdpBatchSize,
+			Offload:    conf.UdpOffload,
+			Sockets:    conf.UdpSockets,
+			ReadBuffer: conf.UdpReadBuffer,
+		}), nil
+	}
+}
@@ -0,0 +1,219 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"oneway-filesync/pkg/config"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func randint(max int64) int {
+	nBig, err := rand.Int(rand.Reader, big.NewInt(max))
+	if err != nil {
+		panic(err)
+	}
+	return int(nBig.Int64())
+}
+
+func localAddress() string {
+	return fmt.Sprintf("127.0.0.1:%d", randint(30000)+30000)
+}
+
+func datagrams() [][]byte {
+	var datagrams [][]byte
+	for _, size := range []int{1, 100, 8192, 3, 5000, 1000, 1000, 1000, 1000} {
+		datagram := make([]byte, size)
+		_, _ = rand.Read(datagram)
+		datagrams = append(datagrams, datagram)
+	}
+	return datagrams
+}
+
+// Sends the datagrams over tr and checks that they arrive whole and in order
+func roundTrip(t *testing.T, tr Transport) {
+	receiver, err := tr.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sender, err := tr.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	sent := datagrams()
+	received := make(chan []byte, len(sent))
+	go func() {
+		if batcher, ok := receiver.(BatchReceiver); ok {
+			batch := batcher.NewBatch(16 * 1024)
+			for {
+				datagrams, err := batch.Read()
+				if err != nil {
+					return
+				}
+				for _, datagram := range datagrams {
+					received <- append([]byte{}, datagram...)
+				}
+			}
+		}
+		buf := make([]byte, 16*1024)
+		for {
+			n, err := receiver.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- append([]byte{}, buf[:n]...)
+		}
+	}()
+	if batcher, ok := sender.(BatchSender); ok {
+		if n, err := batcher.WriteBatch(sent); err != nil || n != len(sent) {
+			t.Fatalf("WriteBatch() = %d, error = %v, want %d", n, err, len(sent))
+		}
+	} else {
+		for _, datagram := range sent {
+			// The receiving end of a stream may still be coming up
+			for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+				_, err := sender.Write(datagram)
+				if err == nil {
+					break
+				}
+				if time.Since(start) > 5*time.Second {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+		}
+	}
+	for i, want := range sent {
+		select {
+		case got := <-received:
+			if !bytes.Equal(got, want) {
+				t.Fatalf("Datagram %d is %d bytes that differ from the %d sent", i, len(got), len(want))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Datagram %d didn't arrive", i)
+		}
+	}
+
+	if err := receiver.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Read(make([]byte, 10)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Read() after Close() error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestTransports(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport Transport
+	}{
+		{"test-chan", NewChan(10)},
+		{"test-udp", NewUDP(localAddress(), UDPOptions{})},
+		{"test-udp-batch", NewUDP(localAddress(), UDPOptions{BatchSize: 4})},
+		{"test-udp-offload", NewUDP(localAddress(), UDPOptions{BatchSize: 4, Offload: true})},
+		{"test-udp-sockets", NewUDP(localAddress(), UDPOptions{Sockets: 4, ReadBuffer: 1 << 20})},
+		{"test-tcp", NewTCP(localAddress())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roundTrip(t, tt.transport)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    config.Config
+		want    reflect.Type
+		wantErr bool
+	}{
+		{"test-default", config.Config{ReceiverIP: "127.0.0.1", ReceiverPort: 5000}, reflect.TypeOf(&UDP{}), false},
+		{"test-udp", config.Config{Transport: "udp"}, reflect.TypeOf(&UDP{}), false},
+		{"test-tcp", config.Config{Transport: "tcp"}, reflect.TypeOf(&TCP{}), false},
+		{"test-device", config.Config{Transport: "device", TransportDevice: "/dev/ttyS0"}, reflect.TypeOf(&Device{}), false},
+		{"test-device-no-path", config.Config{Transport: "device"}, nil, true},
+		{"test-unknown", config.Config{Transport: "carrier-pigeon"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && reflect.TypeOf(got) != tt.want {
+				t.Fatalf("New() = %T, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_readFrame(t *testing.T) {
+	first, err := encodeFrame([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encodeFrame([]byte{4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakemarker := []byte{frameMarker[0], frameMarker[1], 0xff, 0xff, 0xff, 0xff} // Longer than any frame
+	var stream []byte
+	stream = append(stream, 0x00, frameMarker[0], 0x11)
+	stream = append(stream, first...)
+	stream = append(stream, fakemarker...)
+	stream = append(stream, second...)
+	stream = append(stream, second[:4]...) // Cut off mid frame
+
+	reader := bufio.NewReader(bytes.NewReader(stream))
+	tests := []struct {
+		want        []byte
+		wantSkipped int
+		wantErr     bool
+	}{
+		{[]byte{1, 2, 3}, 3, false},
+		{[]byte{4, 5}, len(fakemarker), false},
+		{nil, 0, true},
+	}
+	for i, tt := range tests {
+		got, skipped, err := readFrame(reader)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("Frame %d: readFrame() error = %v, wantErr %v", i, err, tt.wantErr)
+		}
+		if !bytes.Equal(got, tt.want) || skipped != tt.wantSkipped {
+			t.Fatalf("Frame %d: readFrame() = %v after skipping %d, want %v after skipping %d", i, got, skipped, tt.want, tt.wantSkipped)
+		}
+	}
+}
+
+func Test_encodeFrame_limits(t *testing.T) {
+	for _, size := range []int{0, maxFrameSize + 1} {
+		if _, err := encodeFrame(make([]byte, size)); !errors.Is(err, errFrameTooLong) {
+			t.Errorf("encodeFrame() of %d bytes error = %v, want %v", size, err, errFrameTooLong)
+		}
+	}
+}
+
+func TestChan_closed(t *testing.T) {
+	c := NewChan(1)
+	sender, _ := c.Dial()
+	receiver, _ := c.Listen()
+	if _, err := sender.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A full channel with no one reading it anymore doesn't block the sender
+	if _, err := sender.Write([]byte{2}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Write() after Close() error = %v, want %v", err, net.ErrClosed)
+	}
+}
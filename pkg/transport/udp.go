@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"net"
+	"sync"
+)
+
+// Senders that can send several datagrams in a single call implement BatchSender
+type BatchSender interface {
+	// The most datagrams worth passing to a single WriteBatch
+	BatchSize() int
+	// Sends the datagrams in as few calls as it can, returns the number of datagrams sent
+	WriteBatch(datagrams [][]byte) (int, error)
+}
+
+// Receivers that can read several datagrams in a single call implement BatchReceiver,
+// every worker reads through a batch of its own
+type BatchReceiver interface {
+	NewBatch(datagramsize int) Batch
+}
+
+type Batch interface {
+	// Waits for at least one datagram and returns all of the datagrams read,
+	// they are only valid until the next call
+	Read() ([][]byte, error)
+}
+
+const maxDatagramSize = 65535
+
+// Receivers made of several sockets implement MultiReceiver, each of them is read by workers of its own
+type MultiReceiver interface {
+	Receivers() []Receiver
+}
+
+// Receivers that learn how many datagrams the kernel dropped on them for lack of buffer space implement KernelDropCounter
+// The count is of the datagrams dropped since the socket was opened, as of the last datagram read from it
+type KernelDropCounter interface {
+	KernelDrops() uint64
+}
+
+type UDPOptions struct {
+	BatchSize  int  // Datagrams sent or received in a single system call, 0 or 1 sends and receives one at a time
+	Offload    bool // Hands segmenting and coalescing of batches to the kernel with UDP_SEGMENT and UDP_GRO
+	Sockets    int  // Sockets the receiver spreads the datagrams over with SO_REUSEPORT, 0 or 1 opens a single socket
+	ReadBuffer int  // Receive buffer of every socket in bytes, 0 keeps the system's default
+}
+
+// *net.UDPConn already reads and writes a datagram at a time so it is both ends as it is,
+// the receiver also uses it as a syscall.Conn to watch its socket buffer
+// Batching, several sockets and counting kernel drops are only done where the system has calls for them,
+// elsewhere a single plain conn is used
+type UDP struct {
+	address string
+	options UDPOptions
+}
+
+func NewUDP(address string, options UDPOptions) *UDP {
+	return &UDP{address: address, options: options}
+}
+
+func (u *UDP) Dial() (Sender, error) {
+	conn, err := net.Dial("udp", u.address)
+	if err != nil || u.options.BatchSize <= 1 {
+		return conn, err
+	}
+	return newBatchSender(conn.(*net.UDPConn), u.options), nil
+}
+
+func (u *UDP) Listen() (Receiver, error) {
+	conns, err := listenUDP(u.address, u.options.Sockets)
+	if err != nil {
+		return nil, err
+	}
+	var receivers []Receiver
+	for _, conn := range conns {
+		if u.options.ReadBuffer > 0 {
+			setReadBuffer(conn, u.options.ReadBuffer)
+		}
+		receivers = append(receivers, newUDPReceiver(conn, u.options))
+	}
+	if len(receivers) == 1 {
+		return receivers[0], nil
+	}
+	return &udpSockets{receivers: receivers, closed: make(chan struct{})}, nil
+}
+
+// The sockets are meant to be read each on its own through Receivers,
+// Read merges them for callers that don't know to do that
+type udpSockets struct {
+	receivers []Receiver
+	once      sync.Once
+	datagrams chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *udpSockets) Receivers() []Receiver {
+	return s.receivers
+}
+
+func (s *udpSockets) Read(b []byte) (int, error) {
+	s.once.Do(func() {
+		s.datagrams = make(chan []byte, 100)
+		for _, receiver := range s.receivers {
+			go func(receiver Receiver) {
+				buf := make([]byte, maxDatagramSize)
+				for {
+					n, err := receiver.Read(buf)
+					if err != nil {
+						return
+					}
+					select {
+					case <-s.closed:
+						return
+					case s.datagrams <- append([]byte{}, buf[:n]...):
+					}
+				}
+			}(receiver)
+		}
+	})
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	case datagram := <-s.datagrams:
+		return copy(b, datagram), nil
+	}
+}
+
+func (s *udpSockets) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		for _, receiver := range s.receivers {
+			if e := receiver.Close(); e != nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,327 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// A batch is read and written with recvmmsg and sendmmsg through x/net,
+// whose ipv4 and ipv6 packet conns share the same Message type
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
+
+const (
+	maxSegments = 64    // Most segments the kernel takes in a single UDP_SEGMENT send
+	maxGSOSize  = 65507 // Largest UDP payload
+)
+
+// Control messages carry their value in the host's byte order
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+func segmentCmsg(size int) []byte {
+	b := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = unix.SOL_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	nativeEndian.PutUint16(b[unix.CmsgLen(0):], uint16(size))
+	return b
+}
+
+type batchSender struct {
+	*net.UDPConn
+	conn      batchConn
+	batchsize int
+	offload   bool
+	msgs      []ipv4.Message
+	counts    []int // Datagrams in every message
+}
+
+func newBatchSender(conn *net.UDPConn, options UDPOptions) Sender {
+	return &batchSender{
+		UDPConn:   conn,
+		conn:      newBatchConn(conn),
+		batchsize: options.BatchSize,
+		offload:   options.Offload,
+	}
+}
+
+func (s *batchSender) BatchSize() int {
+	return s.batchsize
+}
+
+// With offload runs of datagrams of the same size go out as a single message the kernel splits up,
+// a kernel or a device that can't do that fails the send and the datagrams are sent again without it
+func (s *batchSender) WriteBatch(datagrams [][]byte) (int, error) {
+	sent, err := s.writeBatch(datagrams, s.offload)
+	if err != nil && s.offload {
+		logrus.Warnf("Error sending with UDP segmentation offload, sending without it: %v", err)
+		s.offload = false
+		more, err := s.writeBatch(datagrams[sent:], false)
+		return sent + more, err
+	}
+	return sent, err
+}
+
+func (s *batchSender) writeBatch(datagrams [][]byte, offload bool) (int, error) {
+	s.msgs = s.msgs[:0]
+	s.counts = s.counts[:0]
+	for i := 0; i < len(datagrams); {
+		size := len(datagrams[i])
+		j, total := i+1, size
+		for offload && j < len(datagrams) && j-i < maxSegments && len(datagrams[j]) == size && total+size <= maxGSOSize {
+			total += size
+			j++
+		}
+		msg := ipv4.Message{Buffers: datagrams[i:j]}
+		if j-i > 1 {
+			msg.OOB = segmentCmsg(size)
+		}
+		s.msgs = append(s.msgs, msg)
+		s.counts = append(s.counts, j-i)
+		i = j
+	}
+
+	sent := 0
+	for msgs, counts := s.msgs, s.counts; len(msgs) > 0; {
+		n, err := s.conn.WriteBatch(msgs, 0)
+		for _, count := range counts[:n] {
+			sent += count
+		}
+		if err != nil {
+			return sent, err
+		}
+		msgs, counts = msgs[n:], counts[n:]
+	}
+	return sent, nil
+}
+
+// Every socket of the receiver is spread the datagrams sent to the port by the kernel
+func listenUDP(address string, sockets int) ([]*net.UDPConn, error) {
+	if sockets <= 1 {
+		sockets = 1
+	}
+	config := net.ListenConfig{}
+	if sockets > 1 {
+		config.Control = func(network string, address string, rawconn syscall.RawConn) error {
+			return setsockopt(rawconn, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	}
+	var conns []*net.UDPConn
+	for i := 0; i < sockets; i++ {
+		conn, err := config.ListenPacket(context.Background(), "udp", address)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn.(*net.UDPConn))
+		address = conn.LocalAddr().String() // The rest join the port the first one got
+	}
+	return conns, nil
+}
+
+func setsockopt(rawconn syscall.RawConn, level int, opt int, value int) error {
+	var sockerr error
+	err := rawconn.Control(func(fd uintptr) {
+		sockerr = unix.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return sockerr
+}
+
+// SO_RCVBUFFORCE goes past net.core.rmem_max but requires CAP_NET_ADMIN, without it the buffer is capped
+func setReadBuffer(conn *net.UDPConn, size int) {
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		logrus.Errorf("Error setting socket receive buffer: %v", err)
+		return
+	}
+	if err := setsockopt(rawconn, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, size); err == nil {
+		return
+	}
+	if err := conn.SetReadBuffer(size); err != nil {
+		logrus.Errorf("Error setting socket receive buffer: %v", err)
+		return
+	}
+	var got int
+	err = rawconn.Control(func(fd uintptr) {
+		got, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	})
+	// The kernel reports twice the size it was asked for to account for its own overhead
+	if err == nil && got/2 < size {
+		logrus.Warnf("Socket receive buffer is %d bytes instead of %d, raise net.core.rmem_max or run with CAP_NET_ADMIN", got/2, size)
+	}
+}
+
+// Sockets that batch are read through recvmmsg, the kernel passes its drop count along with the datagrams
+type batchReceiver struct {
+	*net.UDPConn
+	conn      batchConn
+	batchsize int
+	gro       bool
+	drops     atomic.Uint64
+
+	lock    sync.Mutex // Serializes Read
+	batch   Batch
+	pending [][]byte
+}
+
+// A datagram at a time is read with ReadFromUDP like on other systems, unless the kernel coalesces them
+func newUDPReceiver(conn *net.UDPConn, options UDPOptions) Receiver {
+	if options.BatchSize <= 1 && !options.Offload {
+		return conn
+	}
+	r := &batchReceiver{
+		UDPConn:   conn,
+		conn:      newBatchConn(conn),
+		batchsize: options.BatchSize,
+	}
+	if r.batchsize < 1 {
+		r.batchsize = 1
+	}
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		logrus.Errorf("Error getting raw socket: %v", err)
+		return r
+	}
+	if options.Offload {
+		if err := setsockopt(rawconn, unix.SOL_UDP, unix.UDP_GRO, 1); err != nil {
+			logrus.Warnf("Error enabling UDP receive offload, receiving without it: %v", err)
+		} else {
+			r.gro = true
+		}
+	}
+	if err := setsockopt(rawconn, unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1); err != nil {
+		logrus.Warnf("Error enabling kernel drop counter, kernel drops won't be reported: %v", err)
+	}
+	return r
+}
+
+func (r *batchReceiver) KernelDrops() uint64 {
+	return r.drops.Load()
+}
+
+// Workers reading concurrently may pass along counts out of order, the count only grows
+func (r *batchReceiver) setDrops(drops uint64) {
+	for {
+		current := r.drops.Load()
+		if drops <= current || r.drops.CompareAndSwap(current, drops) {
+			return
+		}
+	}
+}
+
+// Read is for callers that don't batch, it reads through a batch of its own
+// so datagrams the kernel coalesced are still returned one at a time
+func (r *batchReceiver) Read(b []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.batch == nil {
+		r.batch = r.NewBatch(maxDatagramSize)
+	}
+	for len(r.pending) == 0 {
+		datagrams, err := r.batch.Read()
+		if err != nil {
+			return 0, err
+		}
+		r.pending = datagrams
+	}
+	n := copy(b, r.pending[0])
+	r.pending = r.pending[1:]
+	return n, nil
+}
+
+func (r *batchReceiver) NewBatch(datagramsize int) Batch {
+	b := &udpBatch{receiver: r, msgs: make([]ipv4.Message, r.batchsize)}
+	if r.gro {
+		datagramsize = maxGSOSize // The kernel coalesces datagrams up to the largest payload
+	}
+	for i := range b.msgs {
+		b.msgs[i].Buffers = [][]byte{make([]byte, datagramsize)}
+		b.msgs[i].OOB = make([]byte, 2*unix.CmsgSpace(4))
+	}
+	return b
+}
+
+type udpBatch struct {
+	receiver  *batchReceiver
+	msgs      []ipv4.Message
+	datagrams [][]byte
+}
+
+// Returns the size of the datagrams the kernel coalesced into a message, 0 if it didn't,
+// and the socket's drop count if the kernel passed it along
+func parseCmsgs(oob []byte) (int, uint64, bool) {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, 0, false
+	}
+	size, drops, hasDrops := 0, uint64(0), false
+	for _, cmsg := range cmsgs {
+		if len(cmsg.Data) < 4 {
+			continue
+		}
+		switch {
+		case cmsg.Header.Level == unix.SOL_UDP && cmsg.Header.Type == unix.UDP_GRO:
+			size = int(nativeEndian.Uint32(cmsg.Data))
+		case cmsg.Header.Level == unix.SOL_SOCKET && cmsg.Header.Type == unix.SO_RXQ_OVFL:
+			drops, hasDrops = uint64(nativeEndian.Uint32(cmsg.Data)), true
+		}
+	}
+	return size, drops, hasDrops
+}
+
+func (b *udpBatch) Read() ([][]byte, error) {
+	n, err := b.receiver.conn.ReadBatch(b.msgs, 0)
+	if err != nil {
+		return nil, err
+	}
+	b.datagrams = b.datagrams[:0]
+	for _, msg := range b.msgs[:n] {
+		data := msg.Buffers[0][:msg.N]
+		size, drops, hasDrops := parseCmsgs(msg.OOB[:msg.NN])
+		if hasDrops {
+			b.receiver.setDrops(drops)
+		}
+		if size <= 0 {
+			b.datagrams = append(b.datagrams, data)
+			continue
+		}
+		for len(data) > size {
+			b.datagrams = append(b.datagrams, data[:size])
+			data = data[size:]
+		}
+		b.datagrams = append(b.datagrams, data)
+	}
+	return b.datagrams, nil
+}
@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUDP_kernelDrops(t *testing.T) {
+	address := localAddress()
+	// A buffer too small for what is sent before the receiver reads, the drops are counted when batching
+	receiver, err := NewUDP(address, UDPOptions{ReadBuffer: 4096, BatchSize: 2}).Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sender, err := NewUDP(address, UDPOptions{}).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	for i := 0; i < 100; i++ {
+		if _, err := sender.Write(make([]byte, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The kernel passes along the count as of when a datagram was queued, so the ones after the drops tell
+	deadliner := receiver.(interface{ SetReadDeadline(time.Time) error })
+	if err := deadliner.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := receiver.Read(make([]byte, 1000)); err != nil {
+			break
+		}
+	}
+	if err := deadliner.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Read(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	counter, ok := receiver.(KernelDropCounter)
+	if !ok {
+		t.Fatalf("%T doesn't count kernel drops", receiver)
+	}
+	if drops := counter.KernelDrops(); drops == 0 || drops >= 100 {
+		t.Fatalf("KernelDrops() = %d, want some of the 100 datagrams", drops)
+	}
+}
+
+func TestUDP_unbatched(t *testing.T) {
+	for _, options := range []UDPOptions{{}, {BatchSize: 1}} {
+		receiver, err := NewUDP(localAddress(), options).Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver.Close()
+		if _, ok := receiver.(*net.UDPConn); !ok {
+			t.Fatalf("Listen() with %+v = %T, want a plain socket", options, receiver)
+		}
+	}
+}
+
+func TestUDP_sockets(t *testing.T) {
+	address := localAddress()
+	receiver, err := NewUDP(address, UDPOptions{Sockets: 4, BatchSize: 8}).Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	multi, ok := receiver.(MultiReceiver)
+	if !ok || len(multi.Receivers()) != 4 {
+		t.Fatalf("Listen() = %T, want 4 sockets", receiver)
+	}
+
+	counts := make([]atomic.Int64, 4)
+	for i, socket := range multi.Receivers() {
+		batch := socket.(BatchReceiver).NewBatch(100)
+		go func(i int) {
+			for {
+				datagrams, err := batch.Read()
+				if err != nil {
+					return
+				}
+				counts[i].Add(int64(len(datagrams)))
+			}
+		}(i)
+	}
+	// The kernel picks a socket by the sender's address so every sender lands on one of them
+	for i := 0; i < 32; i++ {
+		sender, err := NewUDP(address, UDPOptions{}).Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sender.Write([]byte{1}); err != nil {
+			t.Fatal(err)
+		}
+		sender.Close()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	total, used := int64(0), 0
+	for i := range counts {
+		total += counts[i].Load()
+		if counts[i].Load() > 0 {
+			used++
+		}
+	}
+	if total != 32 || used < 2 {
+		t.Fatalf("%d datagrams arrived over %d sockets, want 32 over several", total, used)
+	}
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+
+package transport
+
+import (
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Batching needs recvmmsg and sendmmsg and spreading datagrams over several sockets needs Linux's SO_REUSEPORT,
+// other systems send and receive a datagram at a time on a single socket
+
+func newBatchSender(conn *net.UDPConn, options UDPOptions) Sender {
+	return conn
+}
+
+func newUDPReceiver(conn *net.UDPConn, options UDPOptions) Receiver {
+	return conn
+}
+
+func listenUDP(address string, sockets int) ([]*net.UDPConn, error) {
+	if sockets > 1 {
+		logrus.Warnf("Several receive sockets are only supported on Linux, opening a single one")
+	}
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPConn{conn}, nil
+}
+
+func setReadBuffer(conn *net.UDPConn, size int) {
+	if err := conn.SetReadBuffer(size); err != nil {
+		logrus.Errorf("Error setting socket receive buffer: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Compares sending and receiving shares a datagram at a time to batches with and without offload, such as with
+// go test -run ^$ -bench BenchmarkUDP ./pkg/transport
+// The sender stays at most a window of several batches ahead of the receiver so batches fill up, the socket buffer
+// is raised to hold twice the window so it doesn't overflow and both sides are measured, datagrams lost anyway are reported
+func BenchmarkUDP(b *testing.B) {
+	const datagramsize = 8192
+	const batchsize = 64
+	const window = 4 * batchsize
+	const readbuffer = 2 * window * datagramsize
+	tests := []struct {
+		name    string
+		options UDPOptions
+	}{
+		{"plain", UDPOptions{ReadBuffer: readbuffer}},
+		{"batch", UDPOptions{BatchSize: batchsize, ReadBuffer: readbuffer}},
+		{"batch-offload", UDPOptions{BatchSize: batchsize, Offload: true, ReadBuffer: readbuffer}},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			link := NewUDP(localAddress(), tt.options)
+			receiver, err := link.Listen()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer receiver.Close()
+			sender, err := link.Dial()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer sender.Close()
+
+			var received, lost atomic.Int64
+			progress := make(chan struct{}, 1)
+			count := func(n int) {
+				received.Add(int64(n))
+				select {
+				case progress <- struct{}{}:
+				default:
+				}
+			}
+			go func() {
+				if batcher, ok := receiver.(BatchReceiver); ok {
+					batch := batcher.NewBatch(datagramsize)
+					for {
+						datagrams, err := batch.Read()
+						if err != nil {
+							return
+						}
+						count(len(datagrams))
+					}
+				}
+				buf := make([]byte, datagramsize)
+				for {
+					if _, err := receiver.Read(buf); err != nil {
+						return
+					}
+					count(1)
+				}
+			}()
+
+			datagrams := make([][]byte, batchsize)
+			for i := range datagrams {
+				datagrams[i] = make([]byte, datagramsize)
+			}
+			b.SetBytes(datagramsize)
+			b.ResetTimer()
+			batcher, batched := sender.(BatchSender)
+			for sent := 0; sent < b.N; {
+				n := len(datagrams)
+				if !batched {
+					n = 1
+				}
+				if n > b.N-sent {
+					n = b.N - sent
+				}
+				for int64(sent+n)-received.Load() > window {
+					select {
+					case <-progress:
+					case <-time.After(10 * time.Millisecond):
+						// Lost, the sender moves on
+						missing := int64(sent+n) - received.Load() - window
+						lost.Add(missing)
+						received.Add(missing)
+					}
+				}
+				if batched {
+					_, err = batcher.WriteBatch(datagrams[:n])
+				} else {
+					_, err = sender.Write(datagrams[0])
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+				sent += n
+			}
+			b.StopTimer()
+			b.ReportMetric(100*float64(lost.Load())/float64(b.N), "%lost")
+		})
+	}
+}
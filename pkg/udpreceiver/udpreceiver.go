@@ -5,21 +5,103 @@ import (
 	"errors"
 	"net"
 	"oneway-filesync/pkg/structs"
+	"oneway-filesync/pkg/transport"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/danlapid/socketbuffer"
 	"github.com/sirupsen/logrus"
 )
 
+// Datagrams that can't be decoded are never passed on to the pipeline,
+// they are counted by reason and reported periodically by the manager
+type dropCounters struct {
+	badMagic           atomic.Uint64
+	unsupportedVersion atomic.Uint64
+	unknownType        atomic.Uint64
+	corrupt            atomic.Uint64
+	malformed          atomic.Uint64
+}
+
+func (d *dropCounters) count(err error) {
+	switch {
+	case errors.Is(err, structs.ErrBadMagic):
+		d.badMagic.Add(1)
+	case errors.Is(err, structs.ErrUnsupportedVersion):
+		d.unsupportedVersion.Add(1)
+	case errors.Is(err, structs.ErrUnknownPacketType):
+		d.unknownType.Add(1)
+	case errors.Is(err, structs.ErrChecksum):
+		d.corrupt.Add(1)
+	default:
+		d.malformed.Add(1)
+	}
+}
+
+func (d *dropCounters) report() {
+	if n := d.badMagic.Swap(0); n > 0 {
+		logrus.Warnf("Dropped %d datagrams with bad magic", n)
+	}
+	if n := d.unsupportedVersion.Swap(0); n > 0 {
+		logrus.Errorf("Dropped %d datagrams with unsupported protocol version, is the sender up to date?", n)
+	}
+	if n := d.unknownType.Swap(0); n > 0 {
+		logrus.Errorf("Dropped %d datagrams with unknown packet type", n)
+	}
+	if n := d.corrupt.Swap(0); n > 0 {
+		logrus.Errorf("Dropped %d corrupt datagrams", n)
+	}
+	if n := d.malformed.Swap(0); n > 0 {
+		logrus.Errorf("Dropped %d malformed datagrams", n)
+	}
+}
+
 type udpReceiverConfig struct {
-	conn      *net.UDPConn
-	chunksize int
-	output    chan *structs.Chunk
+	socket      int // Index among the receiver's sockets
+	conn        transport.Receiver
+	chunksize   int
+	output      chan *structs.Chunk
+	drops       dropCounters
+	kernelDrops uint64 // As of the last report
+}
+
+// The kernel counts the datagrams it dropped on a socket because its buffer was full,
+// the rest of the datagrams that were sent but never decoded were lost before they reached the receiver
+func (conf *udpReceiverConfig) reportKernelDrops() {
+	counter, ok := conf.conn.(transport.KernelDropCounter)
+	if !ok {
+		return
+	}
+	if drops := counter.KernelDrops(); drops > conf.kernelDrops {
+		logrus.Errorf("Kernel dropped %d datagrams on socket %d for lack of buffer space, %d since it was opened", drops-conf.kernelDrops, conf.socket, drops)
+		conf.kernelDrops = drops
+	}
+}
+
+// Transports other than UDP have no socket buffer to watch, their drops are still reported
+func reportDrops(ctx context.Context, conf *udpReceiverConfig) {
+	reportticker := time.NewTicker(5 * time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			conf.drops.report()
+			return
+		case <-reportticker.C:
+			conf.drops.report()
+		}
+	}
 }
 
 func manager(ctx context.Context, conf *udpReceiverConfig) {
+	sysconn, ok := conf.conn.(syscall.Conn)
+	if !ok {
+		reportDrops(ctx, conf)
+		return
+	}
 	ticker := time.NewTicker(200 * time.Millisecond)
-	rawconn, err := conf.conn.SyscallConn()
+	reportticker := time.NewTicker(5 * time.Second)
+	rawconn, err := sysconn.SyscallConn()
 	if err != nil {
 		logrus.Errorf("Error getting raw socket: %v", err)
 		return
@@ -33,7 +115,12 @@ func manager(ctx context.Context, conf *udpReceiverConfig) {
 	for {
 		select {
 		case <-ctx.Done():
+			conf.drops.report()
+			conf.reportKernelDrops()
 			return
+		case <-reportticker.C:
+			conf.drops.report()
+			conf.reportKernelDrops()
 		case <-ticker.C:
 			toread, err := socketbuffer.GetAvailableBytes(rawconn)
 			if err != nil {
@@ -48,16 +135,33 @@ func manager(ctx context.Context, conf *udpReceiverConfig) {
 	}
 }
 
-func worker(ctx context.Context, conf *udpReceiverConfig) {
+// Transports that read several datagrams at a time are read a batch at a time
+func reader(conf *udpReceiverConfig) func() ([][]byte, error) {
+	if batcher, ok := conf.conn.(transport.BatchReceiver); ok {
+		return batcher.NewBatch(conf.chunksize).Read
+	}
 	buf := make([]byte, conf.chunksize)
+	datagrams := make([][]byte, 1)
+	return func() ([][]byte, error) {
+		n, err := conf.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		datagrams[0] = buf[:n]
+		return datagrams, nil
+	}
+}
+
+func worker(ctx context.Context, conf *udpReceiverConfig) {
+	read := reader(conf)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			// conn.Close will interrupt any waiting ReadFromUDP
-			n, _, err := conf.conn.ReadFromUDP(buf)
+			// conn.Close will interrupt any waiting Read
+			datagrams, err := read()
 			if err != nil {
 				if errors.Is(err, net.ErrClosed) {
 					// conn.Close was called
@@ -66,25 +170,23 @@ func worker(ctx context.Context, conf *udpReceiverConfig) {
 				logrus.Errorf("Error reading from socket: %v", err)
 				return
 			}
-			chunk, err := structs.DecodeChunk(buf[:n])
-			if err != nil {
-				logrus.Errorf("Error decoding chunk: %v", err)
-				continue
+			for _, datagram := range datagrams {
+				chunk, err := structs.DecodeChunk(datagram)
+				if err != nil {
+					conf.drops.count(err)
+					continue
+				}
+				conf.output <- &chunk
 			}
-			conf.output <- &chunk
 		}
 	}
 }
 
-func CreateUdpReceiver(ctx context.Context, ip string, port int, chunksize int, output chan *structs.Chunk, workercount int) {
-	addr := net.UDPAddr{
-		IP:   net.ParseIP(ip),
-		Port: port,
-	}
-
-	conn, err := net.ListenUDP("udp", &addr)
+// Receives datagrams over the transport, UDP unless configured otherwise
+func CreateUdpReceiver(ctx context.Context, tr transport.Transport, chunksize int, output chan *structs.Chunk, workercount int) {
+	conn, err := tr.Listen()
 	if err != nil {
-		logrus.Errorf("Error creating udp socket: %v", err)
+		logrus.Errorf("Error opening transport: %v", err)
 		return
 	}
 	go func() {
@@ -92,13 +194,25 @@ func CreateUdpReceiver(ctx context.Context, ip string, port int, chunksize int,
 		conn.Close()
 	}()
 
-	conf := udpReceiverConfig{
-		conn:      conn,
-		chunksize: chunksize,
-		output:    output,
+	// Every socket is read by workers of its own and watched by a manager of its own
+	receivers := []transport.Receiver{conn}
+	if multi, ok := conn.(transport.MultiReceiver); ok {
+		receivers = multi.Receivers()
+	}
+	workers := workercount / len(receivers)
+	if workers < 1 {
+		workers = 1
 	}
-	for i := 0; i < workercount; i++ {
-		go worker(ctx, &conf)
+	for i, receiver := range receivers {
+		conf := udpReceiverConfig{
+			socket:    i,
+			conn:      receiver,
+			chunksize: chunksize,
+			output:    output,
+		}
+		for j := 0; j < workers; j++ {
+			go worker(ctx, &conf)
+		}
+		go manager(ctx, &conf)
 	}
-	go manager(ctx, &conf)
 }
@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"math/big"
 	"net"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"oneway-filesync/pkg/structs"
+	"oneway-filesync/pkg/transport"
 
 	"github.com/sirupsen/logrus"
 )
@@ -57,6 +61,13 @@ func Test_manager(t *testing.T) {
 		}
 	}
 
+	chanconn, err := transport.NewChan(1).Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nosocket := &udpReceiverConfig{conn: chanconn, chunksize: 8192, output: make(chan *structs.Chunk)}
+	nosocket.drops.corrupt.Add(1)
+
 	type args struct {
 		conf *udpReceiverConfig
 	}
@@ -65,8 +76,9 @@ func Test_manager(t *testing.T) {
 		args     args
 		expected string
 	}{
-		{"test-invalid-socket", args{&udpReceiverConfig{&net.UDPConn{}, 8192, make(chan *structs.Chunk)}}, "Error getting raw socket"},
-		{"test-buffers-full", args{&udpReceiverConfig{receiving_conn, 8192, make(chan *structs.Chunk)}}, "Buffers are filling up loss of data is probable"},
+		{"test-invalid-socket", args{&udpReceiverConfig{conn: &net.UDPConn{}, chunksize: 8192, output: make(chan *structs.Chunk)}}, "Error getting raw socket"},
+		{"test-buffers-full", args{&udpReceiverConfig{conn: receiving_conn, chunksize: 8192, output: make(chan *structs.Chunk)}}, "Buffers are filling up loss of data is probable"},
+		{"test-no-socket", args{nosocket}, "Dropped 1 corrupt datagrams"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -111,7 +123,7 @@ func Test_worker_close_conn(t *testing.T) {
 		name string
 		args args
 	}{
-		{"test1", args{&udpReceiverConfig{receiving_conn, chunksize, output}}},
+		{"test1", args{&udpReceiverConfig{conn: receiving_conn, chunksize: chunksize, output: output}}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -150,8 +162,8 @@ func Test_worker(t *testing.T) {
 	chunksize := 8192
 
 	output := make(chan *structs.Chunk, 5)
-	conf := &udpReceiverConfig{receiving_conn, chunksize, output}
-	chunk := structs.Chunk{Path: "a", Data: make([]byte, chunksize/2)}
+	conf := &udpReceiverConfig{conn: receiving_conn, chunksize: chunksize, output: output}
+	chunk := structs.Chunk{Type: structs.PacketTypeShare, TransferId: structs.NewTransferId(), Data: make([]byte, chunksize/2)}
 
 	var memLog bytes.Buffer
 	logrus.SetOutput(&memLog)
@@ -179,10 +191,66 @@ func Test_worker(t *testing.T) {
 	}
 }
 
+func Test_worker_batch(t *testing.T) {
+	address := fmt.Sprintf("127.0.0.1:%d", randint(30000)+30000)
+	receiving_conn, err := transport.NewUDP(address, transport.UDPOptions{BatchSize: 4, Offload: true}).Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiving_conn.Close()
+	sending_conn, err := transport.NewUDP(address, transport.UDPOptions{BatchSize: 4, Offload: true}).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sending_conn.Close()
+
+	output := make(chan *structs.Chunk, 10)
+	conf := &udpReceiverConfig{conn: receiving_conn, chunksize: 8192, output: output}
+	var sent []structs.Chunk
+	var datagrams [][]byte
+	for i := 0; i < 10; i++ {
+		chunk := structs.Chunk{Type: structs.PacketTypeShare, TransferId: structs.NewTransferId(), DataOffset: int64(i), Data: make([]byte, 1000)}
+		data, err := chunk.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, chunk)
+		datagrams = append(datagrams, data)
+	}
+	// Same sized datagrams are coalesced on the way where the system offloads them
+	if batcher, ok := sending_conn.(transport.BatchSender); ok {
+		_, err = batcher.WriteBatch(datagrams)
+	} else {
+		for _, data := range datagrams {
+			if _, err = sending_conn.Write(data); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(2 * time.Second)
+		conf.conn.Close()
+		cancel()
+	}()
+	worker(ctx, conf)
+
+	for i, chunk := range sent {
+		got := <-output
+		if !reflect.DeepEqual(*got, chunk) {
+			t.Fatalf("Share %d = %v, want %v", i, got, chunk)
+		}
+	}
+}
+
 func Test_worker_error_invalid_socket(t *testing.T) {
 	chunksize := 8192
 	output := make(chan *structs.Chunk, 5)
-	conf := &udpReceiverConfig{&net.UDPConn{}, chunksize, output}
+	conf := &udpReceiverConfig{conn: &net.UDPConn{}, chunksize: chunksize, output: output}
 
 	var memLog bytes.Buffer
 	logrus.SetOutput(&memLog)
@@ -222,18 +290,32 @@ func Test_worker_error_decoding(t *testing.T) {
 
 	chunksize := 8192
 	output := make(chan *structs.Chunk, 5)
-	conf := &udpReceiverConfig{receiving_conn, chunksize, output}
-	data := make([]byte, chunksize/2)
-	for i := range data {
-		data[i] = 0xff
-	}
-	var memLog bytes.Buffer
-	logrus.SetOutput(&memLog)
+	conf := &udpReceiverConfig{conn: receiving_conn, chunksize: chunksize, output: output}
 
-	_, err = sending_conn.Write(data)
+	garbage := make([]byte, chunksize/2)
+	for i := range garbage {
+		garbage[i] = 0xff
+	}
+	valid, err := structs.Chunk{Type: structs.PacketTypeShare, Data: make([]byte, 100)}.Encode()
 	if err != nil {
 		t.Fatal(err)
 	}
+	futureversion := append([]byte{}, valid...)
+	futureversion[4] = structs.ProtocolVersion + 1
+	unknowntype := append([]byte{}, valid...)
+	unknowntype[5] = 0xff
+	checksum := unknowntype[len(unknowntype)-crc32.Size:]
+	binary.BigEndian.PutUint32(checksum, crc32.Checksum(unknowntype[:len(unknowntype)-crc32.Size], crc32.MakeTable(crc32.Castagnoli)))
+	corrupt := append([]byte{}, valid...)
+	corrupt[structs.HeaderSize+10] ^= 0x01
+	truncated := valid[:structs.HeaderSize+3]
+
+	for _, data := range [][]byte{garbage, futureversion, unknowntype, corrupt, truncated} {
+		_, err = sending_conn.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
@@ -243,8 +325,27 @@ func Test_worker_error_decoding(t *testing.T) {
 	}()
 	worker(ctx, conf)
 
-	if !strings.Contains(memLog.String(), "Error decoding chunk") {
-		t.Fatalf("Expected not in log, '%v' not in '%v'", "Error decoding chunk", memLog.String())
+	if len(output) != 0 {
+		t.Fatalf("Undecodable datagrams were passed on to the pipeline")
+	}
+	counters := map[string]*atomic.Uint64{
+		"badMagic":           &conf.drops.badMagic,
+		"unsupportedVersion": &conf.drops.unsupportedVersion,
+		"unknownType":        &conf.drops.unknownType,
+		"corrupt":            &conf.drops.corrupt,
+		"malformed":          &conf.drops.malformed,
+	}
+	for name, counter := range counters {
+		if counter.Load() != 1 {
+			t.Errorf("%s counter = %d, want 1", name, counter.Load())
+		}
+	}
+
+	var memLog bytes.Buffer
+	logrus.SetOutput(&memLog)
+	conf.drops.report()
+	if !strings.Contains(memLog.String(), "unsupported protocol version") {
+		t.Fatalf("Expected not in log, '%v' not in '%v'", "unsupported protocol version", memLog.String())
 	}
 }
 
@@ -253,9 +354,78 @@ func TestCreateUdpReceiver(t *testing.T) {
 	var memLog bytes.Buffer
 	logrus.SetOutput(&memLog)
 	ctx, cancel := context.WithCancel(context.Background())
-	CreateUdpReceiver(ctx, "127.0.0.1", 88888, 8192, make(chan *structs.Chunk), 1)
+	CreateUdpReceiver(ctx, transport.NewUDP("127.0.0.1:88888", transport.UDPOptions{}), 8192, make(chan *structs.Chunk), 1)
 	cancel()
-	if !strings.Contains(memLog.String(), "Error creating udp socket") {
-		t.Fatalf("Expected not in log, '%v' not in '%v'", "Error creating udp socket", memLog.String())
+	if !strings.Contains(memLog.String(), "Error opening transport") {
+		t.Fatalf("Expected not in log, '%v' not in '%v'", "Error opening transport", memLog.String())
+	}
+}
+
+type countingReceiver struct {
+	transport.Receiver
+	drops uint64
+}
+
+func (r *countingReceiver) KernelDrops() uint64 {
+	return r.drops
+}
+
+func Test_reportKernelDrops(t *testing.T) {
+	counter := &countingReceiver{}
+	conf := &udpReceiverConfig{socket: 2, conn: counter}
+	tests := []struct {
+		name     string
+		drops    uint64
+		expected string
+	}{
+		{"test-none", 0, ""},
+		{"test-first", 5, "Kernel dropped 5 datagrams on socket 2 for lack of buffer space, 5 since it was opened"},
+		{"test-unchanged", 5, ""},
+		{"test-more", 12, "Kernel dropped 7 datagrams on socket 2 for lack of buffer space, 12 since it was opened"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var memLog bytes.Buffer
+			logrus.SetOutput(&memLog)
+			counter.drops = tt.drops
+			conf.reportKernelDrops()
+			if tt.expected == "" && memLog.Len() != 0 {
+				t.Fatalf("Expected nothing in log, got '%v'", memLog.String())
+			}
+			if !strings.Contains(memLog.String(), tt.expected) {
+				t.Fatalf("Expected not in log, '%v' not in '%v'", tt.expected, memLog.String())
+			}
+		})
+	}
+}
+
+func TestCreateUdpReceiver_sockets(t *testing.T) {
+	address := fmt.Sprintf("127.0.0.1:%d", randint(30000)+30000)
+	output := make(chan *structs.Chunk, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	CreateUdpReceiver(ctx, transport.NewUDP(address, transport.UDPOptions{Sockets: 4, ReadBuffer: 1 << 20}), 8192, output, 8)
+
+	data, err := structs.Chunk{Type: structs.PacketTypeShare, Data: make([]byte, 100)}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every sender lands on one of the sockets, all of them are read
+	for i := 0; i < 32; i++ {
+		sending_conn, err := net.Dial("udp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sending_conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		sending_conn.Close()
+	}
+	for i := 0; i < 32; i++ {
+		select {
+		case <-output:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Only %d of 32 shares were received", i)
+		}
 	}
 }
@@ -2,34 +2,36 @@ package udpsender
 
 import (
 	"context"
-	"fmt"
-	"net"
 	"oneway-filesync/pkg/structs"
+	"oneway-filesync/pkg/transport"
 
 	"github.com/sirupsen/logrus"
 )
 
 type udpSenderConfig struct {
-	ip    string
-	port  int
-	input chan *structs.Chunk
+	transport transport.Transport
+	input     chan *structs.Chunk
 }
 
 func worker(ctx context.Context, conf *udpSenderConfig) {
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", conf.ip, conf.port))
+	conn, err := conf.transport.Dial()
 	if err != nil {
-		logrus.Errorf("Error creating udp socket: %v", err)
+		logrus.Errorf("Error opening transport: %v", err)
 		return
 	}
 	defer conn.Close()
+	if batcher, ok := conn.(transport.BatchSender); ok {
+		batchWorker(ctx, conf, batcher)
+		return
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case share := <-conf.input:
 			l := logrus.WithFields(logrus.Fields{
-				"Path": share.Path,
-				"Hash": fmt.Sprintf("%x", share.Hash),
+				"TransferId": share.TransferId.String(),
+				"DataOffset": share.DataOffset,
 			})
 			buf, err := share.Encode()
 			if err != nil {
@@ -45,11 +47,52 @@ func worker(ctx context.Context, conf *udpSenderConfig) {
 	}
 }
 
-func CreateUdpSender(ctx context.Context, ip string, port int, input chan *structs.Chunk, workercount int) {
+// Sends the shares that are already waiting together, without waiting for more to fill the batch
+func batchWorker(ctx context.Context, conf *udpSenderConfig, conn transport.BatchSender) {
+	size := conn.BatchSize()
+	bufs := make([][]byte, 0, size)
+	add := func(share *structs.Chunk) {
+		buf, err := share.Encode()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"TransferId": share.TransferId.String(),
+				"DataOffset": share.DataOffset,
+			}).Errorf("Error encoding share: %v", err)
+			return
+		}
+		bufs = append(bufs, buf)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case share := <-conf.input:
+			bufs = bufs[:0]
+			add(share)
+		fill:
+			for len(bufs) < size {
+				select {
+				case share := <-conf.input:
+					add(share)
+				default:
+					break fill
+				}
+			}
+			if len(bufs) == 0 {
+				continue
+			}
+			if n, err := conn.WriteBatch(bufs); err != nil {
+				logrus.Errorf("Error sending %d of %d shares: %v", len(bufs)-n, len(bufs), err)
+			}
+		}
+	}
+}
+
+// Sends every share as a datagram over the transport, UDP unless configured otherwise
+func CreateUdpSender(ctx context.Context, tr transport.Transport, input chan *structs.Chunk, workercount int) {
 	conf := udpSenderConfig{
-		ip:    ip,
-		port:  port,
-		input: input,
+		transport: tr,
+		input:     input,
 	}
 	for i := 0; i < workercount; i++ {
 		go worker(ctx, &conf)
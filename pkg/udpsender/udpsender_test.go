@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"fmt"
 	"math/big"
 	"net"
 	"oneway-filesync/pkg/structs"
+	"oneway-filesync/pkg/transport"
 	"strings"
 	"testing"
 	"time"
@@ -48,7 +50,7 @@ func Test_worker(t *testing.T) {
 		expectedErr string
 	}{
 		{"test-works", args{ip, port, structs.Chunk{}}, false, ""},
-		{"test-socket-err", args{ip, 88888, structs.Chunk{}}, true, "Error creating udp socket"},
+		{"test-socket-err", args{ip, 88888, structs.Chunk{}}, true, "Error opening transport"},
 		{"test-message-too-long", args{ip, port, structs.Chunk{Data: make([]byte, 100*1024)}}, true, "Error sending share: write udp"},
 	}
 	for _, tt := range tests {
@@ -58,7 +60,7 @@ func Test_worker(t *testing.T) {
 
 			input := make(chan *structs.Chunk, 5)
 			input <- &tt.args.chunk
-			conf := udpSenderConfig{tt.args.ip, tt.args.port, input}
+			conf := udpSenderConfig{transport.NewUDP(fmt.Sprintf("%s:%d", tt.args.ip, tt.args.port), transport.UDPOptions{}), input}
 			ctx, cancel := context.WithCancel(context.Background())
 			go func() {
 				time.Sleep(2 * time.Second)
@@ -76,3 +78,38 @@ func Test_worker(t *testing.T) {
 		})
 	}
 }
+
+func Test_batchWorker(t *testing.T) {
+	for _, options := range []transport.UDPOptions{{BatchSize: 4}, {BatchSize: 4, Offload: true}} {
+		address := fmt.Sprintf("127.0.0.1:%d", randint(30000)+30000)
+		receiving_conn, err := transport.NewUDP(address, transport.UDPOptions{}).Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer receiving_conn.Close()
+
+		input := make(chan *structs.Chunk, 10)
+		for i := 0; i < 10; i++ {
+			input <- &structs.Chunk{Type: structs.PacketTypeShare, DataOffset: int64(i), Data: make([]byte, 1000)}
+		}
+		conf := udpSenderConfig{transport.NewUDP(address, options), input}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(2 * time.Second)
+			cancel()
+		}()
+		worker(ctx, &conf)
+
+		buf := make([]byte, 8192)
+		for i := 0; i < 10; i++ {
+			n, err := receiving_conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunk, err := structs.DecodeChunk(buf[:n])
+			if err != nil || chunk.DataOffset != int64(i) {
+				t.Fatalf("Share %d arrived as share %d: %v", i, chunk.DataOffset, err)
+			}
+		}
+	}
+}
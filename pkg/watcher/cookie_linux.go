@@ -0,0 +1,20 @@
+package watcher
+
+import (
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+)
+
+// Inotify gives both halves of a rename the same cookie, which is how the old path is paired with the new one
+func renameCookie(ei notify.EventInfo) uint32 {
+	if ev, ok := ei.Sys().(*unix.InotifyEvent); ok {
+		return ev.Cookie
+	}
+	return 0
+}
+
+// A moved directory also gets an IN_MOVE_SELF of its own without a cookie, the IN_MOVED_FROM of its parent is the one paired
+func selfMove(ei notify.EventInfo) bool {
+	ev, ok := ei.Sys().(*unix.InotifyEvent)
+	return ok && ev.Mask&unix.IN_MOVE_SELF != 0
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package watcher
+
+import "github.com/rjeczalik/notify"
+
+// Without a way to pair the halves of a rename it is sent as a delete of the old path and a write of the new one
+func renameCookie(ei notify.EventInfo) uint32 {
+	return 0
+}
+
+func selfMove(ei notify.EventInfo) bool {
+	return false
+}
@@ -2,10 +2,13 @@ package watcher
 
 import (
 	"context"
+	"errors"
 	"oneway-filesync/pkg/config"
 	"oneway-filesync/pkg/database"
+	"oneway-filesync/pkg/spool"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/rjeczalik/notify"
@@ -13,8 +16,9 @@ import (
 	"gorm.io/gorm"
 )
 
+// Symlinks are sent as links so a link to a directory isn't a directory
 func isDirectory(path string) (bool, error) {
-	fileInfo, err := os.Stat(path)
+	fileInfo, err := os.Lstat(path)
 	if err != nil {
 		return false, err
 	}
@@ -23,14 +27,108 @@ func isDirectory(path string) (bool, error) {
 }
 
 type watcherConfig struct {
-	db        *gorm.DB
-	encrypted bool
-	input     chan notify.EventInfo
-	cache     map[string]time.Time
+	db      *gorm.DB
+	opts    database.SendOptions
+	spool   *spool.Spool
+	input   chan notify.EventInfo
+	cache   map[string]time.Time
+	renames map[uint32]pendingRename
+}
+
+// The old half of a rename waiting for the new half to arrive
+type pendingRename struct {
+	path string
+	seen time.Time
+}
+
+// A rename whose new half doesn't arrive within this long moved the path out of the watched dir
+const renamePairWindow = time.Second
+
+func isUnder(path string, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// Drops the pending writes of a path and of everything under it
+func forget(conf *watcherConfig, path string) {
+	for p := range conf.cache {
+		if p == path || isUnder(p, path) {
+			delete(conf.cache, p)
+		}
+	}
+}
+
+func queueDelete(conf *watcherConfig, path string) {
+	forget(conf, path)
+	err := database.QueueDeleteForSending(conf.db, path, conf.opts)
+	if err != nil {
+		logrus.Errorf("Failed to queue deletion for sending: %v", err)
+	} else {
+		logrus.Infof("Deletion of '%s' queued for sending", path)
+	}
+}
+
+// Writes still pending under the old path are sent under the new one once they settle
+func queueRename(conf *watcherConfig, oldpath string, newpath string) {
+	forget(conf, newpath)
+	for p, lastupdated := range conf.cache {
+		if p == oldpath || isUnder(p, oldpath) {
+			delete(conf.cache, p)
+			conf.cache[newpath+strings.TrimPrefix(p, oldpath)] = lastupdated
+		}
+	}
+	err := database.QueueRenameForSending(conf.db, oldpath, newpath, conf.opts)
+	if err != nil {
+		logrus.Errorf("Failed to queue rename for sending: %v", err)
+	} else {
+		logrus.Infof("Rename of '%s' to '%s' queued for sending", oldpath, newpath)
+	}
+}
+
+// The old halves of renames that weren't paired in time moved their paths out of the watched dir
+func expireRenames(conf *watcherConfig, now time.Time) {
+	for cookie, pending := range conf.renames {
+		if now.Sub(pending.seen) > renamePairWindow {
+			delete(conf.renames, cookie)
+			queueDelete(conf, pending.path)
+		}
+	}
+}
+
+func handleEvent(conf *watcherConfig, ei notify.EventInfo) {
+	switch ei.Event() {
+	case notify.Remove:
+		queueDelete(conf, ei.Path())
+		return
+	case notify.Rename:
+		if selfMove(ei) {
+			return
+		}
+		if cookie := renameCookie(ei); cookie != 0 {
+			conf.renames[cookie] = pendingRename{path: ei.Path(), seen: time.Now()}
+		} else {
+			queueDelete(conf, ei.Path())
+		}
+		return
+	case notify.Create:
+		cookie := renameCookie(ei)
+		if pending, ok := conf.renames[cookie]; ok && cookie != 0 {
+			delete(conf.renames, cookie)
+			queueRename(conf, pending.path, ei.Path())
+			return
+		}
+	}
+
+	// New directories are sent so that they arrive even if they stay empty
+	isdir, err := isDirectory(ei.Path())
+	if err == nil && (!isdir || ei.Event() == notify.Create) {
+		conf.cache[ei.Path()] = time.Now()
+		logrus.Infof("Noticed change in file '%s'", ei.Path())
+	}
 }
 
 // To save up on resources we only send files that haven't changed for the past 30 seconds
 // otherwise many consecutive small changes will cause a large overhead on the sender/receiver
+// Deletes and renames are queued right away, they are tiny and the receiver applies them in the order they arrive
 func worker(ctx context.Context, conf *watcherConfig) {
 	ticker := time.NewTicker(10 * time.Second)
 	for {
@@ -39,16 +137,16 @@ func worker(ctx context.Context, conf *watcherConfig) {
 			notify.Stop(conf.input)
 			return
 		case ei := <-conf.input:
-			isdir, err := isDirectory(ei.Path())
-			if err == nil && !isdir {
-				conf.cache[ei.Path()] = time.Now()
-				logrus.Infof("Noticed change in file '%s'", ei.Path())
-			}
+			handleEvent(conf, ei)
 		case <-ticker.C:
+			expireRenames(conf, time.Now())
 			for path, lastupdated := range conf.cache {
 				if time.Since(lastupdated).Seconds() > 30 {
+					err := conf.spool.QueueFile(conf.db, path, conf.opts)
+					if errors.Is(err, spool.ErrSpoolFull) {
+						continue // Tried again on the next tick
+					}
 					delete(conf.cache, path)
-					err := database.QueueFileForSending(conf.db, path, conf.encrypted)
 					if err != nil {
 						logrus.Errorf("Failed to queue file for sending: %v", err)
 					} else {
@@ -60,16 +158,19 @@ func worker(ctx context.Context, conf *watcherConfig) {
 	}
 }
 
-func CreateWatcher(ctx context.Context, db *gorm.DB, watchdir string, encrypted bool, input chan notify.EventInfo) {
-	if err := notify.Watch(filepath.Join(watchdir, "..."), input, notify.Write, notify.Create); err != nil {
+// Files are snapshotted into sp when it isn't nil, while it is full they wait in the watcher
+func CreateWatcher(ctx context.Context, db *gorm.DB, watchdir string, opts database.SendOptions, sp *spool.Spool, input chan notify.EventInfo) {
+	if err := notify.Watch(filepath.Join(watchdir, "..."), input, notify.Write, notify.Create, notify.Remove, notify.Rename); err != nil {
 		logrus.Errorf("Failed to watch dir with error: %v", err)
 		return
 	}
 	conf := watcherConfig{
-		db:        db,
-		encrypted: encrypted,
-		input:     input,
-		cache:     make(map[string]time.Time),
+		db:      db,
+		opts:    opts,
+		spool:   sp,
+		input:   input,
+		cache:   make(map[string]time.Time),
+		renames: make(map[uint32]pendingRename),
 	}
 	go worker(ctx, &conf)
 }
@@ -77,5 +178,17 @@ func CreateWatcher(ctx context.Context, db *gorm.DB, watchdir string, encrypted
 func Watcher(ctx context.Context, db *gorm.DB, conf config.Config) {
 	events := make(chan notify.EventInfo, 500)
 
-	CreateWatcher(ctx, db, conf.WatchDir, conf.EncryptedOutput, events)
+	opts := database.SendOptions{
+		Encrypted:   conf.EncryptedOutput,
+		Compress:    conf.WatchCompress,
+		Priority:    conf.WatchPriority,
+		Copies:      conf.WatchCopies,
+		CopySpacing: conf.WatchCopySpacing,
+	}
+	sp, err := spool.OpenSpool(conf.SpoolDir, conf.SpoolSizeLimit)
+	if err != nil {
+		logrus.Errorf("Failed to open spool with error: %v", err)
+		return
+	}
+	CreateWatcher(ctx, db, conf.WatchDir, opts, sp, events)
 }
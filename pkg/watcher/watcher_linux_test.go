@@ -0,0 +1,82 @@
+package watcher
+
+import (
+	"oneway-filesync/pkg/structs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+)
+
+func movedFrom(path string, cookie uint32) fakeEvent {
+	return fakeEvent{event: notify.Rename, path: path, sys: &unix.InotifyEvent{Mask: unix.IN_MOVED_FROM, Cookie: cookie}}
+}
+
+func movedTo(path string, cookie uint32) fakeEvent {
+	return fakeEvent{event: notify.Create, path: path, sys: &unix.InotifyEvent{Mask: unix.IN_MOVED_TO, Cookie: cookie}}
+}
+
+func Test_handleEvent_rename(t *testing.T) {
+	dir := t.TempDir()
+	conf := newTestConf(t)
+	conf.cache[filepath.Join(dir, "a", "x")] = time.Now()
+
+	// The halves of a rename are paired by their cookie, whatever comes in between
+	handleEvent(conf, movedFrom(filepath.Join(dir, "a"), 7))
+	handleEvent(conf, movedFrom(filepath.Join(dir, "c"), 8))
+	handleEvent(conf, movedTo(filepath.Join(dir, "b"), 7))
+	files := queued(t, conf)
+	if len(files) != 1 || files[0].Op != structs.OpRename || files[0].Path != filepath.Join(dir, "a") || files[0].Target != filepath.Join(dir, "b") {
+		t.Fatalf("Queued %+v, want the rename of the directory", files)
+	}
+	// The pending writes of a moved directory follow it
+	if _, ok := conf.cache[filepath.Join(dir, "b", "x")]; len(conf.cache) != 1 || !ok {
+		t.Fatalf("Pending writes = %v, want the one under the directory moved along", conf.cache)
+	}
+	if _, ok := conf.renames[8]; len(conf.renames) != 1 || !ok {
+		t.Fatalf("Pending renames = %v, want the unpaired one", conf.renames)
+	}
+}
+
+func Test_handleEvent_self_move(t *testing.T) {
+	dir := t.TempDir()
+	conf := newTestConf(t)
+
+	// A moved directory gets a cookieless event of its own besides the one its parent gets
+	handleEvent(conf, movedFrom(filepath.Join(dir, "a"), 7))
+	handleEvent(conf, fakeEvent{event: notify.Rename, path: filepath.Join(dir, "a"), sys: &unix.InotifyEvent{Mask: unix.IN_MOVE_SELF}})
+	handleEvent(conf, movedTo(filepath.Join(dir, "b"), 7))
+	files := queued(t, conf)
+	if len(files) != 1 || files[0].Op != structs.OpRename {
+		t.Fatalf("Queued %+v, want only the rename", files)
+	}
+}
+
+func Test_expireRenames(t *testing.T) {
+	dir := t.TempDir()
+	conf := newTestConf(t)
+	conf.cache[filepath.Join(dir, "a", "x")] = time.Now()
+	handleEvent(conf, movedFrom(filepath.Join(dir, "a"), 7))
+
+	expireRenames(conf, time.Now())
+	if files := queued(t, conf); len(files) != 0 {
+		t.Fatalf("Queued %+v before the rename could be paired", files)
+	}
+
+	// Moved out of the watched dir, the path is gone along with what was pending under it
+	expireRenames(conf, time.Now().Add(2*renamePairWindow))
+	files := queued(t, conf)
+	if len(files) != 1 || files[0].Op != structs.OpDelete || files[0].Path != filepath.Join(dir, "a") {
+		t.Fatalf("Queued %+v, want the delete of the path moved out", files)
+	}
+	if len(conf.renames) != 0 || len(conf.cache) != 0 {
+		t.Fatalf("Pending renames = %v and writes = %v, want none", conf.renames, conf.cache)
+	}
+	// A late new half is just a new path
+	handleEvent(conf, movedTo(filepath.Join(dir, "b"), 7))
+	if files := queued(t, conf); len(files) != 1 {
+		t.Fatalf("Queued %+v, want nothing more", files)
+	}
+}
@@ -3,6 +3,8 @@ package watcher
 import (
 	"bytes"
 	"context"
+	"oneway-filesync/pkg/database"
+	"oneway-filesync/pkg/structs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -48,7 +50,7 @@ func TestCreateWatcher_baddir(t *testing.T) {
 	logrus.SetOutput(&memLog)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	CreateWatcher(ctx, &gorm.DB{}, "nonexistentdir", false, make(chan notify.EventInfo, 5))
+	CreateWatcher(ctx, &gorm.DB{}, "nonexistentdir", database.SendOptions{}, nil, make(chan notify.EventInfo, 5))
 	cancel()
 
 	if !strings.Contains(memLog.String(), "Failed to watch dir with error") {
@@ -66,10 +68,11 @@ func Test_worker_baddb(t *testing.T) {
 	}
 
 	conf := watcherConfig{
-		db:        db,
-		encrypted: false,
-		input:     make(chan notify.EventInfo, 5),
-		cache:     make(map[string]time.Time),
+		db:      db,
+		opts:    database.SendOptions{},
+		input:   make(chan notify.EventInfo, 5),
+		cache:   make(map[string]time.Time),
+		renames: make(map[uint32]pendingRename),
 	}
 
 	if err := notify.Watch(filepath.Join(".", "..."), conf.input, notify.Write, notify.Create); err != nil {
@@ -92,3 +95,54 @@ func Test_worker_baddb(t *testing.T) {
 		t.Fatalf("Expected not in log, '%v' not in '%v'", "Failed to queue file for sending:", memLog.String())
 	}
 }
+
+type fakeEvent struct {
+	event notify.Event
+	path  string
+	sys   interface{}
+}
+
+func (e fakeEvent) Event() notify.Event { return e.event }
+func (e fakeEvent) Path() string        { return e.path }
+func (e fakeEvent) Sys() interface{}    { return e.sys }
+
+func newTestConf(t *testing.T) *watcherConfig {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&database.File{}); err != nil {
+		t.Fatal(err)
+	}
+	return &watcherConfig{
+		db:      db,
+		cache:   make(map[string]time.Time),
+		renames: make(map[uint32]pendingRename),
+	}
+}
+
+func queued(t *testing.T, conf *watcherConfig) []database.File {
+	var files []database.File
+	if err := conf.db.Order("sequence").Find(&files).Error; err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func Test_handleEvent_delete(t *testing.T) {
+	dir := t.TempDir()
+	conf := newTestConf(t)
+	for _, path := range []string{"a", "a/x", "ab"} {
+		conf.cache[filepath.Join(dir, path)] = time.Now()
+	}
+
+	// Removing a directory drops the pending writes under it, not those of paths that only start the same
+	handleEvent(conf, fakeEvent{event: notify.Remove, path: filepath.Join(dir, "a")})
+	files := queued(t, conf)
+	if len(files) != 1 || files[0].Op != structs.OpDelete || files[0].Path != filepath.Join(dir, "a") {
+		t.Fatalf("Queued %+v, want the delete of the directory", files)
+	}
+	if _, ok := conf.cache[filepath.Join(dir, "ab")]; len(conf.cache) != 1 || !ok {
+		t.Fatalf("Pending writes = %v, want only the one outside the directory", conf.cache)
+	}
+}
@@ -19,11 +19,11 @@ func ZipFile(dst io.Writer, src *os.File) error {
 	}
 
 	if _, err = io.Copy(zipfile, src); err != nil {
-		return fmt.Errorf("error copying file contents: %v", err)
+		return fmt.Errorf("error copying file contents: %w", err)
 	}
 
 	if err = ziparchive.Close(); err != nil {
-		return fmt.Errorf("error closing zip file: %v", err)
+		return fmt.Errorf("error closing zip file: %w", err)
 	}
 	return nil
 }
@@ -11,6 +11,7 @@ import (
 	"oneway-filesync/pkg/database"
 	"oneway-filesync/pkg/receiver"
 	"oneway-filesync/pkg/sender"
+	"oneway-filesync/pkg/transport"
 	"oneway-filesync/pkg/watcher"
 	"os"
 	"path/filepath"
@@ -70,14 +71,6 @@ func getDiff(t *testing.T, path1 string, path2 string) int {
 	return diff
 }
 
-func pathReplace(path string) string {
-	newpath := path
-	newpath = strings.ReplaceAll(newpath, "/", "_")
-	newpath = strings.ReplaceAll(newpath, "\\", "_")
-	newpath = strings.ReplaceAll(newpath, ":", "_")
-	return newpath
-}
-
 func waitForFinishedFile(t *testing.T, db *gorm.DB, path string, endtime time.Time, outdir string) {
 	ticker := time.NewTicker(1 * time.Second)
 	for {
@@ -91,7 +84,7 @@ func waitForFinishedFile(t *testing.T, db *gorm.DB, path string, endtime time.Ti
 			continue
 		}
 		if !file.Finished || !file.Success {
-			tmpfilepath := filepath.Join(outdir, "tempfiles", fmt.Sprintf("%s___%x.tmp", pathReplace(file.Path), file.Hash))
+			tmpfilepath := filepath.Join(outdir, "tempfiles", fmt.Sprintf("%x.tmp", file.TransferId))
 			diff := getDiff(t, path, tmpfilepath)
 			t.Fatalf("File '%s' transferred but not successfully %d different bytes", path, diff)
 		} else {
@@ -101,6 +94,31 @@ func waitForFinishedFile(t *testing.T, db *gorm.DB, path string, endtime time.Ti
 	}
 }
 
+// Fails if the file is transferred successfully or the receiver doesn't give up on it before endtime,
+// a transfer that stops arriving is closed as failed once it was idle for a while
+// The manifest may be lost along with the rest, so a failed transfer without a path counts as the file
+func waitForUndelivered(t *testing.T, db *gorm.DB, path string, endtime time.Time) {
+	ticker := time.NewTicker(1 * time.Second)
+	for time.Now().Before(endtime) {
+		<-ticker.C
+		var files []database.File
+		err := db.Where("Finished = ? AND (Path = ? OR Path = ?)", true, path, "").Find(&files).Error
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if file.Success {
+				t.Fatalf("File '%s' transferred successfully over a link that loses more than FEC recovers", path)
+			}
+		}
+		if len(files) > 0 {
+			t.Logf("File '%s' failed as expected", path)
+			return
+		}
+	}
+	t.Fatalf("Receiver didn't give up on file '%s'", path)
+}
+
 func tempFile(t *testing.T, size int, tmpdir string) string {
 	file, err := os.CreateTemp(tmpdir, "")
 	if err != nil {
@@ -118,7 +136,15 @@ func tempFile(t *testing.T, size int, tmpdir string) string {
 	return tempfilepath
 }
 
-func setupTest(t *testing.T, conf config.Config) (*gorm.DB, *gorm.DB, func()) {
+// Connects the sender and receiver over tr, or over the transport conf names if tr is nil
+func setupTest(t *testing.T, conf config.Config, tr transport.Transport) (*gorm.DB, *gorm.DB, func()) {
+	if tr == nil {
+		var err error
+		if tr, err = transport.New(conf); err != nil {
+			t.Fatalf("Failed creating transport with err: %v\n", err)
+		}
+	}
+
 	senderdb, err := database.OpenDatabase("t_s_")
 	if err != nil {
 		t.Fatalf("Failed setting up db with err: %v\n", err)
@@ -138,8 +164,11 @@ func setupTest(t *testing.T, conf config.Config) (*gorm.DB, *gorm.DB, func()) {
 	}
 
 	ctx, cancel := context.WithCancel(context.Background()) // Create a cancelable context and pass it to all goroutines, allows us to gracefully shut down the program
-	receiver.Receiver(ctx, receiverdb, conf)
-	sender.Sender(ctx, senderdb, conf)
+	if err := receiver.ReceiverWithTransport(ctx, receiverdb, conf, tr); err != nil {
+		cancel()
+		t.Fatalf("Failed starting receiver with err: %v\n", err)
+	}
+	sender.SenderWithTransport(ctx, senderdb, conf, tr)
 	watcher.Watcher(ctx, senderdb, conf)
 
 	return senderdb, receiverdb, func() {
@@ -151,6 +180,10 @@ func setupTest(t *testing.T, conf config.Config) (*gorm.DB, *gorm.DB, func()) {
 		if err := os.RemoveAll(conf.OutDir); err != nil {
 			t.Log(err)
 		}
+		// Where the receiver archives by default
+		if err := os.RemoveAll(filepath.Clean(conf.OutDir) + "-archive"); err != nil {
+			t.Log(err)
+		}
 		if err := database.ClearDatabase(receiverdb); err != nil {
 			t.Log(err)
 		}
@@ -184,10 +217,28 @@ func TestSetup(t *testing.T) {
 		ChunkFecTotal:    10,
 		OutDir:           "tests_out",
 		WatchDir:         "tests_watch",
-	})
+	}, nil)
 	defer teardowntest()
 }
 
+func TestSetup_invalid(t *testing.T) {
+	for _, conf := range []config.Config{
+		{OutDir: "tests_invalid_out", MirrorPolicy: "sometimes"},
+		{OutDir: "tests_invalid_out", Ownership: "root"},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := receiver.ReceiverWithTransport(ctx, nil, conf, transport.NewChan(1)); err == nil {
+			t.Errorf("ReceiverWithTransport(%+v) expected error", conf)
+		}
+		cancel()
+		// No stage was started
+		if _, err := os.Stat(conf.OutDir); !os.IsNotExist(err) {
+			os.RemoveAll(conf.OutDir)
+			t.Errorf("ReceiverWithTransport(%+v) created the out dir before failing", conf)
+		}
+	}
+}
+
 func TestFileTransfer(t *testing.T) {
 	type args struct {
 		file_sizes []int
@@ -226,6 +277,46 @@ func TestFileTransfer(t *testing.T) {
 					EncryptedOutput:  true,
 					ChunkFecRequired: 5,
 					ChunkFecTotal:    10,
+					InterleaveDepth:  4,
+					OutDir:           "tests_out",
+					WatchDir:         "tests_watch",
+				},
+			},
+		},
+		{
+			name: "Transfer files in batches",
+			args: args{
+				[]int{500, 1024 * 1024},
+				config.Config{
+					ReceiverIP:       "127.0.0.1",
+					ReceiverPort:     randint(30000) + 30000,
+					UdpBatchSize:     64,
+					UdpOffload:       true,
+					UdpSockets:       4,
+					UdpReadBuffer:    4 << 20,
+					BandwidthLimit:   100 * 1024,
+					ChunkSize:        8192,
+					EncryptedOutput:  false,
+					ChunkFecRequired: 5,
+					ChunkFecTotal:    10,
+					OutDir:           "tests_out",
+					WatchDir:         "tests_watch",
+				},
+			},
+		},
+		{
+			name: "Transfer files over tcp",
+			args: args{
+				[]int{500, 1024 * 1024},
+				config.Config{
+					ReceiverIP:       "127.0.0.1",
+					ReceiverPort:     randint(30000) + 30000,
+					Transport:        "tcp",
+					BandwidthLimit:   100 * 1024,
+					ChunkSize:        8192,
+					EncryptedOutput:  false,
+					ChunkFecRequired: 5,
+					ChunkFecTotal:    10,
 					OutDir:           "tests_out",
 					WatchDir:         "tests_watch",
 				},
@@ -234,14 +325,14 @@ func TestFileTransfer(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			senderdb, receiverdb, teardowntest := setupTest(t, tt.args.conf)
+			senderdb, receiverdb, teardowntest := setupTest(t, tt.args.conf, nil)
 			defer teardowntest()
 
 			for _, filesize := range tt.args.file_sizes {
 				testfile := tempFile(t, filesize, "")
 				defer os.Remove(testfile)
 
-				err := database.QueueFileForSending(senderdb, testfile, tt.args.conf.EncryptedOutput)
+				err := database.QueueFileForSending(senderdb, testfile, database.SendOptions{Encrypted: tt.args.conf.EncryptedOutput})
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -265,7 +356,7 @@ func TestWatcherFiles(t *testing.T) {
 		OutDir:           "tests_out",
 		WatchDir:         "tests_watch",
 	}
-	_, receiverdb, teardowntest := setupTest(t, conf)
+	_, receiverdb, teardowntest := setupTest(t, conf, nil)
 	defer teardowntest()
 
 	for i := 0; i < 30; i++ {
@@ -301,3 +392,52 @@ func TestWatcherFiles(t *testing.T) {
 		defer waitForFinishedFile(t, receiverdb, tempfile, time.Now().Add(time.Minute*5), conf.OutDir)
 	}
 }
+
+// Runs the sender and receiver in process over a simulated link, the seeds keep the impairments the same from run to run
+// whatever order the sender's workers send the datagrams in
+func TestLossyLink(t *testing.T) {
+	conf := config.Config{
+		BandwidthLimit:   1024 * 1024,
+		ChunkSize:        8192,
+		ChunkFecRequired: 5,
+		ChunkFecTotal:    10,
+		OutDir:           "tests_out",
+		WatchDir:         "tests_watch",
+	}
+	interleaved := conf
+	interleaved.InterleaveDepth = 8
+
+	tests := []struct {
+		name        string
+		conf        config.Config
+		impairments transport.Impairments
+		delivered   bool
+	}{
+		{"Random loss within FEC", conf, transport.Impairments{Seed: 1, Loss: 0.2}, true},
+		{"Bursts within FEC", conf, transport.Impairments{Seed: 2, Loss: 0.02, BurstRate: 0.01, BurstLength: 4}, true},
+		{"Duplication reordering and corruption", conf, transport.Impairments{Seed: 3, Duplicate: 0.1, Reorder: 0.1, ReorderDepth: 20, Corrupt: 0.05}, true},
+		{"Everything at once", interleaved, transport.Impairments{Seed: 4, Loss: 0.05, BurstRate: 0.002, BurstLength: 3, Duplicate: 0.05, Reorder: 0.05, ReorderDepth: 10, Corrupt: 0.02}, true},
+		{"Loss beyond FEC", conf, transport.Impairments{Seed: 5, Loss: 0.7}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link := transport.NewLossy(transport.NewChan(1000), tt.impairments)
+			senderdb, receiverdb, teardowntest := setupTest(t, tt.conf, link)
+			defer teardowntest()
+			defer func() { t.Logf("Link with seed %d: %v", tt.impairments.Seed, link.Stats()) }()
+
+			testfile := tempFile(t, 1024*1024, "")
+			defer os.Remove(testfile)
+			err := database.QueueFileForSending(senderdb, testfile, database.SendOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.delivered {
+				waitForFinishedFile(t, receiverdb, testfile, time.Now().Add(2*time.Minute), tt.conf.OutDir)
+			} else {
+				waitForUndelivered(t, receiverdb, testfile, time.Now().Add(2*time.Minute))
+			}
+		})
+	}
+}